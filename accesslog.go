@@ -0,0 +1,113 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AccessRecord describes a connection accepted by a CMux, once it is closed.
+// See WithAccessLog.
+type AccessRecord struct {
+	// ID is the ID of the connection. See MuxConn.ID.
+	ID uint64
+	// Matched is whether the connection was matched by a listener.
+	Matched bool
+	// MatchedProtocol is the name of the listener that accepted the
+	// connection. See MuxConn.MatchedProtocol.
+	MatchedProtocol string
+	// RemoteAddr is the remote address of the connection.
+	RemoteAddr net.Addr
+	// Start is when the connection was accepted, and Duration how long it
+	// was open.
+	Start    time.Time
+	Duration time.Duration
+	// BytesRead and BytesWritten are the bytes read from and written to the
+	// connection. See MuxConn.BytesRead and MuxConn.BytesWritten.
+	BytesRead    uint64
+	BytesWritten uint64
+	// Err is why the connection was closed: the error reported to the
+	// ErrorHandler if it was not matched, ErrServerClosed if the mux was
+	// closed before it was delivered, or else the first error returned by
+	// its Read or Write methods (e.g., io.EOF when the client closed it). It
+	// is nil if the connection was closed by the server without error.
+	Err error
+}
+
+// WithAccessLog makes the mux call log once for every connection it accepts,
+// when the connection is closed, so that the connections of all the protocols
+// served on a port end up in a single log. Matched connections are logged
+// when their Close method is called, from the goroutine calling it, so log
+// should not block.
+func WithAccessLog(log func(AccessRecord)) Option {
+	return func(m *cMux) {
+		m.accessLog = log
+	}
+}
+
+// connLog is the state of a connection for the access log.
+type connLog struct {
+	log   func(AccessRecord)
+	start time.Time
+
+	mu   sync.Mutex
+	err  error
+	done bool
+}
+
+// fail records err as the reason the connection is closed, unless there is
+// already one.
+func (l *connLog) fail(err error) {
+	l.mu.Lock()
+	if l.err == nil {
+		l.err = err
+	}
+	l.mu.Unlock()
+}
+
+// logClose logs m with err as the reason it is closed, unless there is
+// already one. It only logs m once.
+func (m *MuxConn) logClose(err error) {
+	l := m.alog
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	if l.done {
+		l.mu.Unlock()
+		return
+	}
+	l.done = true
+	if l.err == nil {
+		l.err = err
+	}
+	rec := AccessRecord{
+		ID:              m.info.ID,
+		Matched:         m.lstats != nil,
+		MatchedProtocol: m.info.MatchedProtocol,
+		RemoteAddr:      m.Conn.RemoteAddr(),
+		Start:           l.start,
+		Duration:        time.Since(l.start),
+		BytesRead:       m.BytesRead(),
+		BytesWritten:    m.BytesWritten(),
+		Err:             l.err,
+	}
+	l.mu.Unlock()
+
+	l.log(rec)
+}
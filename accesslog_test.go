@@ -0,0 +1,72 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	defer leakCheck(t)()
+
+	recs := make(chan AccessRecord, 2)
+	l := newChanListener()
+	defer close(l.connCh)
+	muxl := New(l, WithAccessLog(func(r AccessRecord) { recs <- r }))
+	hellol := muxl.MatchNamed("hello", PrefixMatcher("hello"))
+	errc := serveErrors(t, muxl)
+
+	// A matched connection, closed by the server.
+	w, r := net.Pipe()
+	defer func() { _ = w.Close() }()
+	writeAsync(w, "hello!")
+	l.connCh <- r
+	c, err := hellol.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b [6]byte
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = io.ReadFull(w, b[:2])
+	}()
+	if _, err := io.WriteString(c, "ok"); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+
+	rec := <-recs
+	if !rec.Matched || rec.MatchedProtocol != "hello" || rec.ID == 0 ||
+		rec.BytesRead != 6 || rec.BytesWritten != 2 || rec.Err != nil ||
+		rec.RemoteAddr == nil || rec.Start.IsZero() {
+		t.Errorf("unexpected record for a matched connection: %+v", rec)
+	}
+
+	// A connection that is not matched.
+	w2, r2 := net.Pipe()
+	defer func() { _ = w2.Close() }()
+	writeAsync(w2, "bye!!!")
+	l.connCh <- r2
+	<-errc
+
+	rec = <-recs
+	if _, ok := rec.Err.(ErrNotMatched); rec.Matched || !ok {
+		t.Errorf("unexpected record for an unmatched connection: %+v", rec)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"net"
+)
+
+// VirtualAddr is a net.Addr made of arbitrary strings, e.g., to name the
+// protocol served by a listener returned by a CMux. See ListenerWithAddr.
+type VirtualAddr struct {
+	// Net is the name of the network, returned by Network.
+	Net string
+	// Address is the address, returned by String.
+	Address string
+}
+
+// Network returns a.Net.
+func (a VirtualAddr) Network() string { return a.Net }
+
+// String returns a.Address.
+func (a VirtualAddr) String() string { return a.Address }
+
+type addrListener struct {
+	net.Listener
+	addr net.Addr
+}
+
+// ListenerWithAddr wraps l so that its Addr method returns addr. The
+// listeners returned by a CMux all report the address of the root listener;
+// it lets each of them report something meaningful for its protocol, in logs
+// or for servers advertising their listen address:
+//
+//	grpcl := cmux.ListenerWithAddr(m.Match(cmux.HTTP2()),
+//		cmux.VirtualAddr{Net: "tcp", Address: "grpc://" + l.Addr().String()})
+func ListenerWithAddr(l net.Listener, addr net.Addr) net.Listener {
+	return &addrListener{Listener: l, addr: addr}
+}
+
+func (l *addrListener) Addr() net.Addr {
+	return l.addr
+}
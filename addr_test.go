@@ -0,0 +1,44 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenerWithAddr(t *testing.T) {
+	defer leakCheck(t)()
+
+	l := newChanListener()
+	defer close(l.connCh)
+	muxl := New(l)
+	addr := VirtualAddr{Net: "tcp", Address: "hello://127.0.0.1:80"}
+	hellol := ListenerWithAddr(muxl.Match(PrefixMatcher("hello")), addr)
+	if a := hellol.Addr(); a != addr || a.Network() != "tcp" || a.String() != addr.Address {
+		t.Errorf("unexpected address: %v", a)
+	}
+	serveErrors(t, muxl)
+
+	w, r := net.Pipe()
+	defer func() { _ = w.Close() }()
+	writeAsync(w, "hello!")
+	l.connCh <- r
+	c, err := hellol.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// WithConnGate registers gate to decide whether the accepted connections
+// are matched. It is called right after a connection is accepted, before
+// any byte is read from it or any buffer is allocated for it, e.g. to cap
+// the connections per client or to consult a reputation service. A
+// connection gate rejects is closed, counted by CMux.Rejected and reported
+// to the ErrorHandler as an ErrConnRejected with reason.
+//
+// Gates are called in the order they are registered, after the policy of
+// WithIPPolicy if it is registered first. They are called from the
+// goroutine accepting connections, so a slow gate, e.g. one tarpitting a
+// client before rejecting it, holds up accepting; use WithAcceptLoops to
+// accept on several goroutines.
+func WithConnGate(gate func(c net.Conn) (allow bool, reason string)) Option {
+	return func(m *cMux) {
+		m.admitters = append(m.admitters, gate)
+	}
+}
+
+// admitter decides whether the connection c is sniffed. If not, it returns
+// false and the reason why.
+type admitter func(c net.Conn) (allow bool, reason string)
+
+// admit runs the admitters on c, and returns false after closing and
+// reporting c if one of them rejects it.
+func (m *cMux) admit(c net.Conn) bool {
+	for _, a := range m.admitters {
+		if allow, reason := a(c); !allow {
+			atomic.AddUint64(&m.rejected, 1)
+			_ = c.Close()
+			m.reportErr(ErrConnRejected{connError: connError{c: c}, reason: reason})
+			return false
+		}
+	}
+	return true
+}
+
+func (m *cMux) Rejected() uint64 {
+	return atomic.LoadUint64(&m.rejected)
+}
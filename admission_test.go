@@ -0,0 +1,62 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConnGate(t *testing.T) {
+	defer leakCheck(t)()
+	l, cleanup := testListener(t)
+	defer cleanup()
+
+	n := 0
+	gate := func(c net.Conn) (bool, string) {
+		n++
+		// Admit every other connection.
+		return n%2 == 1, "even connection"
+	}
+	muxl := New(l, WithConnGate(gate))
+	errs := make(chan error, 1)
+	muxl.HandleError(func(err error) bool {
+		errs <- err
+		return true
+	})
+	anyl := muxl.Match(Any())
+	go safeServe(nil, muxl)
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = c.Close() }()
+	}
+	ac, err := anyl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ac.Close()
+	err = <-errs
+	if re, ok := err.(ErrConnRejected); !ok || re.Reason() != "even connection" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if r := muxl.Rejected(); r != 1 {
+		t.Errorf("unexpected rejected count: %d", r)
+	}
+	cleanup()
+}
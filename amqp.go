@@ -0,0 +1,44 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+// The protocol headers AMQP clients send first.
+const (
+	amqp091Header = "AMQP\x00\x00\x09\x01"
+	// AMQP 1.0 headers carry a protocol ID: 0 for AMQP itself, 2 for TLS
+	// and 3 for SASL.
+	amqp10Header     = "AMQP\x00\x01\x00\x00"
+	amqp10TLSHeader  = "AMQP\x02\x01\x00\x00"
+	amqp10SASLHeader = "AMQP\x03\x01\x00\x00"
+)
+
+// AMQP matches the connections of AMQP 0-9-1 and AMQP 1.0 clients by their
+// protocol header. Use AMQP091 or AMQP10 to route the two versions to
+// different listeners.
+func AMQP() Matcher {
+	return PrefixMatcher(amqp091Header, amqp10Header, amqp10TLSHeader,
+		amqp10SASLHeader)
+}
+
+// AMQP091 matches the connections of AMQP 0-9-1 clients, e.g., of RabbitMQ.
+func AMQP091() Matcher {
+	return PrefixMatcher(amqp091Header)
+}
+
+// AMQP10 matches the connections of AMQP 1.0 clients, whether they start
+// with AMQP itself, a TLS or a SASL layer.
+func AMQP10() Matcher {
+	return PrefixMatcher(amqp10Header, amqp10TLSHeader, amqp10SASLHeader)
+}
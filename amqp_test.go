@@ -0,0 +1,49 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAMQP(t *testing.T) {
+	for _, test := range []struct {
+		header         string
+		any, v091, v10 bool
+	}{
+		{"AMQP\x00\x00\x09\x01", true, true, false},
+		{"AMQP\x00\x01\x00\x00", true, false, true},
+		{"AMQP\x02\x01\x00\x00", true, false, true},
+		{"AMQP\x03\x01\x00\x00", true, false, true},
+		{"AMQP\x01\x01\x00\x09", false, false, false},
+		{"AMQP", false, false, false},
+		{"GET / HTTP/1.1\r\n\r\n", false, false, false},
+	} {
+		for _, m := range []struct {
+			name  string
+			m     Matcher
+			match bool
+		}{
+			{"AMQP", AMQP(), test.any},
+			{"AMQP091", AMQP091(), test.v091},
+			{"AMQP10", AMQP10(), test.v10},
+		} {
+			if got := m.m(strings.NewReader(test.header)); got != m.match {
+				t.Errorf("%q: %s: want=%v got=%v", test.header, m.name, m.match, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"reflect"
+)
+
+// maxAutomatonMatchers is the maximum number of matchers compiled into a
+// prefixAutomaton, so that the matched ones fit in a bitmask.
+const maxAutomatonMatchers = 64
+
+// matcherKind is what a mux knows of a matcher without calling it.
+type matcherKind struct {
+	// tree is the patricia tree of a pure prefix matcher, i.e., a matcher
+	// returned by PrefixMatcher, PrefixByteMatcher, HTTP1Fast, HTTP1Methods
+	// or TLS used as is.
+	tree *patriciaTree
+	// any is whether the matcher is Any.
+	any bool
+}
+
+var (
+	prefixMatcherCode = reflect.ValueOf((&patriciaTree{}).matchPrefix).Pointer()
+	anyMatcherCode    = reflect.ValueOf(anyMatcher).Pointer()
+)
+
+// kindOf identifies m by its code. Only the matchers of cmux are
+// recognized, so that matchers with side effects are never called outside
+// of matching.
+func kindOf(m Matcher) matcherKind {
+	switch reflect.ValueOf(m).Pointer() {
+	case prefixMatcherCode:
+		p := &prefixProbe{}
+		m(p)
+		return matcherKind{tree: p.tree}
+	case anyMatcherCode:
+		return matcherKind{any: true}
+	}
+	return matcherKind{}
+}
+
+// prefixProbe is passed to the pure prefix matchers to get their patricia
+// tree, which records itself in the probe without reading.
+type prefixProbe struct {
+	tree *patriciaTree
+}
+
+func (p *prefixProbe) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// prefixAutomaton is a trie of the prefixes of the leading pure prefix
+// matchers of a CMux, keyed to the matchers owning them, so that these
+// matchers are all evaluated in a single walk over the sniffed bytes instead
+// of one walk per matcher.
+type prefixAutomaton struct {
+	root *prefixNode
+	// depths are the max depths of the trees of the matchers, i.e., the
+	// number of bytes each matcher reads.
+	depths []int
+	// listeners are the indices, in cMux.sls, of the listeners owning the
+	// matchers, and matchers the indices of the matchers in their
+	// listeners.
+	listeners []int
+	matchers  []int
+}
+
+type prefixNode struct {
+	next map[byte]*prefixNode
+	// owners is the set of matchers with a prefix ending at this node.
+	owners uint64
+}
+
+// compileDirect checks whether m has a single listener, whose only matcher
+// is Any, in which case connections are handed to the listener without
+// being sniffed. The listeners of MatchUnmatched and MatchNoBytes have no
+// matchers and are not counted, since no connection reaches them then.
+func (m *cMux) compileDirect() {
+	m.direct = -1
+	for i, sl := range m.sls {
+		if len(sl.ss) == 0 {
+			continue
+		}
+		if m.direct >= 0 || len(sl.ss) != 1 || !sl.kinds[0].any {
+			m.direct = -1
+			return
+		}
+		m.direct = i
+	}
+}
+
+// compilePrefixes compiles the leading pure prefix matchers of m into an
+// automaton. The automaton is only used when there are at least two such
+// matchers, as a single tree is already matched in one walk.
+func (m *cMux) compilePrefixes() {
+	a := &prefixAutomaton{root: &prefixNode{}}
+	func() {
+		for i, sl := range m.sls {
+			for j, k := range sl.kinds {
+				if len(a.depths) == maxAutomatonMatchers {
+					return
+				}
+				t := k.tree
+				if t == nil {
+					return
+				}
+				a.add(t)
+				a.listeners = append(a.listeners, i)
+				a.matchers = append(a.matchers, j)
+			}
+		}
+	}()
+
+	if len(a.depths) < 2 {
+		m.prefixes = nil
+		return
+	}
+	m.prefixes = a
+}
+
+func (a *prefixAutomaton) add(t *patriciaTree) {
+	owner := uint64(1) << uint(len(a.depths))
+	for _, p := range t.prefixes {
+		n := a.root
+		for _, b := range p {
+			next, ok := n.next[b]
+			if !ok {
+				if n.next == nil {
+					n.next = make(map[byte]*prefixNode)
+				}
+				next = &prefixNode{}
+				n.next[b] = next
+			}
+			n = next
+		}
+		n.owners |= owner
+	}
+	a.depths = append(a.depths, t.maxDepth)
+}
+
+// match returns the index of the first matcher, in registration order,
+// matching the bytes sniffed by r, or -1 if none does. Each matcher sees the
+// same bytes it would see if it read them itself, so the result is the one
+// of evaluating the matchers one by one. r is not advanced.
+//
+// If reading from r failed, failed is the index of the matcher that was
+// being evaluated then, and -1 otherwise.
+func (a *prefixAutomaton) match(r *bufferedReader) (matched, failed int) {
+	n := a.root
+	seen := n.owners
+	depth := 0
+	failed = -1
+	for i, d := range a.depths {
+		owner := uint64(1) << uint(i)
+		// Only wait for more bytes while they can still decide the match,
+		// so that a short message of another protocol, e.g., a SOCKS
+		// greeting, does not wait for bytes that never come.
+		for n != nil && seen&owner == 0 && depth < d {
+			b := r.peek(depth + 1)
+			if failed < 0 && r.sniffErr != nil {
+				failed = i
+			}
+			if depth >= len(b) {
+				break
+			}
+			if n = n.next[b[depth]]; n != nil {
+				seen |= n.owners
+			}
+			depth++
+		}
+		if seen&owner != 0 {
+			return i, failed
+		}
+	}
+	return -1, failed
+}
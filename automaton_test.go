@@ -0,0 +1,122 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestKindOf(t *testing.T) {
+	pm := PrefixMatcher("foo")
+	cases := []struct {
+		name string
+		m    Matcher
+		pure bool
+		any  bool
+	}{
+		{"prefix", pm, true, false},
+		{"prefix bytes", PrefixByteMatcher([]byte{0, 1}), true, false},
+		{"http1fast", HTTP1Fast(), true, false},
+		{"http1methods", HTTP1Methods("PROPFIND"), true, false},
+		{"tls", TLS(), true, false},
+		{"any", Any(), false, true},
+		{"http2", HTTP2(), false, false},
+		{"wrapped", func(r io.Reader) bool { return pm(r) }, false, false},
+		{"negated", func(r io.Reader) bool { return !pm(r) }, false, false},
+		{"constant", func(io.Reader) bool { return true }, false, false},
+	}
+	for _, c := range cases {
+		k := kindOf(c.m)
+		if pure := k.tree != nil; pure != c.pure || k.any != c.any {
+			t.Errorf("%s: pure=%v any=%v, want %v and %v", c.name, pure, k.any, c.pure, c.any)
+		}
+	}
+}
+
+func TestMatchDoesNotCallMatchers(t *testing.T) {
+	calls := 0
+	counting := func(r io.Reader) bool {
+		calls++
+		return true
+	}
+	m := New(nil)
+	m.Match(counting)
+	m.MatchWithWriters(func(w io.Writer, r io.Reader) bool { return counting(r) })
+	if calls != 0 {
+		t.Errorf("matchers called %d times when registered", calls)
+	}
+}
+
+func TestPrefixAutomaton(t *testing.T) {
+	m := New(nil).(*cMux)
+	m.Match(PrefixMatcher("GET /a"))
+	m.Match(HTTP1Fast())
+	m.Match(PrefixMatcher("GE"), TLS())
+	m.Match(Any())
+
+	a := m.prefixes
+	if a == nil {
+		t.Fatal("prefix matchers are not compiled")
+	}
+	if len(a.depths) != 4 {
+		t.Fatalf("%d matchers compiled, want 4", len(a.depths))
+	}
+
+	cases := []struct {
+		data    string
+		matcher int
+	}{
+		{"GET /a HTTP/1.1\r\n", 0},
+		{"GET /b HTTP/1.1\r\n", 1},
+		{"GEX and more", 2},
+		{"\x16\x03\x01 and more", 3},
+		{"SSH-2.0-OpenSSH", -1},
+		{"GE", 2},
+		{"", -1},
+	}
+	for _, c := range cases {
+		br := bufferedReader{source: strings.NewReader(c.data)}
+		br.reset(true)
+		if got, _ := a.match(&br); got != c.matcher {
+			t.Errorf("%q matched by %d, want %d", c.data, got, c.matcher)
+		}
+		if len(c.data) > 0 && string(br.buffered()) == "" {
+			t.Errorf("%q: sniffed bytes are not buffered", c.data)
+		}
+	}
+}
+
+func TestPrefixAutomatonStopsAtOtherMatchers(t *testing.T) {
+	m := New(nil).(*cMux)
+	m.Match(PrefixMatcher("foo"))
+	if m.prefixes != nil {
+		t.Error("a single prefix matcher is compiled")
+	}
+	m.Match(HTTP2())
+	m.Match(PrefixMatcher("bar"))
+	if m.prefixes != nil {
+		t.Error("prefix matchers after another matcher are compiled")
+	}
+
+	m = New(nil).(*cMux)
+	m.Match(PrefixMatcher("foo"))
+	m.Match(PrefixMatcher("bar"))
+	m.Match(HTTP2())
+	if m.prefixes == nil || len(m.prefixes.depths) != 2 {
+		t.Error("leading prefix matchers are not compiled")
+	}
+}
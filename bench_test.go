@@ -23,16 +23,42 @@ import (
 	"time"
 
 	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
 )
 
 var (
-	benchHTTP1Payload = make([]byte, 4096)
-	benchHTTP2Payload = make([]byte, 4096)
+	benchHTTP1Payload       = make([]byte, 4096)
+	benchHTTP2Payload       = make([]byte, 4096)
+	benchHTTP2HeaderPayload []byte
 )
 
 func init() {
 	copy(benchHTTP1Payload, []byte("GET http://www.w3.org/ HTTP/1.1"))
 	copy(benchHTTP2Payload, http2.ClientPreface)
+
+	var hbuf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+	for _, f := range []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/grpc.health.v1.Health/Check"},
+		{Name: ":authority", Value: "localhost:50051"},
+		{Name: "content-type", Value: "application/grpc"},
+		{Name: "user-agent", Value: "grpc-go/1.27.0"},
+		{Name: "te", Value: "trailers"},
+	} {
+		_ = enc.WriteField(f)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(http2.ClientPreface)
+	framer := http2.NewFramer(&buf, nil)
+	_ = framer.WriteSettings()
+	_ = framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: hbuf.Bytes(),
+		EndHeaders:    true,
+	})
+	benchHTTP2HeaderPayload = buf.Bytes()
 }
 
 type mockConn struct {
@@ -97,6 +123,26 @@ func BenchmarkCMuxConnHTTP2(b *testing.B) {
 	})
 }
 
+func BenchmarkCMuxConnHTTP2Header(b *testing.B) {
+	m := New(nil).(*cMux)
+	l := m.Match(HTTP2HeaderField("content-type", "application/grpc"))
+	go discard(l)
+
+	donec := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			wg.Add(1)
+			m.serve(&mockConn{
+				r: bytes.NewReader(benchHTTP2HeaderPayload),
+			}, donec, &wg)
+		}
+	})
+}
+
 func BenchmarkCMuxConnHTTP1n2(b *testing.B) {
 	m := New(nil).(*cMux)
 	l1 := m.Match(HTTP1Fast())
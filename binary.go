@@ -0,0 +1,141 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// BinaryMatcherBuilder builds a Matcher for a binary protocol from the
+// fields of its header, so that in-house protocols can be matched without
+// parsing the connection by hand:
+//
+//	m := cmux.BinaryProtocol().
+//		Bytes(0, []byte{0xca, 0xfe}).              // magic
+//		Uint(2, 1, nil, 1, 3).                     // version 1 to 3
+//		Bits(3, 0x80, 0x00).                       // reserved bit unset
+//		Uint(4, 4, binary.LittleEndian, 0, 1<<20). // payload length
+//		Matcher()
+//
+// Offsets are from the start of the connection. The fields are checked in
+// the order they end, reading only as many bytes as needed, so that a
+// connection of another protocol is rejected as early as possible.
+type BinaryMatcherBuilder struct {
+	checks []binaryCheck
+}
+
+type binaryCheck struct {
+	offset, length int
+	ok             func(b []byte) bool
+	// magic is the expected bytes of a Bytes check.
+	magic []byte
+}
+
+// BinaryProtocol returns an empty BinaryMatcherBuilder.
+func BinaryProtocol() *BinaryMatcherBuilder {
+	return &BinaryMatcherBuilder{}
+}
+
+// Bytes checks that the bytes at offset are magic.
+func (b *BinaryMatcherBuilder) Bytes(offset int, magic []byte) *BinaryMatcherBuilder {
+	magic = append([]byte(nil), magic...)
+	b.checks = append(b.checks, binaryCheck{
+		offset: offset,
+		length: len(magic),
+		ok: func(p []byte) bool {
+			return string(p) == string(magic)
+		},
+		magic: magic,
+	})
+	return b
+}
+
+// Uint checks that the unsigned integer of size bytes (1, 2, 4 or 8) at
+// offset, in the given byte order, is between min and max, inclusive. The
+// byte order is ignored for single bytes.
+func (b *BinaryMatcherBuilder) Uint(offset, size int, order binary.ByteOrder, min, max uint64) *BinaryMatcherBuilder {
+	var read func([]byte) uint64
+	switch size {
+	case 1:
+		read = func(p []byte) uint64 { return uint64(p[0]) }
+	case 2:
+		read = func(p []byte) uint64 { return uint64(order.Uint16(p)) }
+	case 4:
+		read = func(p []byte) uint64 { return uint64(order.Uint32(p)) }
+	case 8:
+		read = order.Uint64
+	default:
+		panic("cmux: invalid integer size")
+	}
+	b.checks = append(b.checks, binaryCheck{
+		offset: offset,
+		length: size,
+		ok: func(p []byte) bool {
+			v := read(p)
+			return v >= min && v <= max
+		},
+	})
+	return b
+}
+
+// Bits checks that the bits of mask in the byte at offset are those of
+// value.
+func (b *BinaryMatcherBuilder) Bits(offset int, mask, value byte) *BinaryMatcherBuilder {
+	b.checks = append(b.checks, binaryCheck{
+		offset: offset,
+		length: 1,
+		ok: func(p []byte) bool {
+			return p[0]&mask == value&mask
+		},
+	})
+	return b
+}
+
+// Matcher returns the Matcher of the fields. A builder checking only bytes at
+// offset 0 returns a prefix matcher, which is compiled into the automaton of
+// the leading prefix matchers of a CMux.
+func (b *BinaryMatcherBuilder) Matcher() Matcher {
+	checks := append([]binaryCheck(nil), b.checks...)
+	if len(checks) == 1 && checks[0].magic != nil && checks[0].offset == 0 {
+		return PrefixByteMatcher(checks[0].magic)
+	}
+	sort.SliceStable(checks, func(i, j int) bool {
+		return checks[i].offset+checks[i].length < checks[j].offset+checks[j].length
+	})
+	need := 0
+	if len(checks) > 0 {
+		last := checks[len(checks)-1]
+		need = last.offset + last.length
+	}
+
+	return func(r io.Reader) bool {
+		buf := make([]byte, need)
+		n := 0
+		for _, c := range checks {
+			if end := c.offset + c.length; end > n {
+				if _, err := io.ReadFull(r, buf[n:end]); err != nil {
+					return false
+				}
+				n = end
+			}
+			if !c.ok(buf[c.offset : c.offset+c.length]) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// countingReader counts the reads from r.
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (s *countingReader) Read(p []byte) (int, error) {
+	s.reads++
+	return s.r.Read(p)
+}
+
+func TestBinaryMatcher(t *testing.T) {
+	m := BinaryProtocol().
+		Bytes(0, []byte{0xca, 0xfe}).
+		Uint(2, 1, nil, 1, 3).
+		Bits(3, 0x80, 0x00).
+		Uint(4, 4, binary.LittleEndian, 0, 1<<20).
+		Matcher()
+
+	for _, test := range []struct {
+		name  string
+		in    []byte
+		match bool
+	}{
+		{"valid", []byte{0xca, 0xfe, 2, 0x7f, 0, 1, 0, 0, 'x'}, true},
+		{"bad magic", []byte{0xca, 0xff, 2, 0, 0, 0, 0, 0}, false},
+		{"bad version", []byte{0xca, 0xfe, 4, 0, 0, 0, 0, 0}, false},
+		{"reserved bit", []byte{0xca, 0xfe, 1, 0x80, 0, 0, 0, 0}, false},
+		{"too long", []byte{0xca, 0xfe, 1, 0, 0, 0, 0x20, 0}, false},
+		{"short", []byte{0xca, 0xfe, 1}, false},
+	} {
+		if got := m(bytes.NewReader(test.in)); got != test.match {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.match)
+		}
+	}
+
+	// A bad magic is rejected before the rest is read.
+	r := &countingReader{r: bytes.NewReader([]byte{0x00, 0x00})}
+	if m(r) || r.reads != 1 {
+		t.Errorf("unexpected reads: %d", r.reads)
+	}
+}
+
+func TestBinaryMatcherPrefix(t *testing.T) {
+	m := BinaryProtocol().Bytes(0, []byte{0xca, 0xfe}).Matcher()
+	if kindOf(m).tree == nil {
+		t.Error("the matcher of a magic prefix is not a prefix matcher")
+	}
+	if !m(bytes.NewReader([]byte{0xca, 0xfe, 0})) || m(bytes.NewReader([]byte{0xca})) {
+		t.Error("unexpected match")
+	}
+}
@@ -15,22 +15,141 @@
 package cmux
 
 import (
-	"bytes"
 	"io"
+	"sync"
+	"sync/atomic"
 )
 
+const (
+	// defaultSniffBufferSize is the default initial capacity of sniff
+	// buffers.
+	defaultSniffBufferSize = 64
+	// maxPooledBufferSize is the capacity above which sniff buffers are not
+	// returned to the pool, so that a single deep sniff does not pin memory.
+	maxPooledBufferSize = 64 << 10
+)
+
+// SniffBufferPolicy configures the buffers in which a CMux keeps the bytes
+// sniffed by the matchers. The zero value is the default policy.
+type SniffBufferPolicy struct {
+	// InitialSize is the initial capacity of the sniff buffer of a
+	// connection. Muxes whose matchers only need short prefixes (e.g., the
+	// 24 bytes of the HTTP/2 preface) can use a small size, and muxes
+	// matching deep HTTP/2 headers can presize the buffer. It defaults to 64
+	// bytes.
+	InitialSize int
+	// Grow returns the new capacity of a sniff buffer of capacity c that
+	// needs to hold n bytes. Capacities smaller than n are rounded up to n.
+	// It defaults to doubling the capacity.
+	Grow func(c, n int) int
+}
+
+// sniffBuffers are the pooled sniff buffers of a SniffBufferPolicy.
+type sniffBuffers struct {
+	pool sync.Pool
+	size int
+	grow func(c, n int) int
+}
+
+var defaultSniffBuffers = newSniffBuffers(SniffBufferPolicy{})
+
+func newSniffBuffers(p SniffBufferPolicy) *sniffBuffers {
+	size := p.InitialSize
+	if size <= 0 {
+		size = defaultSniffBufferSize
+	}
+	bs := &sniffBuffers{size: size, grow: p.Grow}
+	if bs.grow == nil {
+		bs.grow = func(c, n int) int { return 2 * c }
+	}
+	bs.pool.New = func() interface{} {
+		b := make([]byte, 0, size)
+		return &b
+	}
+	return bs
+}
+
+// sniffMemory tracks the memory held by the sniff buffers of a CMux, so that
+// accepting can pause while it is above a limit.
+type sniffMemory struct {
+	// used is accessed atomically and must stay 64-bit aligned.
+	used  int64
+	limit int64
+	// below is signaled when used goes below the limit.
+	below chan struct{}
+}
+
+func newSniffMemory(limit int64) *sniffMemory {
+	return &sniffMemory{
+		limit: limit,
+		below: make(chan struct{}, 1),
+	}
+}
+
+func (sm *sniffMemory) add(n int64) {
+	if atomic.AddInt64(&sm.used, n) <= sm.limit && n < 0 {
+		select {
+		case sm.below <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wait blocks while the memory in use is above the limit, or until donec is
+// closed.
+func (sm *sniffMemory) wait(donec <-chan struct{}) {
+	waited := false
+	for atomic.LoadInt64(&sm.used) > sm.limit {
+		waited = true
+		select {
+		case <-sm.below:
+		case <-donec:
+			return
+		}
+	}
+	if waited {
+		// Pass the signal on to the other accept loops, if any.
+		select {
+		case sm.below <- struct{}{}:
+		default:
+		}
+	}
+}
+
 // bufferedReader is an optimized implementation of io.Reader that behaves like
 // ```
 // io.MultiReader(bytes.NewReader(buffer.Bytes()), io.TeeReader(source, buffer))
 // ```
 // without allocating.
+//
+// While sniffing, the source is read bufio style: straight into the free
+// space of a single buffer shared by all the matchers, and the bytes are
+// copied out of it, so every sniffed byte is stored once. Each matcher
+// replays what the previous ones have read before reading more from the
+// source, and the connection's consumer replays it after sniffing is done.
+// The buffer is taken from a pool when sniffing starts, and is returned to it
+// as soon as the sniffed bytes are consumed after sniffing is done; from then
+// on, reads go directly to the source.
 type bufferedReader struct {
-	source     io.Reader
-	buffer     bytes.Buffer
+	// held is the memory accounted for the buffer in mem. It is accessed
+	// atomically and must stay 64-bit aligned.
+	held int64
+	// mem tracks the memory of the buffers of the mux, if limited.
+	mem *sniffMemory
+
+	source io.Reader
+	// bufs are the buffers to use, defaultSniffBuffers if nil.
+	bufs   *sniffBuffers
+	buffer []byte
+	// bufferRead is the read position in the buffer.
 	bufferRead int
+	// bufferSize is the number of bytes that can be replayed. While sniffing
+	// it is always len(buffer).
 	bufferSize int
 	sniffing   bool
 	lastErr    error
+	// sniffErr is the first error returned by the source while sniffing.
+	sniffErr error
 }
 
 func (s *bufferedReader) Read(p []byte) (int, error) {
@@ -39,29 +158,162 @@ func (s *bufferedReader) Read(p []byte) (int, error) {
 		// same data and the last error if any. We need to immediately return,
 		// otherwise we may block for ever, if we try to be smart and call
 		// source.Read() seeking a little bit of more data.
-		bn := copy(p, s.buffer.Bytes()[s.bufferRead:s.bufferSize])
+		bn := copy(p, s.buffer[s.bufferRead:s.bufferSize])
 		s.bufferRead += bn
+		if !s.sniffing && s.bufferRead == s.bufferSize {
+			// We don't need the buffer anymore.
+			s.release()
+		}
 		return bn, s.lastErr
-	} else if !s.sniffing && s.buffer.Cap() != 0 {
-		// We don't need the buffer anymore.
-		// Reset it to release the internal slice.
-		s.buffer = bytes.Buffer{}
 	}
 
-	// If there is nothing more to return in the sniffed buffer, read from the
-	// source.
-	sn, sErr := s.source.Read(p)
-	if sn > 0 && s.sniffing {
-		s.lastErr = sErr
-		if wn, wErr := s.buffer.Write(p[:sn]); wErr != nil {
-			return wn, wErr
+	if !s.sniffing {
+		// If there is nothing more to return in the sniffed buffer, read from
+		// the source.
+		return s.source.Read(p)
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// Make room for as much as p can hold, but do not grow the buffer
+	// beyond its initial size just for that.
+	n := len(p)
+	if size := s.buffers().size; n > size {
+		n = size
+	}
+	sn, sErr := s.fill(n)
+	if sn == 0 {
+		return 0, sErr
+	}
+	bn := copy(p, s.buffer[s.bufferRead:s.bufferSize])
+	s.bufferRead += bn
+	if s.bufferRead < s.bufferSize {
+		// The rest, and the error, are returned by the next reads.
+		return bn, nil
+	}
+	return bn, sErr
+}
+
+// next returns the next n bytes like io.ReadFull would, except that the bytes
+// are not copied out of the buffer. It returns fewer bytes only if reading
+// from the source fails. It must only be used while sniffing, and the
+// returned slice is only valid until the next read.
+func (s *bufferedReader) next(n int) []byte {
+	b := s.peek(n)
+	s.bufferRead += len(b)
+	return b
+}
+
+// peek is like next but does not advance the read position.
+func (s *bufferedReader) peek(n int) []byte {
+	for s.bufferSize-s.bufferRead < n {
+		if s.bufferSize > s.bufferRead && s.lastErr != nil {
+			// We will not get more than what is already buffered.
+			break
+		}
+		if _, err := s.fill(n - (s.bufferSize - s.bufferRead)); err != nil {
+			break
 		}
 	}
+
+	if avail := s.bufferSize - s.bufferRead; n > avail {
+		n = avail
+	}
+	return s.buffer[s.bufferRead : s.bufferRead+n]
+}
+
+// fill reads from the source once, into the free space of the buffer after
+// making room for at least n bytes, and returns what the source returned.
+func (s *bufferedReader) fill(n int) (int, error) {
+	s.grow(n)
+	l := len(s.buffer)
+	sn, sErr := s.source.Read(s.buffer[l:cap(s.buffer)])
+	s.buffer = s.buffer[:l+sn]
+	s.bufferSize = len(s.buffer)
+	if sn > 0 {
+		s.lastErr = sErr
+	}
+	if sErr != nil && s.sniffErr == nil {
+		s.sniffErr = sErr
+	}
 	return sn, sErr
 }
 
+// grow makes room for n more bytes in the buffer.
+func (s *bufferedReader) grow(n int) {
+	bufs := s.buffers()
+	if s.buffer == nil {
+		s.buffer = *bufs.pool.Get().(*[]byte)
+		s.track(cap(s.buffer))
+	}
+	if cap(s.buffer)-len(s.buffer) >= n {
+		return
+	}
+	c := bufs.grow(cap(s.buffer), len(s.buffer)+n)
+	if c < len(s.buffer)+n {
+		c = len(s.buffer) + n
+	}
+	s.track(c - cap(s.buffer))
+	b := make([]byte, len(s.buffer), c)
+	copy(b, s.buffer)
+	s.buffer = b
+}
+
+func (s *bufferedReader) track(n int) {
+	if s.mem != nil {
+		atomic.AddInt64(&s.held, int64(n))
+		s.mem.add(int64(n))
+	}
+}
+
+// untrack stops accounting for the buffer. Unlike release, it is safe to
+// call concurrently with reads.
+func (s *bufferedReader) untrack() {
+	if s.mem == nil {
+		return
+	}
+	if n := atomic.SwapInt64(&s.held, 0); n != 0 {
+		s.mem.add(-n)
+	}
+}
+
+func (s *bufferedReader) buffers() *sniffBuffers {
+	if s.bufs == nil {
+		return defaultSniffBuffers
+	}
+	return s.bufs
+}
+
+// buffered returns the bytes that are buffered but not read yet.
+func (s *bufferedReader) buffered() []byte {
+	if s.bufferSize <= s.bufferRead {
+		return nil
+	}
+	return s.buffer[s.bufferRead:s.bufferSize]
+}
+
 func (s *bufferedReader) reset(snif bool) {
 	s.sniffing = snif
 	s.bufferRead = 0
-	s.bufferSize = s.buffer.Len()
+	s.bufferSize = len(s.buffer)
+	if !snif && s.bufferSize == 0 {
+		s.release()
+	}
+}
+
+// release returns the buffer to the pool. The buffered bytes must not be
+// used afterwards.
+func (s *bufferedReader) release() {
+	if s.buffer == nil {
+		return
+	}
+	s.untrack()
+	if cap(s.buffer) <= maxPooledBufferSize {
+		b := s.buffer[:0]
+		s.buffers().pool.Put(&b)
+	}
+	s.buffer = nil
+	s.bufferRead = 0
+	s.bufferSize = 0
 }
@@ -0,0 +1,130 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBufferRelease(t *testing.T) {
+	const payload = "hello world"
+	br := bufferedReader{source: iotest.OneByteReader(strings.NewReader(payload))}
+
+	br.reset(true)
+	var b [7]byte
+	if _, err := io.ReadFull(&br, b[:5]); err != nil {
+		t.Fatal(err)
+	}
+	br.reset(true)
+	// next replays the 5 bytes sniffed above and reads 2 more.
+	if nb := br.next(len(b)); string(nb) != payload[:len(b)] {
+		t.Fatalf("unexpected next bytes %q", nb)
+	}
+	br.reset(false)
+	if br.buffer == nil {
+		t.Fatal("sniffed bytes are not buffered")
+	}
+
+	if _, err := io.ReadFull(&br, b[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if br.buffer == nil {
+		t.Fatal("buffer released before the sniffed bytes are consumed")
+	}
+	if _, err := io.ReadFull(&br, b[3:]); err != nil {
+		t.Fatal(err)
+	}
+	if br.buffer != nil {
+		t.Error("buffer is not released once the sniffed bytes are consumed")
+	}
+
+	rest, err := ioutil.ReadAll(&br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b[:]) + string(rest); got != payload {
+		t.Errorf("unexpected read %q, expected %q", got, payload)
+	}
+}
+
+func TestBufferReleaseNothingSniffed(t *testing.T) {
+	br := bufferedReader{source: strings.NewReader("hello")}
+	br.reset(true)
+	br.reset(false)
+	if br.buffer != nil {
+		t.Error("buffer is allocated while nothing was sniffed")
+	}
+}
+
+func TestBufferSniffReadsAhead(t *testing.T) {
+	const payload = "hello world"
+	br := bufferedReader{source: strings.NewReader(payload)}
+
+	br.reset(true)
+	var b [2]byte
+	if n, err := br.Read(b[:]); n != len(b) || err != nil {
+		t.Fatalf("unexpected read: n=%d err=%v", n, err)
+	}
+	// The source was read once, into the buffer.
+	if got := string(br.buffered()); got != payload[len(b):] {
+		t.Fatalf("unexpected buffered bytes %q", got)
+	}
+
+	br.reset(true)
+	if got := string(br.peek(len(payload))); got != payload {
+		t.Fatalf("unexpected peeked bytes %q", got)
+	}
+
+	br.reset(false)
+	all, err := ioutil.ReadAll(&br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(all) != payload {
+		t.Errorf("unexpected read %q, expected %q", all, payload)
+	}
+}
+
+func TestSniffBufferPolicy(t *testing.T) {
+	payload := strings.Repeat("x", 64)
+	bufs := newSniffBuffers(SniffBufferPolicy{
+		InitialSize: 24,
+		Grow:        func(c, n int) int { return n },
+	})
+	br := bufferedReader{source: strings.NewReader(payload), bufs: bufs}
+
+	br.reset(true)
+	if b := br.next(24); len(b) != 24 {
+		t.Fatalf("unexpected next bytes %q", b)
+	}
+	if c := cap(br.buffer); c != 24 {
+		t.Errorf("initial capacity is %d, want 24", c)
+	}
+	if b := br.next(6); len(b) != 6 {
+		t.Fatalf("unexpected next bytes %q", b)
+	}
+	if c := cap(br.buffer); c != 30 {
+		t.Errorf("grown capacity is %d, want 30", c)
+	}
+
+	m := New(nil, WithSniffBufferPolicy(SniffBufferPolicy{InitialSize: 24})).(*cMux)
+	if m.bufs == nil || m.bufs.size != 24 {
+		t.Error("sniff buffer policy is not applied")
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	recordTypeHandshake    = 0x16
+	handshakeTypeHello     = 0x01
+	extensionServerName    = 0x0000
+	extensionCurves        = 0x000a
+	extensionPoints        = 0x000b
+	extensionSignatureAlgs = 0x000d
+	extensionALPN          = 0x0010
+	extensionSupportedVers = 0x002b
+	serverNameTypeHostName = 0x00
+	tlsRecordHeaderLen     = 5
+	maxClientHelloLen      = 16 << 10
+)
+
+// TLSSNI matches the TLS connections whose ClientHello requests one of
+// hostnames with the server name indication (SNI) extension. The handshake is
+// not terminated: the ClientHello is only sniffed, so the matched connections
+// can be passed through to a TLS server or proxied as is.
+//
+// A host name of the form "*.example.com" matches the server names with one
+// more label than example.com, e.g. "www.example.com" but neither
+// "example.com" nor "a.b.example.com". Host names are matched case
+// insensitively.
+func TLSSNI(hostnames ...string) Matcher {
+	names := make(map[string]struct{}, len(hostnames))
+	for _, h := range hostnames {
+		names[strings.TrimSuffix(strings.ToLower(h), ".")] = struct{}{}
+	}
+	has := func(key string) bool { _, ok := names[key]; return ok }
+	return func(r io.Reader) bool {
+		hello, err := ParseClientHello(r)
+		if err != nil {
+			return false
+		}
+		_, ok := sniKey(hello.ServerName, has)
+		return ok
+	}
+}
+
+// TLSALPN matches the TLS connections whose ClientHello advertises one of
+// protos with the application-layer protocol negotiation (ALPN) extension,
+// e.g. "h2" to tell gRPC and HTTP/2 clients from HTTP/1 ones. As with TLSSNI,
+// the handshake is not terminated.
+//
+// Clients usually advertise several protocols, e.g. both "h2" and
+// "http/1.1", so the listeners should be matched from the most to the least
+// specific protocol.
+func TLSALPN(protos ...string) Matcher {
+	return func(r io.Reader) bool {
+		hello, err := ParseClientHello(r)
+		if err != nil {
+			return false
+		}
+		for _, p := range hello.ALPNProtocols {
+			for _, q := range protos {
+				if p == q {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// TLSVersion matches the TLS connections whose highest version offered in
+// the ClientHello is one of versions, e.g. tls.VersionTLS13. Unlike TLS, which checks the
+// version of the first record, it takes the supported versions extension of
+// TLS 1.3 into account, so it can tell legacy clients from modern ones:
+//
+//	legacyl := m.Match(TLSVersion(tls.VersionTLS10, tls.VersionTLS11))
+//	tlsl := m.Match(TLS())
+//
+// As with TLSSNI, the handshake is not terminated.
+func TLSVersion(versions ...uint16) Matcher {
+	return func(r io.Reader) bool {
+		hello, err := ParseClientHello(r)
+		if err != nil {
+			return false
+		}
+		max := hello.MaxVersion()
+		for _, v := range versions {
+			if v == max {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ErrNotClientHello is returned by ParseClientHello when the bytes read are
+// not a TLS ClientHello.
+var ErrNotClientHello = errors.New("mux: not a TLS ClientHello")
+
+// ClientHello is the part of a TLS ClientHello parsed by ParseClientHello.
+type ClientHello struct {
+	// Version is the legacy version field of the ClientHello. TLS 1.3
+	// clients set it to TLS 1.2 and list the versions they support in
+	// SupportedVersions.
+	Version uint16
+	// CipherSuites are the cipher suites offered by the client.
+	CipherSuites []uint16
+	// ServerName is the host name of the server name indication (SNI)
+	// extension, if any.
+	ServerName string
+	// ALPNProtocols are the protocols of the application-layer protocol
+	// negotiation (ALPN) extension, if any.
+	ALPNProtocols []string
+	// SupportedVersions are the versions of the supported versions
+	// extension, if any.
+	SupportedVersions []uint16
+	// Extensions are the types of the extensions of the ClientHello, in
+	// order.
+	Extensions []uint16
+	// SupportedCurves are the groups of the supported groups extension, if
+	// any.
+	SupportedCurves []uint16
+	// SupportedPoints are the formats of the EC point formats extension, if
+	// any.
+	SupportedPoints []uint8
+	// SignatureSchemes are the schemes of the signature algorithms
+	// extension, if any.
+	SignatureSchemes []uint16
+}
+
+// MaxVersion returns the highest version offered by the client, ignoring
+// GREASE values.
+func (h *ClientHello) MaxVersion() uint16 {
+	if len(h.SupportedVersions) == 0 {
+		return h.Version
+	}
+	var max uint16
+	for _, v := range h.SupportedVersions {
+		if !isGREASE(v) && v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// isGREASE returns whether v is one of the values reserved by RFC 8701 for
+// clients to exercise the extensibility of servers.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ParseClientHello reads the TLS records from r up to the end of the
+// ClientHello they carry and parses it. It is meant for custom matchers
+// sniffing TLS connections without terminating them:
+//
+//	func ACME(r io.Reader) bool {
+//		hello, err := cmux.ParseClientHello(r)
+//		return err == nil && len(hello.ALPNProtocols) == 1 &&
+//			hello.ALPNProtocols[0] == "acme-tls/1"
+//	}
+//
+// It returns ErrNotClientHello if r does not start with a ClientHello, or the
+// error of r if it fails before the end of the ClientHello.
+func ParseClientHello(r io.Reader) (*ClientHello, error) {
+	hr := &handshakeReader{r: r}
+	var hdr [4]byte
+	if _, err := io.ReadFull(hr, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != handshakeTypeHello {
+		return nil, ErrNotClientHello
+	}
+	n := int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+	if n > maxClientHelloLen {
+		return nil, ErrNotClientHello
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(hr, b); err != nil {
+		return nil, err
+	}
+
+	hello := &ClientHello{}
+	s := cursor(b)
+	var ok bool
+	if hello.Version, ok = s.uint16(); !ok {
+		return nil, ErrNotClientHello
+	}
+	// Skip the random and the session ID.
+	if !s.skip(32) || !s.skipVector(1) {
+		return nil, ErrNotClientHello
+	}
+	suites, ok := s.vector(2)
+	if !ok || len(suites)%2 != 0 {
+		return nil, ErrNotClientHello
+	}
+	hello.CipherSuites = suites.uint16s()
+	// Skip the compression methods.
+	if !s.skipVector(1) {
+		return nil, ErrNotClientHello
+	}
+	if len(s) == 0 {
+		// No extensions.
+		return hello, nil
+	}
+	exts, ok := s.vector(2)
+	if !ok {
+		return nil, ErrNotClientHello
+	}
+	for len(exts) > 0 {
+		typ, ok := exts.uint16()
+		if !ok {
+			return nil, ErrNotClientHello
+		}
+		ext, ok := exts.vector(2)
+		if !ok {
+			return nil, ErrNotClientHello
+		}
+		hello.Extensions = append(hello.Extensions, typ)
+		switch typ {
+		case extensionServerName:
+			hello.ServerName, ok = parseServerName(ext)
+		case extensionALPN:
+			hello.ALPNProtocols, ok = parseALPN(ext)
+		case extensionSupportedVers:
+			hello.SupportedVersions, ok = parseUint16s(ext, 1)
+		case extensionCurves:
+			hello.SupportedCurves, ok = parseUint16s(ext, 2)
+		case extensionPoints:
+			var points cursor
+			points, ok = ext.vector(1)
+			hello.SupportedPoints = []uint8(points)
+		case extensionSignatureAlgs:
+			hello.SignatureSchemes, ok = parseUint16s(ext, 2)
+		}
+		if !ok {
+			return nil, ErrNotClientHello
+		}
+	}
+	return hello, nil
+}
+
+// parseServerName returns the host name of the server name extension ext.
+func parseServerName(ext cursor) (string, bool) {
+	names, ok := ext.vector(2)
+	if !ok {
+		return "", false
+	}
+	for len(names) > 0 {
+		t, ok := names.uint8()
+		if !ok {
+			return "", false
+		}
+		name, ok := names.vector(2)
+		if !ok {
+			return "", false
+		}
+		if t == serverNameTypeHostName {
+			return string(name), true
+		}
+	}
+	return "", true
+}
+
+// parseALPN returns the protocols of the ALPN extension ext.
+func parseALPN(ext cursor) ([]string, bool) {
+	list, ok := ext.vector(2)
+	if !ok {
+		return nil, false
+	}
+	var protos []string
+	for len(list) > 0 {
+		p, ok := list.vector(1)
+		if !ok {
+			return nil, false
+		}
+		protos = append(protos, string(p))
+	}
+	return protos, true
+}
+
+// parseUint16s returns the values of the list of uint16 values of ext, whose
+// length prefix is lenLen bytes long.
+func parseUint16s(ext cursor, lenLen int) ([]uint16, bool) {
+	list, ok := ext.vector(lenLen)
+	if !ok || len(list)%2 != 0 {
+		return nil, false
+	}
+	return list.uint16s(), true
+}
+
+// handshakeReader reads the handshake messages carried by a sequence of TLS
+// records.
+type handshakeReader struct {
+	r    io.Reader
+	left int
+	hdr  [tlsRecordHeaderLen]byte
+}
+
+func (h *handshakeReader) Read(p []byte) (int, error) {
+	for h.left == 0 {
+		if _, err := io.ReadFull(h.r, h.hdr[:]); err != nil {
+			return 0, err
+		}
+		if h.hdr[0] != recordTypeHandshake {
+			return 0, ErrNotClientHello
+		}
+		h.left = int(binary.BigEndian.Uint16(h.hdr[3:]))
+	}
+	if len(p) > h.left {
+		p = p[:h.left]
+	}
+	n, err := h.r.Read(p)
+	h.left -= n
+	return n, err
+}
+
+// cursor consumes a byte string in the TLS presentation language.
+type cursor []byte
+
+func (c *cursor) skip(n int) bool {
+	if len(*c) < n {
+		return false
+	}
+	*c = (*c)[n:]
+	return true
+}
+
+func (c *cursor) uint8() (uint8, bool) {
+	if len(*c) < 1 {
+		return 0, false
+	}
+	v := (*c)[0]
+	*c = (*c)[1:]
+	return v, true
+}
+
+func (c *cursor) uint16() (uint16, bool) {
+	if len(*c) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*c)
+	*c = (*c)[2:]
+	return v, true
+}
+
+// uint16s consumes the rest of c as a list of uint16 values.
+func (c *cursor) uint16s() []uint16 {
+	vs := make([]uint16, 0, len(*c)/2)
+	for len(*c) >= 2 {
+		v, _ := c.uint16()
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+// vector consumes a vector whose length prefix is lenLen bytes long and
+// returns its contents.
+func (c *cursor) vector(lenLen int) (cursor, bool) {
+	var n int
+	switch lenLen {
+	case 1:
+		v, ok := c.uint8()
+		if !ok {
+			return nil, false
+		}
+		n = int(v)
+	case 2:
+		v, ok := c.uint16()
+		if !ok {
+			return nil, false
+		}
+		n = int(v)
+	}
+	if len(*c) < n {
+		return nil, false
+	}
+	v := (*c)[:n]
+	*c = (*c)[n:]
+	return v, true
+}
+
+func (c *cursor) skipVector(lenLen int) bool {
+	_, ok := c.vector(lenLen)
+	return ok
+}
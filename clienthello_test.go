@@ -0,0 +1,258 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// helloConn records what is written to it and fails reads, so that a TLS
+// client writes its ClientHello to it and gives up.
+type helloConn struct {
+	net.Conn
+	bytes.Buffer
+}
+
+func (c *helloConn) Write(p []byte) (int, error) { return c.Buffer.Write(p) }
+func (c *helloConn) Read([]byte) (int, error)    { return 0, errors.New("no server") }
+func (c *helloConn) Close() error                { return nil }
+
+// testClientHello returns the records of the ClientHello sent by a TLS client
+// configured with config.
+func testClientHello(t *testing.T, config *tls.Config) []byte {
+	c := &helloConn{}
+	if err := tls.Client(c, config).Handshake(); err == nil {
+		t.Fatal("handshake succeeded")
+	}
+	return c.Bytes()
+}
+
+func TestParseClientHello(t *testing.T) {
+	suites := []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}
+	b := testClientHello(t, &tls.Config{
+		ServerName:   "example.com",
+		NextProtos:   []string{"h2", "http/1.1"},
+		CipherSuites: suites,
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS13,
+	})
+	hello, err := ParseClientHello(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.Version != tls.VersionTLS12 {
+		t.Errorf("unexpected version: %x", hello.Version)
+	}
+	if hello.ServerName != "example.com" {
+		t.Errorf("unexpected server name: %q", hello.ServerName)
+	}
+	if len(hello.ALPNProtocols) != 2 || hello.ALPNProtocols[0] != "h2" ||
+		hello.ALPNProtocols[1] != "http/1.1" {
+		t.Errorf("unexpected ALPN protocols: %q", hello.ALPNProtocols)
+	}
+	// The TLS 1.3 suites are always offered.
+	for _, s := range suites {
+		found := false
+		for _, cs := range hello.CipherSuites {
+			found = found || cs == s
+		}
+		if !found {
+			t.Errorf("cipher suite %x not found in %x", s, hello.CipherSuites)
+		}
+	}
+	if len(hello.SupportedVersions) != 2 || hello.MaxVersion() != tls.VersionTLS13 {
+		t.Errorf("unexpected supported versions: %x", hello.SupportedVersions)
+	}
+	if len(hello.Extensions) == 0 ||
+		len(hello.SupportedCurves) == 0 || len(hello.SignatureSchemes) == 0 {
+		t.Errorf("unexpected extensions: %+v", hello)
+	}
+
+	for _, test := range []struct {
+		b   []byte
+		err error
+	}{
+		{[]byte("GET / HTTP/1.1\r\n\r\n"), ErrNotClientHello},
+		{b[:len(b)/2], io.ErrUnexpectedEOF},
+		{nil, io.EOF},
+		{[]byte{recordTypeHandshake, 3, 1, 0, 4, 2, 0, 0, 0}, ErrNotClientHello},
+		{[]byte{recordTypeHandshake, 3, 1, 0, 4, handshakeTypeHello, 0xff, 0xff, 0xff}, ErrNotClientHello},
+		{[]byte{recordTypeHandshake, 3, 1, 0, 6, handshakeTypeHello, 0, 0, 2, 3, 3}, ErrNotClientHello},
+	} {
+		if _, err := ParseClientHello(bytes.NewReader(test.b)); err != test.err {
+			t.Errorf("%q: want=%v got=%v", test.b, test.err, err)
+		}
+	}
+}
+
+func TestTLSSNI(t *testing.T) {
+	m := TLSSNI("example.com", "*.Example.org")
+	for _, test := range []struct {
+		name  string
+		match bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.com", true},
+		{"www.example.com", false},
+		{"www.example.org", true},
+		{"example.org", false},
+		{"a.b.example.org", false},
+		{"", false},
+	} {
+		hello := testClientHello(t, &tls.Config{
+			ServerName:         test.name,
+			InsecureSkipVerify: true,
+		})
+		if got := m(bytes.NewReader(hello)); got != test.match {
+			t.Errorf("%q: want=%v got=%v", test.name, test.match, got)
+		}
+	}
+
+	// The hello split over several records.
+	hello := testClientHello(t, &tls.Config{ServerName: "example.com"})
+	var split []byte
+	for body := hello[tlsRecordHeaderLen:]; len(body) > 0; {
+		n := 100
+		if n > len(body) {
+			n = len(body)
+		}
+		split = append(split, hello[0], hello[1], hello[2], 0, byte(n))
+		split = append(split, body[:n]...)
+		body = body[n:]
+	}
+	if !m(bytes.NewReader(split)) {
+		t.Error("split hello not matched")
+	}
+
+	for _, b := range [][]byte{
+		[]byte("GET / HTTP/1.1\r\n\r\n"),
+		hello[:len(hello)/2],
+		{recordTypeHandshake, 3, 1, 0, 4, handshakeTypeHello, 0xff, 0xff, 0xff},
+	} {
+		if m(bytes.NewReader(b)) {
+			t.Errorf("%q matched", b)
+		}
+	}
+}
+
+func TestTLSALPN(t *testing.T) {
+	m := TLSALPN("h2", "acme")
+	for _, test := range []struct {
+		protos []string
+		match  bool
+	}{
+		{[]string{"h2", "http/1.1"}, true},
+		{[]string{"http/1.1"}, false},
+		{[]string{"foo", "acme"}, true},
+		{nil, false},
+	} {
+		hello := testClientHello(t, &tls.Config{
+			NextProtos:         test.protos,
+			InsecureSkipVerify: true,
+		})
+		if got := m(bytes.NewReader(hello)); got != test.match {
+			t.Errorf("%q: want=%v got=%v", test.protos, test.match, got)
+		}
+	}
+	if m(bytes.NewReader([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"))) {
+		t.Error("cleartext HTTP/2 matched")
+	}
+}
+
+func TestTLSVersion(t *testing.T) {
+	legacy := TLSVersion(tls.VersionTLS10, tls.VersionTLS11)
+	modern := TLSVersion(tls.VersionTLS13)
+	for _, test := range []struct {
+		min, max       uint16
+		legacy, modern bool
+	}{
+		{tls.VersionTLS10, tls.VersionTLS10, true, false},
+		{tls.VersionTLS10, tls.VersionTLS11, true, false},
+		{tls.VersionTLS12, tls.VersionTLS12, false, false},
+		{tls.VersionTLS12, tls.VersionTLS13, false, true},
+		{tls.VersionTLS13, tls.VersionTLS13, false, true},
+	} {
+		hello := testClientHello(t, &tls.Config{
+			MinVersion:         test.min,
+			MaxVersion:         test.max,
+			InsecureSkipVerify: true,
+		})
+		if got := legacy(bytes.NewReader(hello)); got != test.legacy {
+			t.Errorf("%x-%x: legacy: want=%v got=%v", test.min, test.max, test.legacy, got)
+		}
+		if got := modern(bytes.NewReader(hello)); got != test.modern {
+			t.Errorf("%x-%x: modern: want=%v got=%v", test.min, test.max, test.modern, got)
+		}
+	}
+
+	hello := &ClientHello{
+		Version:           tls.VersionTLS12,
+		SupportedVersions: []uint16{0x3a3a, tls.VersionTLS13, tls.VersionTLS12},
+	}
+	if v := hello.MaxVersion(); v != tls.VersionTLS13 {
+		t.Errorf("GREASE not ignored: %x", v)
+	}
+}
+
+func TestTLSSNIPassthrough(t *testing.T) {
+	defer leakCheck(t)()
+	l, cleanup := testListener(t)
+	defer cleanup()
+
+	muxl := New(l)
+	exl := muxl.Match(TLSSNI("example.com"))
+	otherl := muxl.Match(TLS())
+	go safeServe(nil, muxl)
+
+	for _, test := range []struct {
+		name string
+		l    net.Listener
+	}{
+		{"example.com", exl},
+		{"example.net", otherl},
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = c.Close() }()
+		tc := tls.Client(c, &tls.Config{ServerName: test.name, InsecureSkipVerify: true})
+		go func() { _, _ = io.WriteString(tc, "ping") }()
+
+		ac, err := test.l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := testCertificate(t, test.name)
+		sc := tls.Server(ac, &tls.Config{Certificates: []tls.Certificate{*cert}})
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(sc, b); err != nil || string(b) != "ping" {
+			t.Errorf("%s: unexpected read: %q, %v", test.name, b, err)
+		}
+		if got := sc.ConnectionState().ServerName; got != test.name {
+			t.Errorf("unexpected server name: want=%q got=%q", test.name, got)
+		}
+		_ = sc.Close()
+	}
+	cleanup()
+}
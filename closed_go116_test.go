@@ -0,0 +1,89 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build go1.16
+// +build go1.16
+
+package cmux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestErrClosed(t *testing.T) {
+	for _, err := range []error{ErrListenerClosed, ErrServerClosed} {
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("%v is not net.ErrClosed", err)
+		}
+	}
+	if errors.Is(ErrListenerClosed, ErrServerClosed) {
+		t.Error("ErrListenerClosed is ErrServerClosed")
+	}
+}
+
+func TestClose(t *testing.T) {
+	defer leakCheck(t)()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	muxl := New(l)
+	muxl.Match(HTTP2())
+	anyl := muxl.Match(Any())
+	errCh := make(chan error, 1)
+	go func() { errCh <- muxl.Serve() }()
+
+	// A connection stuck in the HTTP/2 matcher.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	if _, err := io.WriteString(c, "PRI"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := muxl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Serve returns the error of the closed root listener once the
+	// connection being matched is closed.
+	if err := <-errCh; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("unexpected error from Serve: %v", err)
+	}
+	// The listeners of a closed mux return ErrServerClosed.
+	if _, err := anyl.Accept(); err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// The connection is closed, whether it was being matched or still in
+	// the backlog of the root listener.
+	if _, err := c.Read(make([]byte, 1)); !isClosedErr(err) {
+		t.Errorf("connection is not closed: %v", err)
+	}
+	// Close is safe to call again.
+	_ = muxl.Close()
+}
+
+func isClosedErr(err error) bool {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != nil
+}
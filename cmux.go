@@ -15,11 +15,16 @@
 package cmux
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"runtime/pprof"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -31,6 +36,16 @@ type MatchWriter func(io.Writer, io.Reader) bool
 
 // ErrorHandler handles an error and returns whether
 // the mux should continue serving the listener.
+//
+// Besides the errors of the root listener, the handler receives one of the
+// following errors for the connections that could not be delivered as usual:
+// ErrNotMatched, ErrSniffTimeout, ErrNoBytes, ErrMatcherPanic and
+// ErrBacklogFull. They are all temporary net.Errors, so the mux continues
+// serving if the handler returns true. ErrSniffTimeout and ErrNoBytes are
+// also an ErrNotMatched for errors.Is and errors.As. The value returned for
+// ErrBacklogFull is ignored, since the connection is still delivered.
+// Whether serving continues after an error of the root listener also
+// depends on the AcceptRetryPolicy.
 type ErrorHandler func(error) bool
 
 var _ net.Error = ErrNotMatched{}
@@ -38,14 +53,23 @@ var _ net.Error = ErrNotMatched{}
 // ErrNotMatched is returned whenever a connection is not matched by any of
 // the matchers registered in the multiplexer.
 type ErrNotMatched struct {
-	c net.Conn
+	c  net.Conn
+	id uint64
 }
 
 func (e ErrNotMatched) Error() string {
-	return fmt.Sprintf("mux: connection %v not matched by an matcher",
-		e.c.RemoteAddr())
+	return fmt.Sprintf("mux: connection %v (id %d) not matched by an matcher",
+		e.c.RemoteAddr(), e.id)
 }
 
+// ConnID returns the ID of the connection that was not matched. See
+// MuxConn.ID.
+func (e ErrNotMatched) ConnID() uint64 { return e.id }
+
+// RemoteAddr returns the remote address of the connection that was not
+// matched.
+func (e ErrNotMatched) RemoteAddr() net.Addr { return e.c.RemoteAddr() }
+
 // Temporary implements the net.Error interface.
 func (e ErrNotMatched) Temporary() bool { return true }
 
@@ -58,24 +82,124 @@ func (e errListenerClosed) Error() string   { return string(e) }
 func (e errListenerClosed) Temporary() bool { return false }
 func (e errListenerClosed) Timeout() bool   { return false }
 
-// ErrListenerClosed is returned from muxListener.Accept when the underlying
-// listener is closed.
+// ErrListenerClosed is returned from muxListener.Accept once Serve has
+// returned because of an error of the underlying listener, e.g., when it is
+// closed directly rather than with CMux.Close. With Go 1.16 or later,
+// errors.Is(ErrListenerClosed, net.ErrClosed) is true, so that server loops
+// stop on it as they do when their own listener is closed.
 var ErrListenerClosed = errListenerClosed("mux: listener closed")
 
-// ErrServerClosed is returned from muxListener.Accept when mux server is closed.
-var ErrServerClosed = errors.New("mux: server closed")
+// ErrServerClosed is returned from muxListener.Accept once the mux is
+// closed with CMux.Close. Like ErrListenerClosed, it matches net.ErrClosed.
+var ErrServerClosed error = errListenerClosed("mux: server closed")
+
+// ErrNotSyscallConn is returned from MuxConn.SyscallConn when the underlying
+// connection does not implement syscall.Conn.
+var ErrNotSyscallConn = errors.New("mux: connection does not implement syscall.Conn")
+
+// ErrNotTCPConn is returned from the TCP-specific setters of MuxConn when the
+// underlying connection does not support them.
+var ErrNotTCPConn = errors.New("mux: connection is not a TCP connection")
+
+// ErrNotHijackable is returned from TunnelListener.Handle when the
+// http.ResponseWriter does not implement http.Hijacker, e.g. for HTTP/2
+// requests.
+var ErrNotHijackable = errors.New("mux: connection cannot be hijacked")
+
+// DeadlinePolicy determines what happens to the read deadline set for
+// sniffing (see CMux.SetReadTimeout) once a connection is matched.
+type DeadlinePolicy int
+
+const (
+	// ClearDeadline clears the read deadline before the connection is handed
+	// to the listener, so that the protocol server starts without a
+	// deadline.
+	ClearDeadline DeadlinePolicy = iota
+	// KeepDeadline leaves the read deadline in place, so that the first
+	// reads of the protocol server are bounded by the read timeout too. The
+	// protocol server is then responsible for updating the deadline.
+	KeepDeadline
+)
 
 // for readability of readTimeout
 var noTimeout time.Duration
 
 // New instantiates a new connection multiplexer.
-func New(l net.Listener) CMux {
-	return &cMux{
+func New(l net.Listener, opts ...Option) CMux {
+	m := &cMux{
 		root:        l,
 		bufLen:      1024,
 		errh:        func(_ error) bool { return true },
 		donec:       make(chan struct{}),
+		servedc:     make(chan struct{}),
 		readTimeout: noTimeout,
+		direct:      -1,
+		fallback:    -1,
+		noBytes:     -1,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Option configures a CMux instantiated by New.
+type Option func(*cMux)
+
+// WithMaxSniffWorkers bounds the number of connections being matched at the
+// same time to n. Connections are then matched by n worker goroutines instead
+// of one goroutine each, and Serve stops accepting connections while all the
+// workers are busy, leaving them in the backlog of the root listener. Matched
+// connections do not count towards the bound.
+//
+// By default, or if n <= 0, there is no bound.
+func WithMaxSniffWorkers(n int) Option {
+	return func(m *cMux) {
+		m.maxWorkers = n
+	}
+}
+
+// WithAcceptLoops makes Serve accept connections from the root listener in
+// n goroutines instead of one, to increase the accept throughput on machines
+// with many cores. The root listener must support concurrent calls to Accept,
+// as the TCP listeners of the net package do.
+//
+// When one of the loops stops because of an error, the root listener is
+// closed to stop the others, and Serve returns the error.
+//
+// By default, or if n <= 1, there is a single loop.
+func WithAcceptLoops(n int) Option {
+	return func(m *cMux) {
+		m.acceptLoops = n
+	}
+}
+
+// WithMaxSniffMemory makes Serve pause accepting connections while the
+// buffers holding the bytes sniffed from the connections, and not read by the
+// protocol servers yet, total more than n bytes. The pending connections wait
+// in the backlog of the root listener, which pushes back on clients instead of
+// exhausting the memory under a flood of slow or malicious connections.
+//
+// Combine it with SetReadTimeout, so that connections that never finish being
+// matched eventually release their buffers: while paused, Serve does not
+// notice that the root listener is closed.
+//
+// By default, or if n <= 0, there is no limit.
+func WithMaxSniffMemory(n int64) Option {
+	return func(m *cMux) {
+		m.mem = nil
+		if n > 0 {
+			m.mem = newSniffMemory(n)
+		}
+	}
+}
+
+// WithSniffBufferPolicy sets how the buffers holding the bytes sniffed from
+// the connections are sized. The buffers of a CMux are pooled, so the policy
+// mostly matters for the peak memory of bursts of connections.
+func WithSniffBufferPolicy(p SniffBufferPolicy) Option {
+	return func(m *cMux) {
+		m.bufs = newSniffBuffers(p)
 	}
 }
 
@@ -85,6 +209,13 @@ type CMux interface {
 	// the connections matched by at least one of the matcher.
 	//
 	// The order used to call Match determines the priority of matchers.
+	//
+	// The prefix matchers (PrefixMatcher, PrefixByteMatcher, HTTP1Fast,
+	// HTTP1Methods and TLS) registered before any other matcher are compiled
+	// into a single automaton, so that their cost does not grow with their
+	// number. They are recognized by how they were built; the matchers are
+	// never called when registered. Likewise, if the only matcher of the mux
+	// is Any, connections are handed to its listener without being sniffed.
 	Match(...Matcher) net.Listener
 	// MatchWithWriters returns a net.Listener that accepts only the
 	// connections that matched by at least of the matcher writers.
@@ -94,30 +225,172 @@ type CMux interface {
 	//
 	// The order used to call Match determines the priority of matchers.
 	MatchWithWriters(...MatchWriter) net.Listener
+	// MatchNamed is like Match, but also assigns a name to the returned
+	// listener. The name is reported by MuxConn.MatchedProtocol for the
+	// connections accepted by the listener.
+	MatchNamed(name string, matchers ...Matcher) net.Listener
+	// MatchWithWritersNamed is like MatchWithWriters, but also assigns a
+	// name to the returned listener, as MatchNamed does.
+	MatchWithWritersNamed(name string, matchers ...MatchWriter) net.Listener
+	// MatchLabeled is like MatchNamed, but the connections it matches are
+	// accepted from the LabeledListener it returns, along with label. All
+	// the calls return the same LabeledListener, which accepts the
+	// connections of all the labeled listeners.
+	MatchLabeled(label string, matchers ...Matcher) LabeledListener
+	// MatchFanOut is like Match, but returns n listeners sharing the
+	// matchers. The matched connections are delivered to the listeners in
+	// round-robin order, so that n independent accept loops can serve
+	// them.
+	MatchFanOut(n int, matchers ...Matcher) []net.Listener
+	// MatchSplit is like Match, but delivers the share of the matched
+	// connections given by split to canary instead of primary, e.g., to
+	// try a new version of a server on part of the traffic.
+	MatchSplit(split TrafficSplit, matchers ...Matcher) (primary, canary net.Listener)
+	// MatchUnmatched returns a net.Listener that accepts the connections
+	// that none of the matchers matched, instead of closing them and
+	// reporting ErrNotMatched. As with the other listeners, the sniffed
+	// bytes are read again from the connections. The connections whose
+	// matching timed out are still closed and reported as ErrSniffTimeout,
+	// and the ones that sent nothing are handled as described in
+	// MatchNoBytes. Unlike a listener matching Any, it does not take part
+	// in matching, so it can be created at any time. Calling it again
+	// returns the same listener.
+	MatchUnmatched() net.Listener
+	// MatchNoBytes returns a net.Listener that accepts the connections
+	// that sent nothing before the read timeout set with SetReadTimeout
+	// expired, instead of closing them and reporting ErrNoBytes, e.g., to
+	// serve a protocol in which the server speaks first. Like
+	// MatchUnmatched, it does not take part in matching, and calling it
+	// again returns the same listener.
+	MatchNoBytes() net.Listener
 	// Serve starts multiplexing the listener. Serve blocks and perhaps
 	// should be invoked concurrently within a go routine.
 	Serve() error
-	// Closes cmux server and stops accepting any connections on listener
-	Close()
+	// Close closes the mux: the root listener is closed, so that Serve
+	// returns, the listeners returned by the mux return ErrServerClosed,
+	// rather than the ErrListenerClosed they return when Serve stops on an
+	// error of the root listener, and the connections still being matched
+	// are closed. The connections already enqueued for the listeners are
+	// closed once Serve returns. It returns the error of closing the root
+	// listener, and may be called concurrently with Serve.
+	Close() error
+	// SwapRoot replaces the root listener with l, e.g., after binding the
+	// address again with new socket options or binding another address.
+	// The listeners and matchers of the mux keep serving, and Serve goes on
+	// accepting from l. The previous root listener is closed, which drops
+	// the connections pending in its backlog, and the error of closing it
+	// is returned. If the mux is closed, l is not used and SwapRoot returns
+	// ErrServerClosed.
+	SwapRoot(l net.Listener) error
+	// Done returns a channel that is closed once Serve has returned, i.e.,
+	// once the mux has stopped accepting, all the connections being
+	// matched are delivered or closed, and the listeners returned by the
+	// mux are closed. It is never closed if Serve is not called.
+	Done() <-chan struct{}
 	// HandleError registers an error handler that handles listener errors.
 	HandleError(ErrorHandler)
 	// sets a timeout for the read of matchers
 	SetReadTimeout(time.Duration)
+	// SetDeadlinePolicy sets what happens to the read deadline set for the
+	// read timeout once a connection is matched. The default is
+	// ClearDeadline.
+	SetDeadlinePolicy(DeadlinePolicy)
+	// Stats returns the statistics of the listeners returned by the mux, in
+	// the order they were created.
+	Stats() []ListenerStats
+	// Rejected returns the number of connections rejected before being
+	// sniffed, by the policy of WithIPPolicy or a gate of WithConnGate.
+	Rejected() uint64
 }
 
 type matchersListener struct {
 	ss []MatchWriter
-	l  muxListener
+	// kinds are what is known of the matchers without calling them.
+	kinds []matcherKind
+	l     muxListener
+	// lat are the latency histograms of the matchers.
+	lat []latencyHistogram
+	// fanout are the listeners of MatchFanOut, starting with l, and next
+	// the number of connections delivered to them. next is accessed
+	// atomically.
+	fanout []muxListener
+	next   uint32
+	// split is the traffic split of MatchSplit, if any.
+	split *trafficSplit
+}
+
+// listeners returns the listeners the matched connections are delivered to.
+func (sl *matchersListener) listeners() []muxListener {
+	ls := []muxListener{sl.l}
+	if sl.fanout != nil {
+		ls = sl.fanout
+	}
+	if sl.split != nil {
+		ls = append(ls[:len(ls):len(ls)], sl.split.canary)
+	}
+	return ls
+}
+
+// pick returns the listener the matched connection c is delivered to.
+func (sl *matchersListener) pick(c net.Conn) muxListener {
+	if sl.split != nil && sl.split.toCanary(c) {
+		return sl.split.canary
+	}
+	if sl.fanout == nil {
+		return sl.l
+	}
+	n := atomic.AddUint32(&sl.next, 1) - 1
+	return sl.fanout[n%uint32(len(sl.fanout))]
 }
 
 type cMux struct {
-	root        net.Listener
-	bufLen      int
-	errh        ErrorHandler
-	sls         []matchersListener
-	readTimeout time.Duration
-	donec       chan struct{}
-	mu          sync.Mutex
+	// lastID is accessed atomically and must stay 64-bit aligned.
+	lastID uint64
+	// rejected is the number of connections rejected before sniffing. It
+	// is accessed atomically and must stay 64-bit aligned.
+	rejected uint64
+	// root is the root listener, and rootGen the number of times it was
+	// swapped. They are guarded by mu.
+	root     net.Listener
+	rootGen  uint64
+	bufLen   int
+	errh     ErrorHandler
+	sls      []matchersListener
+	prefixes *prefixAutomaton
+	direct   int
+	// fallback is the index of the listener returned by MatchUnmatched,
+	// or -1.
+	fallback int
+	// noBytes is the index of the listener returned by MatchNoBytes, or -1,
+	// and noBytesHandler the handler of WithNoBytesHandler.
+	noBytes        int
+	noBytesHandler func(net.Conn)
+	readTimeout    time.Duration
+	deadline       DeadlinePolicy
+	maxWorkers     int
+	acceptLoops    int
+	retry          AcceptRetryPolicy
+	listen         listenConfig
+	bufs           *sniffBuffers
+	mem            *sniffMemory
+	accessLog      func(AccessRecord)
+	pprofLabels    bool
+	unmatched      recentUnmatched
+	// labeled is the backlog shared by the labeled listeners, if any.
+	labeled chan net.Conn
+	// admitters decide whether the accepted connections are sniffed.
+	admitters []admitter
+	// tlsConfig is the configuration of WithTLSConfig, if any.
+	tlsConfig *tls.Config
+	donec     chan struct{}
+	// closed is set, atomically, once Close is called.
+	closed int32
+	// servedc is closed once Serve has returned.
+	servedc    chan struct{}
+	servedOnce sync.Once
+	mu         sync.Mutex
+	// sniffing are the connections being matched. It is guarded by mu.
+	sniffing map[*MuxConn]struct{}
 }
 
 func matchersToMatchWriters(matchers []Matcher) []MatchWriter {
@@ -132,88 +405,490 @@ func matchersToMatchWriters(matchers []Matcher) []MatchWriter {
 }
 
 func (m *cMux) Match(matchers ...Matcher) net.Listener {
-	mws := matchersToMatchWriters(matchers)
-	return m.MatchWithWriters(mws...)
+	return m.MatchNamed("", matchers...)
 }
 
 func (m *cMux) MatchWithWriters(matchers ...MatchWriter) net.Listener {
+	return m.MatchWithWritersNamed("", matchers...)
+}
+
+func (m *cMux) MatchNamed(name string, matchers ...Matcher) net.Listener {
+	kinds := make([]matcherKind, len(matchers))
+	for i, mt := range matchers {
+		kinds[i] = kindOf(mt)
+	}
+	return m.match(name, matchersToMatchWriters(matchers), kinds)
+}
+
+func (m *cMux) MatchWithWritersNamed(name string,
+	matchers ...MatchWriter) net.Listener {
+	return m.match(name, matchers, make([]matcherKind, len(matchers)))
+}
+
+// match creates the listener of matchers, of the given kinds.
+func (m *cMux) match(name string, matchers []MatchWriter,
+	kinds []matcherKind) net.Listener {
+
 	ml := muxListener{
-		Listener: m.root,
-		connc:    make(chan net.Conn, m.bufLen),
-		donec:    make(chan struct{}),
+		mux:   m,
+		name:  name,
+		stats: &connStats{},
+		connc: make(chan net.Conn, m.bufLen),
+		donec: make(chan struct{}),
+	}
+	if m.pprofLabels {
+		ml.labels = listenerLabels(len(m.sls), name)
 	}
-	m.sls = append(m.sls, matchersListener{ss: matchers, l: ml})
+	m.sls = append(m.sls, matchersListener{
+		ss:    matchers,
+		kinds: kinds,
+		l:     ml,
+		lat:   make([]latencyHistogram, len(matchers)),
+	})
+	m.compilePrefixes()
+	m.compileDirect()
 	return ml
 }
 
+func (m *cMux) MatchUnmatched() net.Listener {
+	if m.fallback < 0 {
+		m.MatchWithWritersNamed("")
+		m.fallback = len(m.sls) - 1
+	}
+	return m.sls[m.fallback].l
+}
+
 func (m *cMux) SetReadTimeout(t time.Duration) {
 	m.readTimeout = t
 }
 
+func (m *cMux) SetDeadlinePolicy(p DeadlinePolicy) {
+	m.deadline = p
+}
+
 func (m *cMux) Serve() error {
 	var wg sync.WaitGroup
 
+	var (
+		workc   chan net.Conn
+		workers sync.WaitGroup
+	)
+	if m.maxWorkers > 0 {
+		workc = make(chan net.Conn)
+		workers.Add(m.maxWorkers)
+		for i := 0; i < m.maxWorkers; i++ {
+			go func() {
+				defer workers.Done()
+				for c := range workc {
+					m.serve(c, m.donec, &wg)
+				}
+			}()
+		}
+	}
+
 	defer func() {
 		m.closeDoneChans()
+		if workc != nil {
+			close(workc)
+			workers.Wait()
+		}
 		wg.Wait()
 
-		for _, sl := range m.sls {
-			close(sl.l.connc)
-			// Drain the connections enqueued for the listener.
-			for c := range sl.l.connc {
-				_ = c.Close()
+		closed := make(map[chan net.Conn]bool, len(m.sls))
+		for i := range m.sls {
+			for _, l := range m.sls[i].listeners() {
+				if closed[l.connc] {
+					// A backlog shared by the labeled listeners.
+					continue
+				}
+				closed[l.connc] = true
+				close(l.connc)
+				// Drain the connections enqueued for the listener.
+				for c := range l.connc {
+					_ = c.Close()
+				}
 			}
 		}
+		m.servedOnce.Do(func() { close(m.servedc) })
 	}()
 
+	if m.acceptLoops <= 1 {
+		return m.accept(workc, &wg)
+	}
+	errc := make(chan error, m.acceptLoops)
+	for i := 0; i < m.acceptLoops; i++ {
+		go func() { errc <- m.accept(workc, &wg) }()
+	}
+	err := <-errc
+	// Stop the other loops.
+	_ = m.rootListener().Close()
+	for i := 1; i < m.acceptLoops; i++ {
+		<-errc
+	}
+	return err
+}
+
+// accept accepts connections from the root listener, and dispatches them
+// to the sniffing goroutines, or to workc if there are workers, until
+// accepting fails with an error the mux should not continue serving after.
+func (m *cMux) accept(workc chan<- net.Conn, wg *sync.WaitGroup) error {
+	// failures is the number of consecutive failed accepts.
+	failures := 0
 	for {
-		c, err := m.root.Accept()
+		if m.mem != nil {
+			m.mem.wait(m.donec)
+		}
+
+		root, gen := m.rootListenerGen()
+		c, err := root.Accept()
 		if err != nil {
-			if !m.handleErr(err) {
+			if _, cur := m.rootListenerGen(); cur != gen {
+				// The root listener was closed by SwapRoot.
+				continue
+			}
+			failures++
+			if !m.retryAccept(err, failures) {
 				return err
 			}
 			continue
 		}
+		failures = 0
+
+		if !m.admit(c) {
+			continue
+		}
+		if m.tlsConfig != nil {
+			c = tls.Server(c, m.tlsConfig)
+		}
+		if m.direct >= 0 {
+			m.handoff(c, m.direct, wg)
+			continue
+		}
 
 		wg.Add(1)
-		go m.serve(c, m.donec, &wg)
+		if workc == nil {
+			go m.serve(c, m.donec, wg)
+			continue
+		}
+		select {
+		case workc <- c:
+		case <-m.donec:
+			_ = c.Close()
+			wg.Done()
+		}
 	}
 }
 
 func (m *cMux) serve(c net.Conn, donec <-chan struct{}, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	muc := newMuxConn(c)
+	muc := m.newConn(c)
+	if !m.startServing(muc) {
+		m.drop(muc)
+		return
+	}
+	defer m.doneServing(muc)
+
 	if m.readTimeout > noTimeout {
-		_ = c.SetReadDeadline(time.Now().Add(m.readTimeout))
+		muc.deadline = time.Now().Add(m.readTimeout)
+		_ = c.SetReadDeadline(muc.deadline)
+	}
+	if tc, ok := c.(*tls.Conn); ok && m.tlsConfig != nil {
+		if err := tc.Handshake(); err != nil {
+			m.reject(muc, ErrTLSHandshake{
+				connError: connError{c: c, id: muc.info.ID},
+				err:       err,
+			})
+			return
+		}
+	}
+	// The leading prefix matchers are evaluated at once, the others one by
+	// one.
+	skip := 0
+	// failed is the matcher that was running when reading from the
+	// connection first failed.
+	failed := matcherRef{listener: -1}
+	now := time.Now()
+	if a := m.prefixes; a != nil {
+		muc.startSniffing()
+		i, f := a.match(&muc.buf)
+		end := time.Now()
+		evaluated := len(a.depths)
+		if i >= 0 {
+			evaluated = i + 1
+		}
+		for k := 0; k < evaluated; k++ {
+			m.sls[a.listeners[k]].lat[a.matchers[k]].observe(end.Sub(now))
+		}
+		now = end
+		if i >= 0 {
+			m.deliver(muc, a.listeners[i], donec)
+			return
+		}
+		if f >= 0 {
+			failed = m.matcherRef(a.listeners[f], a.matchers[f])
+		}
+		skip = len(a.depths)
 	}
-	for _, sl := range m.sls {
-		for _, s := range sl.ss {
-			matched := s(muc.Conn, muc.startSniffing())
+	for i, sl := range m.sls {
+		for j, s := range sl.ss {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			matched, p := callMatcher(s, muc)
+			end := time.Now()
+			sl.lat[j].observe(end.Sub(now))
+			now = end
+			if p != nil {
+				m.reject(muc, ErrMatcherPanic{
+					connError:  connError{c: c, id: muc.info.ID},
+					matcherRef: m.matcherRef(i, j),
+					value:      p,
+				})
+				return
+			}
 			if matched {
-				muc.doneSniffing()
-				if m.readTimeout > noTimeout {
-					_ = c.SetReadDeadline(time.Time{})
-				}
-				select {
-				case sl.l.connc <- muc:
-				case <-donec:
-					_ = c.Close()
-				}
+				m.deliver(muc, i, donec)
 				return
 			}
+			if failed.listener < 0 && muc.buf.sniffErr != nil {
+				failed = m.matcherRef(i, j)
+			}
 		}
 	}
 
-	_ = c.Close()
-	err := ErrNotMatched{c: c}
+	select {
+	case <-donec:
+		// The mux was closed while the connection was being matched.
+		m.drop(muc)
+		return
+	default:
+	}
+
+	if len(muc.buf.buffer) == 0 && muc.buf.sniffErr != nil {
+		m.handleNoBytes(muc, donec)
+		return
+	}
+	m.unmatched.add(c.RemoteAddr(), muc.buf.buffer)
+	if ne, ok := muc.buf.sniffErr.(net.Error); ok && ne.Timeout() {
+		m.reject(muc, ErrSniffTimeout{
+			connError:  connError{c: c, id: muc.info.ID},
+			matcherRef: failed,
+		})
+		return
+	}
+	if m.fallback >= 0 {
+		m.deliver(muc, m.fallback, donec)
+		return
+	}
+	m.reject(muc, ErrNotMatched{c: c, id: muc.info.ID})
+}
+
+func (m *cMux) newConn(c net.Conn) *MuxConn {
+	muc := newMuxConn(c)
+	muc.buf.bufs = m.bufs
+	muc.buf.mem = m.mem
+	muc.info.ID = atomic.AddUint64(&m.lastID, 1)
+	if m.accessLog != nil {
+		muc.alog = &connLog{log: m.accessLog, start: time.Now()}
+	}
+	return muc
+}
+
+// reject closes muc, which could not be matched because of err, and reports
+// err.
+func (m *cMux) reject(muc *MuxConn, err error) {
+	_ = muc.Conn.Close()
+	muc.buf.release()
+	m.reportErr(err)
+	muc.logClose(err)
+}
+
+// callMatcher calls s on muc, and returns what s panicked with, if it did.
+func callMatcher(s MatchWriter, muc *MuxConn) (matched bool, p interface{}) {
+	defer func() {
+		p = recover()
+	}()
+	return s(sniffWriter{muc}, muc.startSniffing()), nil
+}
+
+func (m *cMux) matcherRef(listener, matcher int) matcherRef {
+	return matcherRef{
+		name:     m.sls[listener].l.name,
+		listener: listener,
+		matcher:  matcher,
+	}
+}
+
+// reportErr passes err to the error handler, and closes the root listener if
+// the mux should not continue serving.
+func (m *cMux) reportErr(err error) {
 	if !m.handleErr(err) {
-		_ = m.root.Close()
+		_ = m.rootListener().Close()
+	}
+}
+
+// handoff delivers c to the i-th listener without sniffing it, when the
+// only matcher of the mux is Any. The connection is delivered from the Serve
+// goroutine, without starting a goroutine or allocating a sniff buffer,
+// unless the backlog of the listener is full: the accept loop does not wait
+// for room in the backlog.
+func (m *cMux) handoff(c net.Conn, i int, wg *sync.WaitGroup) {
+	muc := m.newConn(c)
+	if m.readTimeout > noTimeout && m.deadline == KeepDeadline {
+		_ = c.SetReadDeadline(time.Now().Add(m.readTimeout))
+	}
+	muc.matched(m.sls[i].l)
+	l, mc := m.sls[i].pick(c), muc.accepted()
+	select {
+	case l.connc <- mc:
+		return
+	default:
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if !m.waitEnqueue(muc, i, l, mc, m.donec) {
+			_ = c.Close()
+			muc.logClose(ErrServerClosed)
+		}
+	}()
+}
+
+// deliver delivers muc to the i-th listener once it is matched.
+func (m *cMux) deliver(muc *MuxConn, i int, donec <-chan struct{}) {
+	muc.doneSniffing()
+	muc.matched(m.sls[i].l)
+	if m.readTimeout > noTimeout && m.deadline == ClearDeadline {
+		_ = muc.Conn.SetReadDeadline(time.Time{})
+	}
+	if !m.enqueue(muc, i, donec) {
+		m.drop(muc)
+	}
+}
+
+// enqueue waits until muc is in the backlog of the i-th listener, and
+// returns false if donec is closed first. If the backlog is full, it reports
+// ErrBacklogFull before waiting.
+func (m *cMux) enqueue(muc *MuxConn, i int, donec <-chan struct{}) bool {
+	l, c := m.sls[i].pick(muc.Conn), muc.accepted()
+	select {
+	case l.connc <- c:
+		return true
+	default:
 	}
+	return m.waitEnqueue(muc, i, l, c, donec)
 }
 
-func (m *cMux) Close() {
+// waitEnqueue reports ErrBacklogFull for muc, picked for l, the full
+// backlog of the i-th listener, and waits until c, the accepted form of muc,
+// is in the backlog. It returns false if donec is closed first.
+func (m *cMux) waitEnqueue(muc *MuxConn, i int, l muxListener, c net.Conn,
+	donec <-chan struct{}) bool {
+
+	// The connection is still delivered, so the answer of the handler is
+	// ignored: backlog pressure must not stop the mux.
+	_ = m.errh(ErrBacklogFull{
+		connError:  connError{c: muc.Conn, id: muc.info.ID},
+		matcherRef: matcherRef{name: l.name, listener: i, matcher: -1},
+	})
+	select {
+	case l.connc <- c:
+		return true
+	case <-donec:
+		return false
+	}
+}
+
+func (m *cMux) Close() error {
+	atomic.StoreInt32(&m.closed, 1)
 	m.closeDoneChans()
+
+	m.mu.Lock()
+	for muc := range m.sniffing {
+		// The matchers fail on the closed connection, and serve drops it.
+		_ = muc.Conn.Close()
+	}
+	m.mu.Unlock()
+
+	return m.rootListener().Close()
+}
+
+func (m *cMux) SwapRoot(l net.Listener) error {
+	m.mu.Lock()
+	select {
+	case <-m.donec:
+		m.mu.Unlock()
+		return ErrServerClosed
+	default:
+	}
+	old := m.root
+	m.root = l
+	m.rootGen++
+	m.mu.Unlock()
+
+	// Closing the old root unblocks the accept loops, which move on to l.
+	return old.Close()
+}
+
+func (m *cMux) rootListener() net.Listener {
+	l, _ := m.rootListenerGen()
+	return l
+}
+
+// rootListenerGen returns the root listener and the number of times it was
+// swapped.
+func (m *cMux) rootListenerGen() (net.Listener, uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.root, m.rootGen
+}
+
+func (m *cMux) Done() <-chan struct{} {
+	return m.servedc
+}
+
+// startServing records that muc is being matched, and returns false if the
+// mux is closed.
+func (m *cMux) startServing(muc *MuxConn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case <-m.donec:
+		return false
+	default:
+	}
+	if m.sniffing == nil {
+		m.sniffing = make(map[*MuxConn]struct{})
+	}
+	m.sniffing[muc] = struct{}{}
+	return true
+}
+
+func (m *cMux) doneServing(muc *MuxConn) {
+	m.mu.Lock()
+	delete(m.sniffing, muc)
+	m.mu.Unlock()
+}
+
+// drop closes muc, which is not delivered because the mux is closed.
+func (m *cMux) drop(muc *MuxConn) {
+	_ = muc.Conn.Close()
+	muc.buf.release()
+	muc.logClose(ErrServerClosed)
+}
+
+// closedErr returns the error of the listeners of a stopped mux:
+// ErrServerClosed if it was closed, and ErrListenerClosed if Serve returned
+// because of an error of the root listener.
+func (m *cMux) closedErr() error {
+	if atomic.LoadInt32(&m.closed) != 0 {
+		return ErrServerClosed
+	}
+	return ErrListenerClosed
 }
 
 func (m *cMux) closeDoneChans() {
@@ -226,12 +901,14 @@ func (m *cMux) closeDoneChans() {
 	default:
 		close(m.donec)
 	}
-	for _, sl := range m.sls {
-		select {
-		case <-sl.l.donec:
-			// Already closed. Don't close again
-		default:
-			close(sl.l.donec)
+	for i := range m.sls {
+		for _, l := range m.sls[i].listeners() {
+			select {
+			case <-l.donec:
+				// Already closed. Don't close again
+			default:
+				close(l.donec)
+			}
 		}
 	}
 }
@@ -245,35 +922,89 @@ func (m *cMux) handleErr(err error) bool {
 		return false
 	}
 
-	if ne, ok := err.(net.Error); ok {
-		return ne.Temporary()
-	}
-
-	return false
+	return isTemporary(err)
 }
 
 type muxListener struct {
-	net.Listener
+	mux   *cMux
+	name  string
+	stats *connStats
 	connc chan net.Conn
 	donec chan struct{}
+	// labels carries the pprof labels of the listener, if enabled.
+	labels context.Context
 }
 
 func (l muxListener) Accept() (net.Conn, error) {
 	select {
 	case c, ok := <-l.connc:
 		if !ok {
-			return nil, ErrListenerClosed
+			return nil, l.mux.closedErr()
+		}
+		if l.labels != nil {
+			pprof.SetGoroutineLabels(l.labels)
 		}
 		return c, nil
 	case <-l.donec:
-		return nil, ErrServerClosed
+		return nil, l.mux.closedErr()
 	}
 }
 
+// Addr returns the address of the root listener.
+func (l muxListener) Addr() net.Addr {
+	return l.mux.rootListener().Addr()
+}
+
+// Close closes the root listener.
+func (l muxListener) Close() error {
+	return l.mux.rootListener().Close()
+}
+
 // MuxConn wraps a net.Conn and provides transparent sniffing of connection data.
+//
+// The connections accepted from the listeners returned by a CMux are
+// *MuxConns, or *TLSMuxConns if they wrap a *tls.Conn, so type assertions on
+// the original connection type (for example *net.TCPConn or *tls.Conn) fail.
+// Use NetConn to reach the wrapped connection instead.
+//
+// Like *tls.Conn, connection wrappers are expected to expose the connection
+// they wrap through a NetConn() net.Conn method. To find a connection of a
+// given type, follow that chain until the type matches:
+//
+//	for {
+//		if tc, ok := c.(*net.TCPConn); ok {
+//			return tc
+//		}
+//		u, ok := c.(interface{ NetConn() net.Conn })
+//		if !ok {
+//			return nil
+//		}
+//		c = u.NetConn()
+//	}
 type MuxConn struct {
-	net.Conn
+	// stats is accessed atomically and must stay 64-bit aligned.
+	stats connStats
+	// buf starts with an atomically accessed field, so it must stay right
+	// after stats.
 	buf bufferedReader
+	// lstats are the stats of the listener that accepted the connection.
+	lstats *connStats
+
+	net.Conn
+	info   ConnInfo
+	tls    *tls.Conn
+	alog   *connLog
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// deadline is the read deadline set for sniffing, if any.
+	deadline time.Time
+	// greeting is what a greeter wrote to the connection, greetKey the key
+	// of the greeter, and swallow the number of bytes still to be dropped
+	// from the writes of the server. swallow is accessed atomically.
+	greeting []byte
+	greetKey string
+	swallow  int32
 }
 
 func newMuxConn(c net.Conn) *MuxConn {
@@ -294,7 +1025,214 @@ func newMuxConn(c net.Conn) *MuxConn {
 // return either err == EOF or err == nil.  The next Read should
 // return 0, EOF.
 func (m *MuxConn) Read(p []byte) (int, error) {
-	return m.buf.Read(p)
+	n, err := m.buf.Read(p)
+	m.stats.addRead(n)
+	if m.lstats != nil {
+		m.lstats.addRead(n)
+	}
+	if err != nil && m.alog != nil {
+		m.alog.fail(err)
+	}
+	return n, err
+}
+
+// Write writes p to the underlying connection. If the connection was greeted
+// by ServerFirst, the greeting is dropped from the first bytes written, which
+// must match it.
+func (m *MuxConn) Write(p []byte) (int, error) {
+	skipped, err := m.swallowGreeting(p)
+	if err != nil {
+		if m.alog != nil {
+			m.alog.fail(err)
+		}
+		return 0, err
+	}
+	if skipped > 0 && skipped == len(p) {
+		return skipped, nil
+	}
+	n, err := m.Conn.Write(p[skipped:])
+	m.stats.addWritten(n)
+	if m.lstats != nil {
+		m.lstats.addWritten(n)
+	}
+	if err != nil && m.alog != nil {
+		m.alog.fail(err)
+	}
+	return skipped + n, err
+}
+
+// MatchedProtocol returns the name of the listener that accepted the
+// connection, as passed to MatchNamed or MatchWithWritersNamed. It is empty
+// for listeners created without a name.
+func (m *MuxConn) MatchedProtocol() string {
+	return m.info.MatchedProtocol
+}
+
+// ID returns the ID of the connection. IDs are assigned in increasing order,
+// starting from 1, when the mux starts handling the connection, and are
+// unique within a CMux. They are also reported in the errors passed to the
+// ErrorHandler and in ConnInfo, so that events can be correlated.
+func (m *MuxConn) ID() uint64 {
+	return m.info.ID
+}
+
+// Context returns the context of the connection. It carries the ConnInfo of
+// the connection under ConnInfoContextKey, and is canceled when the
+// connection is closed.
+func (m *MuxConn) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// Close closes the connection and cancels its context.
+func (m *MuxConn) Close() error {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	// The sniffed bytes that were not read are not needed anymore.
+	m.buf.untrack()
+	err := m.Conn.Close()
+	m.logClose(nil)
+	return err
+}
+
+// matched records the metadata of the connection once it is matched for l.
+func (m *MuxConn) matched(l muxListener) {
+	atomic.AddUint64(&l.stats.matched, 1)
+	m.lstats = l.stats
+	m.info.MatchedProtocol = l.name
+	if c, ok := m.underlying(func(c net.Conn) bool {
+		_, ok := c.(*tls.Conn)
+		return ok
+	}); ok {
+		m.tls = c.(*tls.Conn)
+		// The handshake is complete if any of the matchers has read from
+		// the connection.
+		if cs := m.tls.ConnectionState(); cs.HandshakeComplete {
+			m.info.TLS = &cs
+		}
+	}
+	ctx := context.Background()
+	if l.labels != nil {
+		ctx = l.labels
+	}
+	m.ctx, m.cancel = context.WithCancel(withConnInfo(ctx, &m.info))
+}
+
+// Peeked returns the bytes sniffed by the matchers that have not been read
+// from m yet, without consuming them. It returns nil once the sniffed bytes
+// are consumed.
+//
+// The returned slice is only valid until the next call to Read, and Peeked
+// must not be called concurrently with Read.
+func (m *MuxConn) Peeked() []byte {
+	return m.buf.buffered()
+}
+
+// NetConn returns the underlying connection wrapped by m. Reads on the
+// returned connection bypass the bytes sniffed by the matchers.
+func (m *MuxConn) NetConn() net.Conn {
+	return m.Conn
+}
+
+// underlying follows the NetConn chain of the underlying connection and
+// returns the first connection for which is returns true.
+func (m *MuxConn) underlying(is func(net.Conn) bool) (net.Conn, bool) {
+	c := m.Conn
+	for {
+		if is(c) {
+			return c, true
+		}
+		u, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil, false
+		}
+		c = u.NetConn()
+	}
+}
+
+// SyscallConn returns a raw network connection of the underlying connection,
+// if it implements syscall.Conn, so that socket options can be set on it.
+// Note that reading from the raw connection bypasses the sniffed bytes.
+func (m *MuxConn) SyscallConn() (syscall.RawConn, error) {
+	c, ok := m.underlying(func(c net.Conn) bool {
+		_, ok := c.(syscall.Conn)
+		return ok
+	})
+	if !ok {
+		return nil, ErrNotSyscallConn
+	}
+	return c.(syscall.Conn).SyscallConn()
+}
+
+type keepAliveSetter interface {
+	SetKeepAlive(keepalive bool) error
+}
+
+type keepAlivePeriodSetter interface {
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+type noDelaySetter interface {
+	SetNoDelay(noDelay bool) error
+}
+
+type lingerSetter interface {
+	SetLinger(sec int) error
+}
+
+// SetKeepAlive sets whether the operating system should send keep-alive
+// messages on the underlying connection. See net.TCPConn.SetKeepAlive.
+func (m *MuxConn) SetKeepAlive(keepalive bool) error {
+	c, ok := m.underlying(func(c net.Conn) bool {
+		_, ok := c.(keepAliveSetter)
+		return ok
+	})
+	if !ok {
+		return ErrNotTCPConn
+	}
+	return c.(keepAliveSetter).SetKeepAlive(keepalive)
+}
+
+// SetKeepAlivePeriod sets the period between keep-alives on the underlying
+// connection. See net.TCPConn.SetKeepAlivePeriod.
+func (m *MuxConn) SetKeepAlivePeriod(d time.Duration) error {
+	c, ok := m.underlying(func(c net.Conn) bool {
+		_, ok := c.(keepAlivePeriodSetter)
+		return ok
+	})
+	if !ok {
+		return ErrNotTCPConn
+	}
+	return c.(keepAlivePeriodSetter).SetKeepAlivePeriod(d)
+}
+
+// SetNoDelay controls whether the operating system should delay packet
+// transmission on the underlying connection. See net.TCPConn.SetNoDelay.
+func (m *MuxConn) SetNoDelay(noDelay bool) error {
+	c, ok := m.underlying(func(c net.Conn) bool {
+		_, ok := c.(noDelaySetter)
+		return ok
+	})
+	if !ok {
+		return ErrNotTCPConn
+	}
+	return c.(noDelaySetter).SetNoDelay(noDelay)
+}
+
+// SetLinger sets the behavior of Close on the underlying connection. See
+// net.TCPConn.SetLinger.
+func (m *MuxConn) SetLinger(sec int) error {
+	c, ok := m.underlying(func(c net.Conn) bool {
+		_, ok := c.(lingerSetter)
+		return ok
+	})
+	if !ok {
+		return ErrNotTCPConn
+	}
+	return c.(lingerSetter).SetLinger(sec)
 }
 
 func (m *MuxConn) startSniffing() io.Reader {
@@ -16,6 +16,7 @@ package cmux
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"errors"
@@ -29,11 +30,14 @@ import (
 	"net/rpc"
 	"os"
 	"os/exec"
+	"reflect"
+	"regexp"
 	"runtime"
 	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -319,6 +323,69 @@ func TestTimeout(t *testing.T) {
 	}
 }
 
+func TestDeadlinePolicy(t *testing.T) {
+	testDeadlinePolicy(t, ClearDeadline)
+	testDeadlinePolicy(t, KeepDeadline)
+}
+
+func testDeadlinePolicy(t *testing.T, policy DeadlinePolicy) {
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+	const (
+		readTimeout = 50 * time.Millisecond
+		request     = "GET / HTTP/1.1\r\n"
+	)
+
+	writer, reader := net.Pipe()
+	go func() {
+		if _, err := io.WriteString(writer, request); err != nil {
+			t.Error(err)
+			return
+		}
+		// Wait past the read timeout before sending the rest.
+		time.Sleep(3 * readTimeout)
+		_, _ = io.WriteString(writer, "\r\n")
+		_ = writer.Close()
+	}()
+
+	l := newChanListener()
+	l.connCh <- reader
+	muxl := New(l)
+	muxl.SetReadTimeout(readTimeout)
+	muxl.SetDeadlinePolicy(policy)
+	httpl := muxl.Match(HTTP1Fast())
+	go safeServe(errCh, muxl)
+	muxedConn, err := httpl.Accept()
+	close(l.connCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = muxedConn.Close() }()
+
+	if _, err := io.ReadFull(muxedConn, make([]byte, len(request))); err != nil {
+		t.Fatal(err)
+	}
+	var b [2]byte
+	_, err = io.ReadFull(muxedConn, b[:])
+	switch policy {
+	case ClearDeadline:
+		if err != nil {
+			t.Errorf("unexpected error after the read timeout: %v", err)
+		}
+	case KeepDeadline:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("expected a timeout error, got %v", err)
+		}
+	}
+}
+
 func TestRead(t *testing.T) {
 	defer leakCheck(t)()
 	errCh := make(chan error)
@@ -399,6 +466,141 @@ func TestAny(t *testing.T) {
 	runTestHTTP1Client(t, l.Addr())
 }
 
+func TestPrefixByteMatcher(t *testing.T) {
+	m := PrefixByteMatcher([]byte{0xca, 0xfe, 0xba, 0xbe}, []byte{0x1f, 0x8b})
+	for _, test := range []struct {
+		data  []byte
+		match bool
+	}{
+		{[]byte{0xca, 0xfe, 0xba, 0xbe, 0x00}, true},
+		{[]byte{0x1f, 0x8b, 0x08}, true},
+		{[]byte{0xca, 0xfe}, false},
+		{[]byte("GET / HTTP/1.1\r\n\r\n"), false},
+	} {
+		if got := m(bytes.NewReader(test.data)); got != test.match {
+			t.Errorf("%x: want=%v got=%v", test.data, test.match, got)
+		}
+	}
+}
+
+func TestDirectHandoff(t *testing.T) {
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+	const payload = "hello"
+
+	writer, reader := net.Pipe()
+	go func() {
+		if _, err := io.WriteString(writer, payload); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := writer.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	l := newChanListener()
+	l.connCh <- reader
+	muxl := New(l)
+	anyl := muxl.MatchNamed("any", Any())
+	if muxl.(*cMux).direct < 0 {
+		t.Fatal("Any is not handed off directly")
+	}
+	go safeServe(errCh, muxl)
+	c, err := anyl.Accept()
+	close(l.connCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	muc := c.(*MuxConn)
+	if muc.buf.buffer != nil {
+		t.Error("connection was sniffed")
+	}
+	if p := muc.MatchedProtocol(); p != "any" {
+		t.Errorf("unexpected matched protocol %q", p)
+	}
+	b, err := ioutil.ReadAll(muc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != payload {
+		t.Errorf("unexpected read %q, expected %q", b, payload)
+	}
+
+	ready := true
+	for _, test := range []struct {
+		name  string
+		match func(CMux)
+	}{
+		{"after another matcher", func(m CMux) {
+			m.Match(HTTP1Fast())
+			m.Match(Any())
+		}},
+		{"before another listener", func(m CMux) {
+			m.Match(Any())
+			m.Match(HTTP1Fast())
+		}},
+		{"with another matcher", func(m CMux) {
+			m.Match(Any(), HTTP1Fast())
+		}},
+		{"not reading", func(m CMux) {
+			// Matches without reading, but not every connection.
+			m.Match(func(io.Reader) bool { return ready })
+		}},
+	} {
+		m := New(nil).(*cMux)
+		test.match(m)
+		if m.direct >= 0 {
+			t.Errorf("%s: connections are handed off directly", test.name)
+		}
+	}
+}
+
+func TestDirectHandoffBacklogFull(t *testing.T) {
+	defer leakCheck(t)()
+
+	// The listener is closed by Close.
+	l, _ := testListener(t)
+	m := New(l).(*cMux)
+	m.bufLen = 0
+	anyl := m.Match(Any())
+	go func() { _ = m.Serve() }()
+	defer func() { _ = m.Close() }()
+
+	const n = 3
+	for i := 0; i < n; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = c.Close() }()
+	}
+	// The accept loop does not wait for the connections to be accepted
+	// from anyl.
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadUint64(&m.lastID) < n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("accept loop blocked after %d connections", atomic.LoadUint64(&m.lastID))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < n; i++ {
+		c, err := anyl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.Close()
+	}
+}
+
 func TestTLS(t *testing.T) {
 	generateTLSCert(t)
 	defer cleanupTLSCert(t)
@@ -477,6 +679,309 @@ func TestHTTP2(t *testing.T) {
 	}
 }
 
+func TestPeeked(t *testing.T) {
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+	const payload = "GET / HTTP/1.1\r\n"
+
+	writer, reader := net.Pipe()
+	go func() {
+		if _, err := io.WriteString(writer, payload); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := writer.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	l := newChanListener()
+	l.connCh <- reader
+	muxl := New(l)
+	httpl := muxl.Match(HTTP1Fast())
+	go safeServe(errCh, muxl)
+	muxedConn, err := httpl.Accept()
+	close(l.connCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	muc := muxedConn.(*MuxConn)
+	peeked := string(muc.Peeked())
+	if peeked == "" || !strings.HasPrefix(payload, peeked) {
+		t.Fatalf("unexpected peeked bytes %q", peeked)
+	}
+	if again := string(muc.Peeked()); again != peeked {
+		t.Errorf("peeking consumed the bytes: got %q, want %q", again, peeked)
+	}
+
+	var b [2]byte
+	if _, err := io.ReadFull(muc, b[:]); err != nil {
+		t.Fatal(err)
+	}
+	if p := string(muc.Peeked()); p != peeked[2:] {
+		t.Errorf("unexpected peeked bytes after read: got %q, want %q", p, peeked[2:])
+	}
+
+	rest, err := ioutil.ReadAll(muc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b[:]) + string(rest); got != payload {
+		t.Errorf("unexpected read %q, expected %q", got, payload)
+	}
+	if p := muc.Peeked(); p != nil {
+		t.Errorf("unexpected peeked bytes after consuming the connection: %q", p)
+	}
+}
+
+func TestMaxSniffWorkers(t *testing.T) {
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+	// PrefixMatcher reads one byte more than its longest prefix.
+	const payload = "hello!"
+
+	l := newChanListener()
+	muxl := New(l, WithMaxSniffWorkers(1))
+	hellol := muxl.Match(PrefixMatcher("hello"))
+	go safeServe(errCh, muxl)
+	defer close(l.connCh)
+
+	slowW, slowR := net.Pipe()
+	fastW, fastR := net.Pipe()
+	defer func() {
+		_ = slowW.Close()
+		_ = fastW.Close()
+	}()
+	l.connCh <- slowR
+	l.connCh <- fastR
+	go func() {
+		if _, err := io.WriteString(fastW, payload); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	acceptc := make(chan net.Conn)
+	go func() {
+		for i := 0; i < 2; i++ {
+			c, err := hellol.Accept()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			acceptc <- c
+		}
+	}()
+
+	// The only worker is busy sniffing the slow connection, so the fast one
+	// must wait.
+	select {
+	case c := <-acceptc:
+		t.Fatalf("connection %v matched while the worker is busy", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	go func() {
+		if _, err := io.WriteString(slowW, payload); err != nil {
+			t.Error(err)
+		}
+	}()
+	for _, want := range []net.Conn{slowR, fastR} {
+		select {
+		case c := <-acceptc:
+			if c.(*MuxConn).Conn != want {
+				t.Errorf("connections matched out of order")
+			}
+			_ = c.Close()
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection not matched")
+		}
+	}
+}
+
+func TestAcceptLoops(t *testing.T) {
+	defer leakCheck(t)()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	muxl := New(l, WithAcceptLoops(4))
+	hellol := muxl.Match(PrefixMatcher("hello"))
+	errCh := make(chan error, 1)
+	go func() { errCh <- muxl.Serve() }()
+
+	const conns = 10
+	for i := 0; i < conns; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = c.Close() }()
+		if _, err := io.WriteString(c, "hello!"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < conns; i++ {
+		c, err := hellol.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.Close()
+	}
+
+	if err := muxl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Serve returns once all the loops are stopped.
+	if err := <-errCh; !strings.Contains(err.Error(), "use of closed") {
+		t.Errorf("unexpected error from Serve: %v", err)
+	}
+}
+
+func TestSwapRoot(t *testing.T) {
+	defer leakCheck(t)()
+	l1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	muxl := New(l1)
+	hellol := muxl.Match(PrefixMatcher("hello"))
+	errCh := make(chan error, 1)
+	go func() { errCh <- muxl.Serve() }()
+
+	for _, l := range []net.Listener{l1, l2} {
+		if l == l2 {
+			if err := muxl.SwapRoot(l2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = c.Close() }()
+		if _, err := io.WriteString(c, "hello!"); err != nil {
+			t.Fatal(err)
+		}
+		mc, err := hellol.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = mc.Close()
+		if hellol.Addr() != l.Addr() {
+			t.Errorf("unexpected address: want=%v got=%v", l.Addr(), hellol.Addr())
+		}
+	}
+
+	if err := muxl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; !strings.Contains(err.Error(), "use of closed") {
+		t.Errorf("unexpected error from Serve: %v", err)
+	}
+	if err := muxl.SwapRoot(l1); err != ErrServerClosed {
+		t.Errorf("unexpected error swapping the root of a closed mux: %v", err)
+	}
+}
+
+func TestMaxSniffMemory(t *testing.T) {
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+	// PrefixMatcher reads one byte more than its longest prefix.
+	const payload = "hello!"
+
+	l := newChanListener()
+	muxl := New(l, WithMaxSniffMemory(1))
+	hellol := muxl.Match(PrefixMatcher("hello"))
+	go safeServe(errCh, muxl)
+	defer close(l.connCh)
+
+	var readers []net.Conn
+	for i := 0; i < 3; i++ {
+		w, r := net.Pipe()
+		defer func() { _ = w.Close() }()
+		go func() {
+			if _, err := io.WriteString(w, payload); err != nil {
+				t.Error(err)
+			}
+		}()
+		readers = append(readers, r)
+	}
+
+	l.connCh <- readers[0]
+	c, err := hellol.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	conns := []net.Conn{c}
+
+	// The sniffed bytes of the first connection are not read yet, so the
+	// next connections must wait. Serve may already be waiting in Accept
+	// when the memory goes above the limit though, so one more connection
+	// can be accepted.
+	var pending net.Conn
+	for _, r := range readers[1:] {
+		l.connCh <- r
+		time.Sleep(100 * time.Millisecond)
+		if len(l.connCh) == 1 {
+			pending = r
+			break
+		}
+		c, err := hellol.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = c.Close() }()
+		conns = append(conns, c)
+	}
+	if pending == nil {
+		t.Fatal("connections accepted above the memory limit")
+	}
+
+	for _, c := range conns {
+		var b [len(payload)]byte
+		if _, err := io.ReadFull(c, b[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err = hellol.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.(*MuxConn).Conn != pending {
+		t.Error("unexpected connection matched")
+	}
+	_ = c.Close()
+}
+
 func TestHTTP2MatchHeaderField(t *testing.T) {
 	testHTTP2MatchHeaderField(t, HTTP2HeaderField, "value", "value", "anothervalue")
 }
@@ -485,6 +990,136 @@ func TestHTTP2MatchHeaderFieldPrefix(t *testing.T) {
 	testHTTP2MatchHeaderField(t, HTTP2HeaderFieldPrefix, "application/grpc+proto", "application/grpc", "application/json")
 }
 
+func TestHTTP2MatchHeaderFieldRegex(t *testing.T) {
+	testHTTP2MatchHeaderField(t, func(name, expr string) Matcher {
+		return HTTP2HeaderFieldRegex(name, regexp.MustCompile(expr))
+	}, "application/grpc+json", `^application/grpc(\+proto|\+json)?$`, `^application/json$`)
+
+	var w bytes.Buffer
+	m := HTTP2MatchHeaderFieldRegexSendSettings("content-type", regexp.MustCompile(`^application/grpc(\+proto)?$`))
+	if !m(&w, bytes.NewReader(benchHTTP2HeaderPayload)) {
+		t.Error("content type not matched")
+	}
+	if w.Len() == 0 {
+		t.Error("settings not sent")
+	}
+}
+
+func TestHTTP2PseudoHeaderFields(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		m     MatchWriter
+		match bool
+	}{
+		{"path", HTTP2PathPrefixSendSettings("/grpc.health.v1.Health/"), true},
+		{"other path", HTTP2PathPrefixSendSettings("/grpc.reflection."), false},
+		{"authority", HTTP2AuthoritySendSettings("LocalHost:50051"), true},
+		{"other authority", HTTP2AuthoritySendSettings("localhost"), false},
+		{"path matcher", func(w io.Writer, r io.Reader) bool {
+			return HTTP2PathPrefix("/grpc.health.")(r)
+		}, true},
+		{"authority matcher", func(w io.Writer, r io.Reader) bool {
+			return HTTP2Authority("localhost:50051")(r)
+		}, true},
+	} {
+		var w bytes.Buffer
+		if got := test.m(&w, bytes.NewReader(benchHTTP2HeaderPayload)); got != test.match {
+			t.Errorf("%s: want=%v got=%v", test.name, test.match, got)
+		}
+	}
+}
+
+func TestHTTP1HeaderPredicate(t *testing.T) {
+	const req = "GET / HTTP/1.1\r\nHost: example.com\r\n" +
+		"x-forwarded-proto: https\r\n" +
+		"Authorization: Bearer token\r\nAuthorization: Basic Zm9vOmJhcg==\r\n\r\n"
+	for _, test := range []struct {
+		name  string
+		m     Matcher
+		match bool
+	}{
+		{"proto", HTTP1HeaderPredicate(func(name, value string) bool {
+			return name == "X-Forwarded-Proto" && value == "https"
+		}), true},
+		{"host", HTTP1HeaderPredicate(func(name, value string) bool {
+			return name == "Host" && value == "example.com"
+		}), true},
+		{"none", HTTP1HeaderPredicate(func(name, value string) bool {
+			return name == "Cookie"
+		}), false},
+		{"basic", HTTP1HeaderFieldRegex("authorization", regexp.MustCompile(`^Basic `)), true},
+		{"digest", HTTP1HeaderFieldRegex("Authorization", regexp.MustCompile(`^Digest `)), false},
+	} {
+		if got := test.m(strings.NewReader(req)); got != test.match {
+			t.Errorf("%s: want=%v got=%v", test.name, test.match, got)
+		}
+	}
+	if HTTP1HeaderPredicate(func(string, string) bool { return true })(strings.NewReader(http2.ClientPreface)) {
+		t.Error("HTTP/2 preface matched")
+	}
+}
+
+func TestHTTP1Methods(t *testing.T) {
+	m := HTTP1Methods("PROPFIND", "MKCOL", "REPORT")
+	for _, test := range []struct {
+		req   string
+		match bool
+	}{
+		{"PROPFIND /dav/ HTTP/1.1\r\nDepth: 1\r\n\r\n", true},
+		{"MKCOL /dav/new/ HTTP/1.1\r\n\r\n", true},
+		{"REPORT /cal/ HTTP/1.1\r\n\r\n", true},
+		{"REPORTS /cal/ HTTP/1.1\r\n\r\n", false},
+		{"GET / HTTP/1.1\r\n\r\n", false},
+	} {
+		if got := m(strings.NewReader(test.req)); got != test.match {
+			t.Errorf("%q: want=%v got=%v", test.req, test.match, got)
+		}
+	}
+}
+
+func TestHTTP1Version(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		versions []string
+		req      string
+		match    bool
+	}{
+		{"1.0", []string{"HTTP/1.0"}, "GET / HTTP/1.0\r\n\r\n", true},
+		{"1.1", []string{"HTTP/1.0"}, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", false},
+		{"either", []string{"HTTP/1.0", "HTTP/1.1"}, "POST / HTTP/1.1\r\n\r\n", true},
+		{"none", nil, "GET / HTTP/1.0\r\n\r\n", false},
+		{"http2", []string{"HTTP/2.0"}, http2.ClientPreface, false},
+		{"garbage", []string{"HTTP/1.0"}, "HTTP/1.0\r\n\r\n", false},
+	} {
+		if got := HTTP1Version(test.versions...)(strings.NewReader(test.req)); got != test.match {
+			t.Errorf("%s: want=%v got=%v", test.name, test.match, got)
+		}
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		hosts []string
+		req   string
+		match bool
+	}{
+		{"any", nil, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", true},
+		{"host", []string{"Example.com"}, "CONNECT example.com:443 HTTP/1.1\r\n\r\n", true},
+		{"target", []string{"example.com:443"}, "CONNECT example.com:443 HTTP/1.0\r\n\r\n", true},
+		{"other port", []string{"example.com:8443"}, "CONNECT example.com:443 HTTP/1.1\r\n\r\n", false},
+		{"other host", []string{"example.org"}, "CONNECT example.com:443 HTTP/1.1\r\n\r\n", false},
+		{"ipv6", []string{"::1"}, "CONNECT [::1]:443 HTTP/1.1\r\n\r\n", true},
+		{"no port", nil, "CONNECT example.com HTTP/1.1\r\n\r\n", false},
+		{"get", nil, "GET http://example.com/ HTTP/1.1\r\n\r\n", false},
+		{"http2", nil, http2.ClientPreface, false},
+	} {
+		if got := HTTPConnect(test.hosts...)(strings.NewReader(test.req)); got != test.match {
+			t.Errorf("%s: want=%v got=%v", test.name, test.match, got)
+		}
+	}
+}
+
 func testHTTP2MatchHeaderField(
 	t *testing.T,
 	matcherConstructor func(string, string) Matcher,
@@ -603,8 +1238,10 @@ func TestErrorHandler(t *testing.T) {
 	var errCount uint32
 	muxl.HandleError(func(err error) bool {
 		if atomic.AddUint32(&errCount, 1) == 1 {
-			if _, ok := err.(ErrNotMatched); !ok {
+			if e, ok := err.(ErrNotMatched); !ok {
 				t.Errorf("unexpected error: %v", err)
+			} else if e.ConnID() == 0 {
+				t.Errorf("no connection ID in error: %v", err)
 			}
 		}
 		return true
@@ -651,6 +1288,42 @@ func TestMultipleMatchers(t *testing.T) {
 	runTestHTTP1Client(t, l.Addr())
 }
 
+func TestMatchUnmatched(t *testing.T) {
+	defer leakCheck(t)()
+
+	l := newChanListener()
+	defer close(l.connCh)
+	muxl := New(l)
+	muxl.Match(PrefixMatcher("hello"))
+	unmatchedl := muxl.MatchUnmatched()
+	if muxl.MatchUnmatched() != unmatchedl {
+		t.Error("MatchUnmatched returned another listener")
+	}
+	errc := serveErrors(t, muxl)
+
+	w, r := net.Pipe()
+	defer func() { _ = w.Close() }()
+	writeAsync(w, "bye!!!")
+	l.connCh <- r
+	c, err := unmatchedl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	var b [6]byte
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:]) != "bye!!!" {
+		t.Errorf("unexpected sniffed bytes: %q", b)
+	}
+	select {
+	case err := <-errc:
+		t.Errorf("unexpected error: %v", err)
+	default:
+	}
+}
+
 func TestListenerClose(t *testing.T) {
 	defer leakCheck(t)()
 	errCh := make(chan error)
@@ -696,7 +1369,7 @@ func TestListenerClose(t *testing.T) {
 	}
 }
 
-func TestClose(t *testing.T) {
+func TestNetConn(t *testing.T) {
 	defer leakCheck(t)()
 	errCh := make(chan error)
 	defer func() {
@@ -711,12 +1384,333 @@ func TestClose(t *testing.T) {
 
 	muxl := New(l)
 	anyl := muxl.Match(Any())
+	go safeServe(errCh, muxl)
 
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	muxedConn, err := anyl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = muxedConn.Close() }()
+
+	nc, ok := muxedConn.(interface{ NetConn() net.Conn })
+	if !ok {
+		t.Fatalf("%T does not implement NetConn", muxedConn)
+	}
+	if _, ok := nc.NetConn().(*net.TCPConn); !ok {
+		t.Errorf("unexpected underlying connection %T", nc.NetConn())
+	}
+}
+
+func TestSyscallConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer func() {
+		_ = c1.Close()
+		_ = c2.Close()
+	}()
+	if _, err := newMuxConn(c1).SyscallConn(); err != ErrNotSyscallConn {
+		t.Errorf("unexpected error for a pipe: %v", err)
+	}
+
+	l, cleanup := testListener(t)
+	defer cleanup()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	var sc syscall.Conn = newMuxConn(c)
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	if err := rc.Control(func(fd uintptr) { called = true }); err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Error("control function was not called")
+	}
+}
+
+func TestTCPSetters(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer func() {
+		_ = c1.Close()
+		_ = c2.Close()
+	}()
+	if err := newMuxConn(c1).SetNoDelay(true); err != ErrNotTCPConn {
+		t.Errorf("unexpected error for a pipe: %v", err)
+	}
+
+	l, cleanup := testListener(t)
+	defer cleanup()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	// Wrap the connection twice to exercise the NetConn chain.
+	muc := newMuxConn(newMuxConn(c))
+	if err := muc.SetKeepAlive(true); err != nil {
+		t.Error(err)
+	}
+	if err := muc.SetKeepAlivePeriod(time.Minute); err != nil {
+		t.Error(err)
+	}
+	if err := muc.SetNoDelay(false); err != nil {
+		t.Error(err)
+	}
+	if err := muc.SetLinger(0); err != nil {
+		t.Error(err)
+	}
+}
+
+type testProtocolHandler struct{}
+
+func (h *testProtocolHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, r.Context().Value(MatchedProtocolContextKey))
+}
+
+func TestMatchedProtocol(t *testing.T) {
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+	l, cleanup := testListener(t)
+	defer cleanup()
+
+	muxl := New(l)
+	httpl := muxl.MatchNamed(testHTTP1Resp, HTTP1Fast())
+	rpcl := muxl.MatchWithWritersNamed("rpc", matchersToMatchWriters([]Matcher{Any()})...)
+
+	s := &http.Server{
+		Handler:     &testProtocolHandler{},
+		ConnContext: ConnContext,
+	}
+	s.SetKeepAlivesEnabled(false)
+	go func() { _ = s.Serve(httpl) }()
+	go safeServe(errCh, muxl)
+
+	// The handler responds with the name of the listener.
+	runTestHTTP1Client(t, l.Addr())
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	if _, err := io.WriteString(c, "rpc request"); err != nil {
+		t.Fatal(err)
+	}
+	muxedConn, err := rpcl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = muxedConn.Close() }()
+	if p := muxedConn.(*MuxConn).MatchedProtocol(); p != "rpc" {
+		t.Errorf("unexpected matched protocol: %q", p)
+	}
+}
+
+func TestConnContext(t *testing.T) {
+	generateTLSCert(t)
+	defer cleanupTLSCert(t)
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+	l, cleanup := testListener(t)
+	defer cleanup()
+
+	certificate, err := tls.LoadX509KeyPair("cert.pem", "key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsl := tls.NewListener(l, &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+	})
+
+	muxl := New(tlsl)
+	anyl := muxl.MatchNamed("any", PrefixMatcher("hello"))
+	go safeServe(errCh, muxl)
+
+	c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	if _, err := io.WriteString(c, "hello world"); err != nil {
+		t.Fatal(err)
+	}
+
+	muxedConn, err := anyl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The connection wraps a *tls.Conn, whose state it exposes.
+	tc, ok := muxedConn.(*TLSMuxConn)
+	if !ok {
+		t.Fatalf("unexpected connection type: %T", muxedConn)
+	}
+	if cs := tc.ConnectionState(); !cs.HandshakeComplete {
+		t.Errorf("unexpected TLS connection state: %v", cs)
+	}
+	ctx := tc.Context()
+	info, ok := ConnInfoFromContext(ctx)
+	if !ok {
+		t.Fatal("no connection info in the context")
+	}
+	if info.MatchedProtocol != "any" {
+		t.Errorf("unexpected matched protocol: %q", info.MatchedProtocol)
+	}
+	if id := tc.ID(); id != 1 || info.ID != id {
+		t.Errorf("unexpected connection ID: %d (info: %d)", id, info.ID)
+	}
+	if info.TLS == nil || !info.TLS.HandshakeComplete {
+		t.Errorf("unexpected TLS state: %v", info.TLS)
+	}
+
+	reqCtx := ConnContext(context.Background(), muxedConn)
+	if info, ok := ConnInfoFromContext(reqCtx); !ok || info.MatchedProtocol != "any" {
+		t.Errorf("unexpected connection info in the request context: %v", info)
+	}
+
+	if err := muxedConn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	default:
+		t.Error("context is not canceled after closing the connection")
+	}
+}
+
+func TestStats(t *testing.T) {
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+	const (
+		request  = "GET / HTTP/1.1\r\n"
+		response = "HTTP/1.1 200 OK\r\n"
+	)
+
+	writer, reader := net.Pipe()
+	go func() {
+		if _, err := io.WriteString(writer, request); err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := io.ReadFull(writer, make([]byte, len(response))); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := writer.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	l := newChanListener()
+	l.connCh <- reader
+	muxl := New(l)
+	muxl.MatchNamed("ssh", PrefixMatcher("SSH-"))
+	httpl := muxl.MatchNamed("http", HTTP1Fast())
 	go safeServe(errCh, muxl)
+	muxedConn, err := httpl.Accept()
+	close(l.connCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(io.LimitReader(muxedConn, int64(len(request)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(muxedConn, response); err != nil {
+		t.Fatal(err)
+	}
 
-	muxl.Close()
+	muc := muxedConn.(*MuxConn)
+	if n := muc.BytesRead(); n != uint64(len(request)) {
+		t.Errorf("unexpected bytes read: want=%d got=%d", len(request), n)
+	}
+	if n := muc.BytesWritten(); n != uint64(len(response)) {
+		t.Errorf("unexpected bytes written: want=%d got=%d", len(response), n)
+	}
 
-	if _, err := anyl.Accept(); err != ErrServerClosed {
+	want := []ListenerStats{
+		{Name: "ssh"},
+		{
+			Name:         "http",
+			Matched:      1,
+			BytesRead:    uint64(len(request)),
+			BytesWritten: uint64(len(response)),
+		},
+	}
+	got := muxl.Stats()
+	// The sniff latencies vary from run to run, so only the number of calls
+	// is checked.
+	for i, wantCalls := range []uint64{1, 1} {
+		ms := got[i].Matchers
+		if len(ms) != 1 || ms[0].Calls != wantCalls {
+			t.Errorf("unexpected matcher stats for %s: %+v", got[i].Name, ms)
+		}
+		got[i].Matchers = nil
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected stats: want=%+v got=%+v", want, got)
+	}
+}
+
+func TestDone(t *testing.T) {
+	defer leakCheck(t)()
+	l := newChanListener()
+
+	muxl := New(l)
+	anyl := muxl.Match(Any())
+	errCh := make(chan error, 1)
+	go func() { errCh <- muxl.Serve() }()
+
+	select {
+	case <-muxl.Done():
+		t.Fatal("done before Serve returned")
+	default:
+	}
+
+	close(l.connCh)
+	select {
+	case <-muxl.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not done after the root listener was closed")
+	}
+	if err := <-errCh; err == nil {
+		t.Error("Serve returned nil")
+	}
+	// The listeners are closed once done.
+	if _, err := anyl.Accept(); err != ErrListenerClosed {
 		t.Fatal(err)
 	}
 }
@@ -0,0 +1,118 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// contextKey is a value for use with context.WithValue. It's used as
+// a pointer so it fits in an interface{} without allocation.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string { return "cmux context value " + k.name }
+
+// ConnInfo is the metadata cmux learned about a connection while matching it.
+type ConnInfo struct {
+	// ID is the ID of the connection. See MuxConn.ID.
+	ID uint64
+	// MatchedProtocol is the name of the listener that accepted the
+	// connection. See MuxConn.MatchedProtocol.
+	MatchedProtocol string
+	// TLS is the state of the underlying TLS connection, if the connection
+	// was accepted from a TLS listener and the handshake was complete when
+	// the connection was matched.
+	TLS *tls.ConnectionState
+	// Proxy is the PROXY protocol header of the connection, if it was
+	// consumed by ProxyHeaderStage.
+	Proxy *ProxyInfo
+}
+
+// ProxyInfo is what a PROXY protocol header said about a connection.
+type ProxyInfo struct {
+	// Version is the version of the header, 1 or 2.
+	Version int
+	// Source and Destination are the addresses of the client and server
+	// given by the header. They are nil for LOCAL and UNKNOWN headers, and
+	// for the address families cmux does not decode.
+	Source, Destination net.Addr
+}
+
+// ConnInfoContextKey is a context key. The associated value is of type
+// *ConnInfo and is present in the context of connections accepted by cmux
+// (see MuxConn.Context) and, when ConnContext is used, in the context of HTTP
+// requests served on them.
+var ConnInfoContextKey = &contextKey{"conn-info"}
+
+// ConnInfoFromContext returns the ConnInfo stored in ctx, if any.
+func ConnInfoFromContext(ctx context.Context) (*ConnInfo, bool) {
+	info, ok := ctx.Value(ConnInfoContextKey).(*ConnInfo)
+	return info, ok
+}
+
+// MatchedProtocolContextKey is a context key. It can be used in HTTP
+// handlers with Context().Value(MatchedProtocolContextKey) to access the name
+// of the cmux listener that accepted the connection. The associated value is
+// of type string.
+//
+// The value is only set when ConnContext is used as the ConnContext of the
+// http.Server.
+var MatchedProtocolContextKey = &contextKey{"matched-protocol"}
+
+// ConnContext adds the metadata cmux knows about c to ctx. It has the
+// signature of http.Server.ConnContext, so that the metadata is available in
+// the context of the requests served on the connection:
+//
+//	s := &http.Server{
+//		Handler:     h,
+//		ConnContext: cmux.ConnContext,
+//	}
+//
+// Connections that were not accepted by cmux are left untouched.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	muc, ok := muxConnOf(c)
+	if !ok {
+		return ctx
+	}
+	return withConnInfo(ctx, &muc.info)
+}
+
+func withConnInfo(ctx context.Context, info *ConnInfo) context.Context {
+	ctx = context.WithValue(ctx, ConnInfoContextKey, info)
+	return context.WithValue(ctx, MatchedProtocolContextKey, info.MatchedProtocol)
+}
+
+// muxConnOf follows the NetConn chain of c, e.g. when c is a *tls.Conn
+// wrapping a *MuxConn, and returns the first *MuxConn in it, including the
+// one of a *TLSMuxConn.
+func muxConnOf(c net.Conn) (*MuxConn, bool) {
+	for {
+		switch mc := c.(type) {
+		case *MuxConn:
+			return mc, true
+		case *TLSMuxConn:
+			return mc.MuxConn, true
+		}
+		u, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil, false
+		}
+		c = u.NetConn()
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"fmt"
+	"net"
+)
+
+var (
+	_ net.Error = ErrSniffTimeout{}
+	_ net.Error = ErrMatcherPanic{}
+	_ net.Error = ErrBacklogFull{}
+	_ net.Error = ErrConnRejected{}
+	_ net.Error = ErrNoBytes{}
+	_ net.Error = ErrTLSHandshake{}
+)
+
+// connError identifies the connection of an error.
+type connError struct {
+	c  net.Conn
+	id uint64
+}
+
+// ConnID returns the ID of the connection. See MuxConn.ID.
+func (e connError) ConnID() uint64 { return e.id }
+
+// RemoteAddr returns the remote address of the connection.
+func (e connError) RemoteAddr() net.Addr { return e.c.RemoteAddr() }
+
+// asNotMatched sets target to the ErrNotMatched of the connection, if target
+// is a *ErrNotMatched, for the errors that are also an ErrNotMatched.
+func (e connError) asNotMatched(target interface{}) bool {
+	p, ok := target.(*ErrNotMatched)
+	if ok {
+		*p = ErrNotMatched{c: e.c, id: e.id}
+	}
+	return ok
+}
+
+func isNotMatched(target error) bool {
+	_, ok := target.(ErrNotMatched)
+	return ok
+}
+
+// matcherRef identifies the listener and the matcher of an error.
+type matcherRef struct {
+	name     string
+	listener int
+	matcher  int
+}
+
+// Listener returns the name of the listener involved, as passed to
+// MatchNamed or MatchWithWritersNamed.
+func (r matcherRef) Listener() string { return r.name }
+
+// ListenerIndex returns the index of the listener involved, in the order the
+// listeners were created by the Match methods, or -1 if unknown.
+func (r matcherRef) ListenerIndex() int { return r.listener }
+
+// MatcherIndex returns the index of the matcher involved among the matchers
+// of the listener, or -1 if no matcher is involved.
+func (r matcherRef) MatcherIndex() int { return r.matcher }
+
+func (r matcherRef) describe() string {
+	if r.listener < 0 {
+		return "unknown matcher"
+	}
+	l := fmt.Sprintf("listener %d", r.listener)
+	if r.name != "" {
+		l = fmt.Sprintf("listener %q", r.name)
+	}
+	if r.matcher < 0 {
+		return l
+	}
+	return fmt.Sprintf("matcher %d of %s", r.matcher, l)
+}
+
+// ErrSniffTimeout is passed to the ErrorHandler instead of ErrNotMatched when
+// a connection is not matched because the read timeout set with
+// SetReadTimeout expired. It refers to the matcher that was reading then.
+// Since the connection was not matched either, errors.Is and errors.As
+// recognize it as an ErrNotMatched.
+type ErrSniffTimeout struct {
+	connError
+	matcherRef
+}
+
+// Is reports whether target is an ErrNotMatched.
+func (e ErrSniffTimeout) Is(target error) bool { return isNotMatched(target) }
+
+// As sets target to the ErrNotMatched of the connection, if target is a
+// *ErrNotMatched.
+func (e ErrSniffTimeout) As(target interface{}) bool { return e.asNotMatched(target) }
+
+func (e ErrSniffTimeout) Error() string {
+	return fmt.Sprintf("mux: connection %v (id %d) timed out in %s",
+		e.c.RemoteAddr(), e.id, e.describe())
+}
+
+// Temporary implements the net.Error interface.
+func (e ErrSniffTimeout) Temporary() bool { return true }
+
+// Timeout implements the net.Error interface.
+func (e ErrSniffTimeout) Timeout() bool { return true }
+
+// ErrMatcherPanic is passed to the ErrorHandler when a matcher panics. The
+// connection is closed without trying the remaining matchers.
+type ErrMatcherPanic struct {
+	connError
+	matcherRef
+	value interface{}
+}
+
+func (e ErrMatcherPanic) Error() string {
+	return fmt.Sprintf("mux: %s panicked on connection %v (id %d): %v",
+		e.describe(), e.c.RemoteAddr(), e.id, e.value)
+}
+
+// Value returns the value the matcher panicked with.
+func (e ErrMatcherPanic) Value() interface{} { return e.value }
+
+// Temporary implements the net.Error interface.
+func (e ErrMatcherPanic) Temporary() bool { return true }
+
+// Timeout implements the net.Error interface.
+func (e ErrMatcherPanic) Timeout() bool { return false }
+
+// ErrBacklogFull is passed to the ErrorHandler when a connection is matched
+// while the backlog of its listener is full, i.e., when the listener is not
+// accepted from fast enough. The connection is still delivered once there is
+// room in the backlog, and the mux keeps serving whatever the handler
+// returns. It refers to the listener, and MatcherIndex is -1.
+type ErrBacklogFull struct {
+	connError
+	matcherRef
+}
+
+func (e ErrBacklogFull) Error() string {
+	return fmt.Sprintf("mux: backlog of %s full for connection %v (id %d)",
+		e.describe(), e.c.RemoteAddr(), e.id)
+}
+
+// Temporary implements the net.Error interface.
+func (e ErrBacklogFull) Temporary() bool { return true }
+
+// Timeout implements the net.Error interface.
+func (e ErrBacklogFull) Timeout() bool { return false }
+
+// ErrConnRejected is passed to the ErrorHandler when a connection is
+// rejected right after it is accepted, before any byte is read from it,
+// by the policy of WithIPPolicy or a gate of WithConnGate. The connection is
+// closed. Its ConnID is 0, since rejected connections are not assigned an
+// ID.
+type ErrConnRejected struct {
+	connError
+	reason string
+}
+
+func (e ErrConnRejected) Error() string {
+	return fmt.Sprintf("mux: connection %v rejected: %s", e.c.RemoteAddr(), e.reason)
+}
+
+// Reason returns why the connection was rejected.
+func (e ErrConnRejected) Reason() string { return e.reason }
+
+// Temporary implements the net.Error interface.
+func (e ErrConnRejected) Temporary() bool { return true }
+
+// Timeout implements the net.Error interface.
+func (e ErrConnRejected) Timeout() bool { return false }
+
+// ErrNoBytes is passed to the ErrorHandler instead of ErrNotMatched or
+// ErrSniffTimeout when a connection is not matched because it sent nothing
+// before it was closed or the read timeout expired, e.g., a health check of
+// a load balancer or a port scan. See MatchNoBytes and WithNoBytesHandler.
+// Since the connection was not matched either, errors.Is and errors.As
+// recognize it as an ErrNotMatched.
+type ErrNoBytes struct {
+	connError
+	timeout bool
+}
+
+// Is reports whether target is an ErrNotMatched.
+func (e ErrNoBytes) Is(target error) bool { return isNotMatched(target) }
+
+// As sets target to the ErrNotMatched of the connection, if target is a
+// *ErrNotMatched.
+func (e ErrNoBytes) As(target interface{}) bool { return e.asNotMatched(target) }
+
+func (e ErrNoBytes) Error() string {
+	if e.timeout {
+		return fmt.Sprintf("mux: connection %v (id %d) sent nothing before the read timeout",
+			e.c.RemoteAddr(), e.id)
+	}
+	return fmt.Sprintf("mux: connection %v (id %d) closed without sending anything",
+		e.c.RemoteAddr(), e.id)
+}
+
+// Temporary implements the net.Error interface.
+func (e ErrNoBytes) Temporary() bool { return true }
+
+// Timeout implements the net.Error interface. It reports whether the read
+// timeout expired, as opposed to the connection being closed.
+func (e ErrNoBytes) Timeout() bool { return e.timeout }
+
+// ErrTLSHandshake is passed to the ErrorHandler when the TLS handshake of a
+// connection fails, with the TLS termination of WithTLSConfig. The
+// connection is closed.
+type ErrTLSHandshake struct {
+	connError
+	err error
+}
+
+func (e ErrTLSHandshake) Error() string {
+	return fmt.Sprintf("mux: TLS handshake of connection %v (id %d) failed: %v",
+		e.c.RemoteAddr(), e.id, e.err)
+}
+
+// Unwrap returns the error of the handshake.
+func (e ErrTLSHandshake) Unwrap() error { return e.err }
+
+// Temporary implements the net.Error interface.
+func (e ErrTLSHandshake) Temporary() bool { return true }
+
+// Timeout implements the net.Error interface. It reports whether the
+// handshake failed because the read timeout expired.
+func (e ErrTLSHandshake) Timeout() bool {
+	ne, ok := e.err.(net.Error)
+	return ok && ne.Timeout()
+}
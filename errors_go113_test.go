@@ -0,0 +1,139 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build go1.13
+// +build go1.13
+
+package cmux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestErrSniffTimeoutIsNotMatched(t *testing.T) {
+	defer leakCheck(t)()
+
+	// The listener is closed by Close.
+	l, _ := testListener(t)
+	m := New(l)
+	m.SetReadTimeout(50 * time.Millisecond)
+	hellol := m.Match(PrefixMatcher("hello"))
+	errc := make(chan error, 1)
+	// A handler written for ErrNotMatched only.
+	m.HandleError(func(err error) bool {
+		var nm ErrNotMatched
+		ok := errors.As(err, &nm)
+		if ok {
+			errc <- err
+		}
+		return ok
+	})
+	go func() { _ = m.Serve() }()
+	defer func() { _ = m.Close() }()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	if _, err := io.WriteString(c, "hel"); err != nil {
+		t.Fatal(err)
+	}
+	err = <-errc
+	if _, ok := err.(ErrSniffTimeout); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !errors.Is(err, ErrNotMatched{}) {
+		t.Errorf("%v is not ErrNotMatched", err)
+	}
+	var nm ErrNotMatched
+	if errors.As(err, &nm); nm.ConnID() != err.(ErrSniffTimeout).ConnID() {
+		t.Errorf("unexpected connection ID %d", nm.ConnID())
+	}
+
+	// The mux is still serving.
+	c2, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c2.Close() }()
+	if _, err := io.WriteString(c2, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	muc, err := hellol.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = muc.Close()
+}
+
+func TestErrNoBytesIsNotMatched(t *testing.T) {
+	defer leakCheck(t)()
+
+	// The listener is closed by Close.
+	l, _ := testListener(t)
+	m := New(l)
+	m.SetReadTimeout(50 * time.Millisecond)
+	hellol := m.Match(PrefixMatcher("hello"))
+	errc := make(chan error, 2)
+	// A handler written for ErrNotMatched only.
+	m.HandleError(func(err error) bool {
+		var nm ErrNotMatched
+		ok := errors.As(err, &nm)
+		if ok {
+			errc <- err
+		}
+		return ok
+	})
+	go func() { _ = m.Serve() }()
+	defer func() { _ = m.Close() }()
+
+	// A port scan, and a health check waiting for the read timeout.
+	for _, timeout := range []bool{false, true} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !timeout {
+			_ = c.Close()
+		}
+		err = <-errc
+		if e, ok := err.(ErrNoBytes); !ok || e.Timeout() != timeout {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !errors.Is(err, ErrNotMatched{}) {
+			t.Errorf("%v is not ErrNotMatched", err)
+		}
+		_ = c.Close()
+	}
+
+	// The mux is still serving.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	muc, err := hellol.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = muc.Close()
+}
@@ -0,0 +1,172 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveErrors serves m and returns a channel receiving the errors passed to
+// its error handler.
+func serveErrors(t *testing.T, m CMux) <-chan error {
+	errc := make(chan error, 1)
+	m.HandleError(func(err error) bool {
+		errc <- err
+		return true
+	})
+	go func() {
+		if err := m.Serve(); err == nil {
+			t.Error("Serve returned nil")
+		}
+	}()
+	return errc
+}
+
+func writeAsync(w net.Conn, s string) {
+	go func() {
+		// The connection may be closed by cmux before everything is read.
+		_, _ = io.WriteString(w, s)
+	}()
+}
+
+func TestErrSniffTimeout(t *testing.T) {
+	defer leakCheck(t)()
+
+	l := newChanListener()
+	defer close(l.connCh)
+	muxl := New(l)
+	muxl.SetReadTimeout(50 * time.Millisecond)
+	muxl.MatchNamed("http2", HTTP2())
+	muxl.MatchNamed("hello", PrefixMatcher("hello"))
+	errc := serveErrors(t, muxl)
+
+	w, r := net.Pipe()
+	defer func() { _ = w.Close() }()
+	// HTTP2 fails on the first byte, PrefixMatcher waits for more.
+	writeAsync(w, "hel")
+	l.connCh <- r
+
+	err := <-errc
+	e, ok := err.(ErrSniffTimeout)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.Listener() != "hello" || e.ListenerIndex() != 1 || e.MatcherIndex() != 0 {
+		t.Errorf("unexpected matcher in error: %v", err)
+	}
+	if e.ConnID() == 0 || e.RemoteAddr() == nil {
+		t.Errorf("unexpected connection in error: %v", err)
+	}
+}
+
+func TestErrMatcherPanic(t *testing.T) {
+	defer leakCheck(t)()
+
+	l := newChanListener()
+	defer close(l.connCh)
+	muxl := New(l)
+	muxl.Match(PrefixMatcher("foo"), func(io.Reader) bool { panic("boom") })
+	errc := serveErrors(t, muxl)
+
+	w, r := net.Pipe()
+	defer func() { _ = w.Close() }()
+	writeAsync(w, "hello")
+	l.connCh <- r
+
+	err := <-errc
+	e, ok := err.(ErrMatcherPanic)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.Value() != "boom" || e.ListenerIndex() != 0 || e.MatcherIndex() != 1 {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestErrBacklogFull(t *testing.T) {
+	defer leakCheck(t)()
+
+	l := newChanListener()
+	defer close(l.connCh)
+	m := New(l).(*cMux)
+	// Nothing is enqueued while Accept is not called.
+	m.bufLen = 0
+	hellol := m.MatchNamed("hello", PrefixMatcher("hello"))
+	errc := serveErrors(t, m)
+
+	w, r := net.Pipe()
+	defer func() { _ = w.Close() }()
+	writeAsync(w, "hello!")
+	l.connCh <- r
+
+	err := <-errc
+	e, ok := err.(ErrBacklogFull)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.Listener() != "hello" || e.MatcherIndex() != -1 {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// The connection is still delivered.
+	c, err := hellol.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+}
+
+func TestErrBacklogFullKeepsServing(t *testing.T) {
+	defer leakCheck(t)()
+
+	// The listener is closed by Close.
+	l, _ := testListener(t)
+	m := New(l).(*cMux)
+	m.bufLen = 0
+	hellol := m.Match(PrefixMatcher("hello"))
+	errc := make(chan error, 2)
+	// A handler that tolerates nothing: backlog pressure must not stop the
+	// mux anyway.
+	m.HandleError(func(err error) bool {
+		errc <- err
+		return false
+	})
+	go func() { _ = m.Serve() }()
+	defer func() { _ = m.Close() }()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = c.Close() }()
+		if _, err := io.WriteString(c, "hello!"); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err == nil {
+			t.Fatal("no error")
+		} else if _, ok := err.(ErrBacklogFull); !ok {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		muc, err := hellol.Accept()
+		if err != nil {
+			t.Fatalf("connection %d not delivered: %v", i, err)
+		}
+		_ = muc.Close()
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"net"
+)
+
+func (m *cMux) MatchFanOut(n int, matchers ...Matcher) []net.Listener {
+	if n < 1 {
+		n = 1
+	}
+	m.Match(matchers...)
+	sl := &m.sls[len(m.sls)-1]
+	sl.fanout = make([]muxListener, n)
+	ls := make([]net.Listener, n)
+	for i := range sl.fanout {
+		l := sl.l
+		if i > 0 {
+			// The listeners share the name and the statistics, but have
+			// their own backlog.
+			l.connc = make(chan net.Conn, m.bufLen)
+			l.donec = make(chan struct{})
+		}
+		sl.fanout[i] = l
+		ls[i] = l
+	}
+	return ls
+}
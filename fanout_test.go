@@ -0,0 +1,64 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMatchFanOut(t *testing.T) {
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+	l, cleanup := testListener(t)
+	defer cleanup()
+
+	muxl := New(l)
+	ls := muxl.MatchFanOut(3, Any())
+	if len(ls) != 3 {
+		t.Fatalf("unexpected number of listeners: %d", len(ls))
+	}
+	go safeServe(errCh, muxl)
+
+	for i := 0; i < 6; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = c.Close() }()
+		ac, err := ls[i%len(ls)].Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = ac.Close()
+	}
+	if stats := muxl.Stats(); len(stats) != 1 || stats[0].Matched != 6 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	cleanup()
+	for _, fl := range ls {
+		if _, err := fl.Accept(); err != ErrListenerClosed {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
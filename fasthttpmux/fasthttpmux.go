@@ -0,0 +1,54 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package fasthttpmux adapts cmux listeners for fasthttp servers.
+//
+// Connections accepted from a cmux listener replay the sniffed prefix from
+// the mux's buffer on their first reads and then read straight from the
+// underlying connection, so fasthttp's own read buffer is the only one that
+// holds request bytes once the prefix has been consumed.
+package fasthttpmux
+
+import (
+	"io"
+	"net"
+
+	"github.com/soheilhy/cmux"
+	"github.com/valyala/fasthttp"
+)
+
+type listener struct {
+	net.Listener
+}
+
+// Listener wraps a listener returned by cmux so that closing the mux is
+// reported to fasthttp as io.EOF, which fasthttp.Server.Serve treats as a
+// clean shutdown instead of a permanent accept error.
+func Listener(l net.Listener) net.Listener {
+	return listener{Listener: l}
+}
+
+func (l listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == cmux.ErrListenerClosed || err == cmux.ErrServerClosed {
+		return nil, io.EOF
+	}
+	return c, err
+}
+
+// Serve serves s on the cmux listener l. It returns nil once the mux is
+// closed.
+func Serve(s *fasthttp.Server, l net.Listener) error {
+	return s.Serve(Listener(l))
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package fasthttpmux
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/soheilhy/cmux"
+	"github.com/valyala/fasthttp"
+)
+
+const testResp = "fasthttp"
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := cmux.New(l)
+	httpl := m.Match(cmux.HTTP1Fast())
+
+	s := &fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.SetBodyString(testResp)
+		},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- Serve(s, httpl) }()
+	go func() { _ = m.Serve() }()
+
+	c := &http.Client{Timeout: 5 * time.Second}
+	r, err := c.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	_ = r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != testResp {
+		t.Errorf("invalid response: want=%s got=%s", testResp, b)
+	}
+
+	m.Close()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("unexpected error from Serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Serve did not return after the mux was closed")
+	}
+	_ = l.Close()
+}
@@ -0,0 +1,10 @@
+module github.com/soheilhy/cmux/fasthttpmux
+
+go 1.11
+
+require (
+	github.com/soheilhy/cmux v0.0.0-00010101000000-000000000000
+	github.com/valyala/fasthttp v1.17.0
+)
+
+replace github.com/soheilhy/cmux => ../
@@ -0,0 +1,155 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrInjectedReset is returned from the Read and Write methods of the
+// connections of a FaultListener when they reset the connection.
+var ErrInjectedReset = errors.New("mux: injected connection reset")
+
+// Faults are the faults a FaultListener injects into its connections. The
+// zero value injects none.
+type Faults struct {
+	// Latency is added to each Read and Write.
+	Latency time.Duration
+	// Bandwidth caps the bytes per second read from and written to each
+	// connection. Zero means no cap.
+	Bandwidth int
+	// ResetProbability is the probability, from 0 to 1, that a Read or a
+	// Write resets the connection instead: the connection is closed with a
+	// TCP reset, if possible, and ErrInjectedReset is returned.
+	ResetProbability float64
+	// CorruptProbability is the probability, from 0 to 1, that a byte read
+	// or written is corrupted.
+	CorruptProbability float64
+	// Seed seeds the random faults, so that a run can be reproduced. Zero
+	// seeds them with the current time.
+	Seed int64
+}
+
+type faultListener struct {
+	net.Listener
+	faults Faults
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// FaultListener wraps l so that the connections it accepts suffer faults,
+// e.g. to test how the clients of a protocol served by a CMux handle slow,
+// lossy or failing connections. Each listener returned by a CMux can be
+// wrapped with its own faults:
+//
+//	grpcl := cmux.FaultListener(m.Match(cmux.HTTP2()), cmux.Faults{
+//		Latency:          50 * time.Millisecond,
+//		ResetProbability: 0.001,
+//	})
+func FaultListener(l net.Listener, f Faults) net.Listener {
+	seed := f.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &faultListener{Listener: l, faults: f, rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (l *faultListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &faultConn{Conn: c, l: l}, nil
+}
+
+// float64 returns a random number in [0, 1).
+func (l *faultListener) float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rnd.Float64()
+}
+
+type faultConn struct {
+	net.Conn
+	l *faultListener
+}
+
+// before injects the faults due before an operation, and returns
+// ErrInjectedReset if the connection is reset.
+func (c *faultConn) before() error {
+	f := &c.l.faults
+	if f.ResetProbability > 0 && c.l.float64() < f.ResetProbability {
+		if ls, ok := c.Conn.(lingerSetter); ok {
+			_ = ls.SetLinger(0)
+		}
+		_ = c.Conn.Close()
+		return ErrInjectedReset
+	}
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	return nil
+}
+
+// throttle waits for the time n bytes take at the bandwidth cap.
+func (c *faultConn) throttle(n int) {
+	if bw := c.l.faults.Bandwidth; bw > 0 && n > 0 {
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(bw))
+	}
+}
+
+func (c *faultConn) corrupt(b []byte) {
+	p := c.l.faults.CorruptProbability
+	if p <= 0 {
+		return
+	}
+	for i := range b {
+		if c.l.float64() < p {
+			b[i] ^= 0xff
+		}
+	}
+}
+
+func (c *faultConn) Read(p []byte) (int, error) {
+	if err := c.before(); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(p)
+	c.throttle(n)
+	c.corrupt(p[:n])
+	return n, err
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	if err := c.before(); err != nil {
+		return 0, err
+	}
+	c.throttle(len(p))
+	if c.l.faults.CorruptProbability > 0 {
+		p = append([]byte(nil), p...)
+		c.corrupt(p)
+	}
+	return c.Conn.Write(p)
+}
+
+// NetConn returns the wrapped connection.
+func (c *faultConn) NetConn() net.Conn {
+	return c.Conn
+}
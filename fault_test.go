@@ -0,0 +1,93 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// acceptFault returns a connection accepted from a FaultListener with f, and
+// the client end of it.
+func acceptFault(t *testing.T, f Faults) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac, err := FaultListener(l, f).Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac, c
+}
+
+func TestFaultListener(t *testing.T) {
+	defer leakCheck(t)()
+
+	t.Run("latency", func(t *testing.T) {
+		ac, c := acceptFault(t, Faults{Latency: 50 * time.Millisecond, Bandwidth: 1000})
+		defer func() { _ = c.Close() }()
+		defer func() { _ = ac.Close() }()
+		writeAsync(c, "0123456789")
+		start := time.Now()
+		b := make([]byte, 10)
+		if _, err := io.ReadFull(ac, b); err != nil {
+			t.Fatal(err)
+		}
+		// 50ms of latency and 10ms for 10 bytes at 1000 B/s.
+		if d := time.Since(start); d < 60*time.Millisecond {
+			t.Errorf("read too fast: %v", d)
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		ac, c := acceptFault(t, Faults{ResetProbability: 1})
+		defer func() { _ = c.Close() }()
+		if _, err := ac.Write([]byte("x")); err != ErrInjectedReset {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			t.Error("reset connection is still open")
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		ac, c := acceptFault(t, Faults{CorruptProbability: 1, Seed: 1})
+		defer func() { _ = c.Close() }()
+		defer func() { _ = ac.Close() }()
+		p := []byte("abc")
+		if _, err := ac.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != "abc" {
+			t.Errorf("the written buffer was modified: %q", p)
+		}
+		b := make([]byte, 3)
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(b, p) {
+			t.Errorf("the written bytes were not corrupted")
+		}
+	})
+}
@@ -0,0 +1,199 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TLSFingerprint matches the TLS connections by the fingerprint of their
+// ClientHello, either JA3 (the hex MD5 hash, e.g.
+// "cd08e31494f9531f560d64c695473da9") or JA4 (e.g.
+// "t13d1516h2_8daaf6152771_e5627efa2ab1"). Both kinds can be mixed in the
+// lists.
+//
+// A connection is matched if one of its fingerprints is in allow, or if allow
+// is empty, and none is in deny. For instance, known SDK clients can be
+// routed to their own listener, and abusive clients left unmatched:
+//
+//	sdkl := m.Match(TLSFingerprint(sdk, nil))
+//	tlsl := m.Match(TLSFingerprint(nil, abusive))
+//
+// As with TLSSNI, the handshake is not terminated.
+func TLSFingerprint(allow, deny []string) Matcher {
+	set := func(fps []string) map[string]struct{} {
+		m := make(map[string]struct{}, len(fps))
+		for _, fp := range fps {
+			m[strings.ToLower(fp)] = struct{}{}
+		}
+		return m
+	}
+	allowed, denied := set(allow), set(deny)
+	return func(r io.Reader) bool {
+		hello, err := ParseClientHello(r)
+		if err != nil {
+			return false
+		}
+		fps := [...]string{hello.JA3(), hello.JA4()}
+		ok := len(allowed) == 0
+		for _, fp := range fps {
+			if _, found := denied[fp]; found {
+				return false
+			}
+			if _, found := allowed[fp]; found {
+				ok = true
+			}
+		}
+		return ok
+	}
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello, i.e. the hex MD5 hash
+// of its version, cipher suites, extensions, supported groups and point
+// formats. GREASE values are ignored.
+func (h *ClientHello) JA3() string {
+	sum := md5.Sum([]byte(h.ja3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+func (h *ClientHello) ja3String() string {
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(h.Version)))
+	for _, list := range [][]uint16{
+		h.CipherSuites,
+		h.Extensions,
+		h.SupportedCurves,
+	} {
+		b.WriteByte(',')
+		sep := ""
+		for _, v := range list {
+			if isGREASE(v) {
+				continue
+			}
+			b.WriteString(sep)
+			b.WriteString(strconv.Itoa(int(v)))
+			sep = "-"
+		}
+	}
+	b.WriteByte(',')
+	for i, p := range h.SupportedPoints {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(p)))
+	}
+	return b.String()
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello, assuming it was
+// received over TCP. GREASE values are ignored.
+func (h *ClientHello) JA4() string {
+	ciphers := ja4Hex(h.CipherSuites)
+	exts := ja4Hex(h.Extensions)
+
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(h.MaxVersion()), sni,
+		min99(len(ciphers)), min99(len(exts)), ja4ALPN(h.ALPNProtocols))
+
+	// The server name and ALPN extensions are left out of the hash, as they
+	// are already in the first part.
+	hashed := exts[:0:0]
+	for _, e := range exts {
+		if e != "0000" && e != "0010" {
+			hashed = append(hashed, e)
+		}
+	}
+	sort.Strings(ciphers)
+	sort.Strings(hashed)
+	c := strings.Join(hashed, ",")
+	if schemes := ja4Hex(h.SignatureSchemes); len(schemes) > 0 {
+		c += "_" + strings.Join(schemes, ",")
+	}
+	return a + "_" + ja4Hash(strings.Join(ciphers, ","), len(ciphers)) + "_" +
+		ja4Hash(c, len(hashed))
+}
+
+// ja4Hex returns the non-GREASE values of vs as 4-digit hex strings.
+func ja4Hex(vs []uint16) []string {
+	hs := make([]string, 0, len(vs))
+	for _, v := range vs {
+		if !isGREASE(v) {
+			hs = append(hs, fmt.Sprintf("%04x", v))
+		}
+	}
+	return hs
+}
+
+func ja4Hash(s string, n int) string {
+	if n == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	}
+	return "00"
+}
+
+// ja4ALPN returns the first and last characters of the first ALPN protocol,
+// or of its hex representation if they are not alphanumeric.
+func ja4ALPN(protos []string) string {
+	if len(protos) == 0 || protos[0] == "" {
+		return "00"
+	}
+	p := protos[0]
+	first, last := p[0], p[len(p)-1]
+	if !isAlnum(first) || !isAlnum(last) {
+		h := hex.EncodeToString([]byte(p))
+		return h[:1] + h[len(h)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestJA3(t *testing.T) {
+	// The example of the JA3 README.
+	hello := &ClientHello{
+		Version:         769,
+		CipherSuites:    []uint16{0x0a0a, 47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		Extensions:      []uint16{0, 10, 11, 0x1a1a},
+		SupportedCurves: []uint16{23, 24, 25},
+		SupportedPoints: []uint8{0},
+	}
+	const want = "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0"
+	if s := hello.ja3String(); s != want {
+		t.Errorf("unexpected JA3 string: want=%q got=%q", want, s)
+	}
+	if fp := hello.JA3(); fp != "ada70206e40642a3e4461f35503241d5" {
+		t.Errorf("unexpected JA3: %s", fp)
+	}
+}
+
+func TestJA4(t *testing.T) {
+	// The example of the JA4 specification.
+	hello := &ClientHello{
+		Version: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			0x2a2a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+			0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+		},
+		Extensions: []uint16{
+			0x3a3a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010,
+			0x0005, 0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x0015,
+			0x4469,
+		},
+		ServerName:        "example.com",
+		ALPNProtocols:     []string{"h2", "http/1.1"},
+		SupportedVersions: []uint16{0x4a4a, tls.VersionTLS13, tls.VersionTLS12},
+		SignatureSchemes: []uint16{
+			0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601,
+		},
+	}
+	if fp := hello.JA4(); fp != "t13d1516h2_8daaf6152771_e5627efa2ab1" {
+		t.Errorf("unexpected JA4: %s", fp)
+	}
+
+	hello = &ClientHello{Version: tls.VersionTLS11, ALPNProtocols: []string{"\xabc"}}
+	if fp := hello.JA4(); fp != "t11i0000a3_000000000000_000000000000" {
+		t.Errorf("unexpected JA4: %s", fp)
+	}
+}
+
+func TestTLSFingerprint(t *testing.T) {
+	b := testClientHello(t, &tls.Config{ServerName: "example.com"})
+	hello, err := ParseClientHello(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ja3, ja4 := hello.JA3(), hello.JA4()
+	if !strings.HasPrefix(ja4, "t13d") {
+		t.Errorf("unexpected JA4: %s", ja4)
+	}
+
+	for _, test := range []struct {
+		allow, deny []string
+		match       bool
+	}{
+		{nil, nil, true},
+		{[]string{ja3}, nil, true},
+		{[]string{"foo", strings.ToUpper(ja4)}, nil, true},
+		{[]string{"foo"}, nil, false},
+		{nil, []string{ja4}, false},
+		{[]string{ja3}, []string{ja4}, false},
+		{nil, []string{"foo"}, true},
+	} {
+		m := TLSFingerprint(test.allow, test.deny)
+		if got := m(bytes.NewReader(b)); got != test.match {
+			t.Errorf("allow=%q deny=%q: want=%v got=%v", test.allow, test.deny, test.match, got)
+		}
+	}
+	if TLSFingerprint(nil, nil)(strings.NewReader("GET / HTTP/1.1\r\n\r\n")) {
+		t.Error("HTTP matched")
+	}
+}
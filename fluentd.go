@@ -0,0 +1,100 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// maxFluentdTagLen is the maximum length of a Fluentd tag.
+const maxFluentdTagLen = 1024
+
+// Fluentd matches the connections speaking the Fluentd forward protocol, by
+// the first event they send: a MessagePack array of 2 to 4 elements whose
+// first element is a printable tag, followed by a time (Message mode), an
+// array of entries (Forward mode) or a binary string of entries
+// (PackedForward and CompressedPackedForward modes). The clients of servers
+// requiring authentication wait for a HELO message of the server, so they
+// are not matched.
+func Fluentd() Matcher {
+	return func(r io.Reader) bool {
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil ||
+			b[0] < 0x92 || b[0] > 0x94 {
+			return false
+		}
+		tag, ok := readMsgpackStr(r)
+		if !ok || len(tag) == 0 {
+			return false
+		}
+		for _, c := range tag {
+			if c < 0x21 || c > 0x7e {
+				return false
+			}
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return false
+		}
+		c := b[0]
+		switch {
+		case c <= 0x7f, c == 0xce, c == 0xcf, c == 0xd2, c == 0xd3:
+			// A time in seconds.
+		case c == 0xd7, c == 0xc7:
+			// An EventTime extension.
+		case c >= 0x90 && c <= 0x9f, c == 0xdc, c == 0xdd:
+			// An array of entries.
+		case c >= 0xc4 && c <= 0xc6, c >= 0xd9 && c <= 0xdb, c >= 0xa0 && c <= 0xbf:
+			// A binary or string of packed entries.
+		default:
+			return false
+		}
+		return true
+	}
+}
+
+// readMsgpackStr reads a MessagePack string of at most maxFluentdTagLen
+// bytes from r.
+func readMsgpackStr(r io.Reader) ([]byte, bool) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:1]); err != nil {
+		return nil, false
+	}
+	var n int
+	switch c := hdr[0]; {
+	case c >= 0xa0 && c <= 0xbf:
+		n = int(c & 0x1f)
+	case c == 0xd9:
+		if _, err := io.ReadFull(r, hdr[1:2]); err != nil {
+			return nil, false
+		}
+		n = int(hdr[1])
+	case c == 0xda:
+		if _, err := io.ReadFull(r, hdr[1:3]); err != nil {
+			return nil, false
+		}
+		n = int(binary.BigEndian.Uint16(hdr[1:3]))
+	default:
+		return nil, false
+	}
+	if n > maxFluentdTagLen {
+		return nil, false
+	}
+	s := make([]byte, n)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return nil, false
+	}
+	return s, true
+}
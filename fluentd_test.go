@@ -0,0 +1,45 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFluentd(t *testing.T) {
+	for _, test := range []struct {
+		name, event string
+		match       bool
+	}{
+		// ["app.access", 1700000000, {"k": "v"}]
+		{"message", "\x93\xaaapp.access\xce\x65\x53\xf1\x00\x81\xa1k\xa1v", true},
+		// ["app.access", EventTime, {}, {}]
+		{"message with option", "\x94\xaaapp.access\xd7\x00\x65\x53\xf1\x00\x00\x00\x00\x00\x80\x80", true},
+		// ["app.access", [[1700000000, {}]]]
+		{"forward", "\x92\xaaapp.access\x91\x92\xce\x65\x53\xf1\x00\x80", true},
+		// ["app.access", <bin>]
+		{"packed forward", "\x92\xd9\x0aapp.access\xc4\x01\x00", true},
+		{"tag with space", "\x93\xabapp access\xce\x65\x53\xf1\x00\x80", false},
+		{"empty tag", "\x93\xa0\xce\x65\x53\xf1\x00\x80", false},
+		{"map", "\x93\xaaapp.access\x80", false},
+		{"too many elements", "\x95\xaaapp.access\xce\x65\x53\xf1\x00\x80", false},
+		{"http", "GET / HTTP/1.1\r\n\r\n", false},
+	} {
+		if got := Fluentd()(strings.NewReader(test.event)); got != test.match {
+			t.Errorf("%s: want=%v got=%v", test.name, test.match, got)
+		}
+	}
+}
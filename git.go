@@ -0,0 +1,62 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+// gitServices are the services a git daemon client may request, followed by
+// the space separating them from the repository path.
+var gitServices = []string{
+	"git-upload-pack ",
+	"git-receive-pack ",
+	"git-upload-archive ",
+}
+
+// maxGitServiceLen is the length of the longest of gitServices.
+const maxGitServiceLen = len("git-upload-archive ")
+
+// GitProtocol matches the connections of git clients to a git daemon, by the
+// pkt-line request they send first, e.g.,
+// "0032git-upload-pack /project.git\x00host=example.com\x00".
+func GitProtocol() Matcher {
+	return func(r io.Reader) bool {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return false
+		}
+		n, err := strconv.ParseUint(string(hdr[:]), 16, 16)
+		if err != nil || n < 4 {
+			return false
+		}
+		size := int(n) - 4
+		if size > maxGitServiceLen {
+			size = maxGitServiceLen
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return false
+		}
+		for _, s := range gitServices {
+			if strings.HasPrefix(string(b), s) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGitProtocol(t *testing.T) {
+	for _, test := range []struct {
+		req   string
+		match bool
+	}{
+		{"0032git-upload-pack /project.git\x00host=example.com\x00", true},
+		{"0029git-receive-pack /project.git\x00", true},
+		{"0027git-upload-archive /project.git\x00", true},
+		{"0014git-upload-pack \x00", true},
+		// The length is too short for the service.
+		{"0010git-upload-pack /", false},
+		{"0032git-fetch-pack /project.git\x00", false},
+		{"003zgit-upload-pack /project.git\x00", false},
+		{"0000", false},
+		{"GET / HTTP/1.1\r\n\r\n", false},
+	} {
+		if got := GitProtocol()(strings.NewReader(test.req)); got != test.match {
+			t.Errorf("%q: want=%v got=%v", test.req, test.match, got)
+		}
+	}
+}
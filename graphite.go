@@ -0,0 +1,62 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxGraphiteLineLen is the maximum length of the first line of a Graphite
+// connection.
+const maxGraphiteLineLen = 1024
+
+// Graphite matches the connections speaking the Graphite plaintext protocol,
+// by its first line: "metric.path value timestamp\n". It is a heuristic: the
+// path must be made of the characters of Graphite metric names and tags,
+// the value a number and the timestamp an integer.
+func Graphite() Matcher {
+	return func(r io.Reader) bool {
+		br := bufio.NewReaderSize(&io.LimitedReader{R: r, N: maxGraphiteLineLen}, maxGraphiteLineLen)
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return false
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !isGraphitePath(fields[0]) {
+			return false
+		}
+		if _, err := strconv.ParseFloat(fields[1], 64); err != nil {
+			return false
+		}
+		_, err = strconv.ParseInt(fields[2], 10, 64)
+		return err == nil
+	}
+}
+
+func isGraphitePath(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("._-:;=~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
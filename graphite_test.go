@@ -0,0 +1,41 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGraphite(t *testing.T) {
+	for _, test := range []struct {
+		line  string
+		match bool
+	}{
+		{"servers.web01.cpu.load 0.42 1700000000\n", true},
+		{"servers.web01.requests 12 1700000000\r\n", true},
+		{"disk.used;host=web01;mount=/ 1e9 1700000000\n", false},
+		{"disk.used;host=web01 1e9 -1\n", true},
+		{"servers.web01.cpu.load 0.42\n", false},
+		{"servers.web01.cpu.load 0.42 1700000000", false},
+		{"servers.web01.cpu.load high 1700000000\n", false},
+		{"servers.web01.cpu.load 0.42 1700000000.5\n", false},
+		{"GET / HTTP/1.1\r\n", false},
+	} {
+		if got := Graphite()(strings.NewReader(test.line)); got != test.match {
+			t.Errorf("%q: want=%v got=%v", test.line, test.match, got)
+		}
+	}
+}
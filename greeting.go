@@ -0,0 +1,168 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrGreetingMismatch is returned from MuxConn.Write when the server of a
+// connection greeted by ServerFirst does not start with the same greeting.
+var ErrGreetingMismatch = errors.New("mux: server greeting differs from ServerFirst greeting")
+
+// sniffWriter is the io.Writer passed to MatchWriters. It writes to the
+// connection being sniffed, bypassing its stats.
+type sniffWriter struct {
+	muc *MuxConn
+}
+
+func (w sniffWriter) Write(p []byte) (int, error) {
+	return w.muc.Conn.Write(p)
+}
+
+// ServerFirst returns a MatchWriter for a protocol in which the server speaks
+// first, e.g., SMTP, FTP or POP3. If the client sends nothing for delay,
+// greeting is written to it and matcher is evaluated on what the client
+// sends back:
+//
+//	greeting := []byte("220 mx.example.com ESMTP\r\n")
+//	smtpl := m.MatchWithWriters(ServerFirst(time.Second, greeting,
+//		PrefixMatcher("EHLO", "HELO")))
+//
+// A connection is greeted once: the ServerFirst matchers with the same
+// greeting, e.g., of SMTP and FTP which both greet with "220", all match
+// the same reply, and the ones with another greeting do not match.
+//
+// The server of the listener that accepts a greeted connection greets the
+// client too, so the greeting is dropped from the first bytes it writes:
+// greeting must be what the server sends first, or its writes fail with
+// ErrGreetingMismatch. Greetings that
+// differ for each connection, e.g., the challenge of MySQL, are not
+// supported by ServerFirst; see MySQL.
+//
+// The clients speaking first are not delayed, but ServerFirst must be
+// matched before the matchers that wait for the client, e.g., HTTP1 or the
+// leading prefix matchers, which would otherwise hold the silent clients
+// until the read timeout. delay must be shorter than the read timeout.
+func ServerFirst(delay time.Duration, greeting []byte, matcher Matcher) MatchWriter {
+	greeting = append([]byte(nil), greeting...)
+	g := &greeter{
+		delay:    delay,
+		key:      string(greeting),
+		greeting: func(*MuxConn) []byte { return greeting },
+		swallow:  true,
+	}
+	return g.matchWriter(matcher)
+}
+
+// Greeting returns what a server-first matcher, e.g., ServerFirst, wrote to
+// the connection before it was matched, or nil if it was not greeted.
+func (m *MuxConn) Greeting() []byte {
+	return m.greeting
+}
+
+// greeter greets the clients of a server-first protocol that send nothing.
+type greeter struct {
+	delay time.Duration
+	// key identifies the greeting: the connections greeted by a greeter
+	// are only matched by the greeters with the same key.
+	key string
+	// greeting returns the greeting of a connection.
+	greeting func(muc *MuxConn) []byte
+	// swallow is whether the greeting of the server is dropped.
+	swallow bool
+}
+
+// matchWriter returns a MatchWriter greeting the silent connections and
+// evaluating matcher on their reply.
+func (g *greeter) matchWriter(matcher Matcher) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		sw, ok := w.(sniffWriter)
+		if !ok {
+			return false
+		}
+		muc := sw.muc
+		if muc.greeting == nil {
+			if !muc.waitSilence(g.delay) {
+				return false
+			}
+			greeting := g.greeting(muc)
+			if _, err := muc.Conn.Write(greeting); err != nil {
+				return false
+			}
+			muc.greeting, muc.greetKey = greeting, g.key
+			if g.swallow {
+				atomic.StoreInt32(&muc.swallow, int32(len(greeting)))
+			}
+		} else if muc.greetKey != g.key {
+			return false
+		}
+		return matcher(r)
+	}
+}
+
+// waitSilence returns whether the client of m sent nothing for d. The
+// timeout is then forgotten, so that sniffing can go on.
+func (m *MuxConn) waitSilence(d time.Duration) bool {
+	b := &m.buf
+	if b.bufferSize > 0 || b.sniffErr != nil {
+		return false
+	}
+	deadline := time.Now().Add(d)
+	if !m.deadline.IsZero() && m.deadline.Before(deadline) {
+		// The sniffing would time out first.
+		return false
+	}
+	_ = m.Conn.SetReadDeadline(deadline)
+	n := len(b.peek(1))
+	_ = m.Conn.SetReadDeadline(m.deadline)
+	if n > 0 {
+		return false
+	}
+	if ne, ok := b.sniffErr.(net.Error); !ok || !ne.Timeout() {
+		return false
+	}
+	b.sniffErr = nil
+	return true
+}
+
+// swallowGreeting returns how many of the bytes of p being written to m are
+// dropped, because the server is greeting a client ServerFirst already
+// greeted. It fails with ErrGreetingMismatch if they differ from the
+// greeting, which is then never dropped.
+func (m *MuxConn) swallowGreeting(p []byte) (int, error) {
+	for {
+		left := atomic.LoadInt32(&m.swallow)
+		if left <= 0 {
+			return 0, nil
+		}
+		k := left
+		if len(p) < int(left) {
+			k = int32(len(p))
+		}
+		sent := m.greeting[len(m.greeting)-int(left):]
+		if !bytes.Equal(p[:k], sent[:k]) {
+			return 0, ErrGreetingMismatch
+		}
+		if atomic.CompareAndSwapInt32(&m.swallow, left, left-k) {
+			return int(k), nil
+		}
+	}
+}
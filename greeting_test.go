@@ -0,0 +1,136 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerFirst(t *testing.T) {
+	defer leakCheck(t)()
+	l, cleanup := testListener(t)
+	defer cleanup()
+
+	const greeting = "220 mx.example.com ready\r\n"
+	muxl := New(l)
+	muxl.SetReadTimeout(5 * time.Second)
+	smtpl := muxl.MatchWithWriters(ServerFirst(50*time.Millisecond,
+		[]byte(greeting), PrefixMatcher("EHLO", "HELO")))
+	ftpl := muxl.MatchWithWriters(ServerFirst(50*time.Millisecond,
+		[]byte(greeting), PrefixMatcher("USER")))
+	// Greeted connections do not match other greetings.
+	muxl.MatchWithWriters(ServerFirst(50*time.Millisecond, []byte("+OK\r\n"),
+		Any()))
+	httpl := muxl.Match(HTTP1Fast())
+	go safeServe(nil, muxl)
+
+	for _, test := range []struct {
+		cmd string
+		l   net.Listener
+	}{
+		{"EHLO client\r\n", smtpl},
+		{"USER anonymous\r\n", ftpl},
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = c.Close() }()
+		br := bufio.NewReader(c)
+		if line, err := br.ReadString('\n'); err != nil || line != greeting {
+			t.Fatalf("unexpected greeting: %q, %v", line, err)
+		}
+		writeAsync(c, test.cmd)
+
+		ac, err := test.l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(test.cmd))
+		if _, err := io.ReadFull(ac, b); err != nil || string(b) != test.cmd {
+			t.Errorf("unexpected command: %q, %v", b, err)
+		}
+		// The greeting of the server is dropped, in whatever pieces it
+		// is written.
+		for _, s := range []string{greeting[:3], greeting[3:] + "250 hi\r\n"} {
+			if _, err := io.WriteString(ac, s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if line, err := br.ReadString('\n'); err != nil || line != "250 hi\r\n" {
+			t.Errorf("unexpected reply: %q, %v", line, err)
+		}
+		if n := ac.(*MuxConn).BytesWritten(); n != 8 {
+			t.Errorf("unexpected bytes written: %d", n)
+		}
+		_ = ac.Close()
+	}
+
+	// A server not starting with the greeting fails to write, after the
+	// part that matches.
+	gc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = gc.Close() }()
+	if line, err := bufio.NewReader(gc).ReadString('\n'); err != nil || line != greeting {
+		t.Fatalf("unexpected greeting: %q, %v", line, err)
+	}
+	writeAsync(gc, "EHLO client\r\n")
+	ac, err := smtpl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(ac, greeting[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := io.WriteString(ac, " other greeting\r\n"); n != 0 || err != ErrGreetingMismatch {
+		t.Errorf("unexpected write of a mismatching greeting: %d, %v", n, err)
+	}
+	_ = ac.Close()
+
+	// Clients speaking first are not greeted.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	writeAsync(c, "GET / HTTP/1.1\r\n\r\n")
+	ac, err = httpl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(ac, "HTTP/1.1 200 OK\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(c).ReadString('\n'); err != nil || line != "HTTP/1.1 200 OK\r\n" {
+		t.Errorf("unexpected response: %q, %v", line, err)
+	}
+	_ = ac.Close()
+
+	cleanup()
+}
+
+func TestServerFirstOutsideMux(t *testing.T) {
+	m := ServerFirst(time.Millisecond, []byte("220\r\n"), Any())
+	if m(ioutil.Discard, nil) {
+		t.Error("matched outside of a mux")
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// GRPCService returns a MatchWriter matching the gRPC calls of services, by
+// the :path pseudo-header field of the first headers frame. A service is
+// either the full name of a service, e.g., "grpc.health.v1.Health", to match
+// all its methods, or of a method, e.g., "grpc.health.v1.Health/Watch", to
+// match only that one. Routing a service to its own grpc.Server, e.g., with
+// other keepalive settings, only works if the clients use a connection per
+// service, as the calls of a connection all go to the same listener.
+//
+// Like HTTP2MatchHeaderFieldSendSettings, it writes the settings to the
+// client, since gRPC clients block on receiving a SETTINGS frame.
+func GRPCService(services ...string) MatchWriter {
+	type path struct {
+		value []byte
+		exact bool
+	}
+	paths := make([]path, len(services))
+	for i, s := range services {
+		s = "/" + strings.TrimPrefix(s, "/")
+		if strings.Contains(s[1:], "/") {
+			paths[i] = path{value: []byte(s), exact: true}
+		} else {
+			paths[i] = path{value: []byte(s + "/")}
+		}
+	}
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP2Field(w, r, ":path", func(gotValue []byte) bool {
+			for _, p := range paths {
+				if p.exact && bytes.Equal(gotValue, p.value) ||
+					!p.exact && bytes.HasPrefix(gotValue, p.value) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGRPCService(t *testing.T) {
+	// The payload calls /grpc.health.v1.Health/Check.
+	for _, test := range []struct {
+		services []string
+		match    bool
+	}{
+		{[]string{"grpc.health.v1.Health"}, true},
+		{[]string{"/grpc.health.v1.Health"}, true},
+		{[]string{"grpc.health.v1.Health/Check"}, true},
+		{[]string{"grpc.health.v1.Health/Watch"}, false},
+		{[]string{"grpc.health.v1.Health/Ch"}, false},
+		{[]string{"grpc.health.v1"}, false},
+		{[]string{"grpc.health.v1.Healt"}, false},
+		{[]string{"grpc.reflection.v1.ServerReflection", "grpc.health.v1.Health"}, true},
+		{nil, false},
+	} {
+		var w bytes.Buffer
+		if got := GRPCService(test.services...)(&w, bytes.NewReader(benchHTTP2HeaderPayload)); got != test.match {
+			t.Errorf("%q: want=%v got=%v", test.services, test.match, got)
+		}
+		if w.Len() == 0 {
+			t.Errorf("%q: settings not sent", test.services)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package grpcmux serves gRPC and HTTP (HTTP/1, h2c upgrade and h2c with
+// prior knowledge) on a single listener using cmux.
+package grpcmux
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/soheilhy/cmux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+)
+
+// Option configures Serve.
+type Option func(*options)
+
+type options struct {
+	httpServer  *http.Server
+	http2Server *http2.Server
+	grpcRoutes  []grpcRoute
+}
+
+// WithHTTPServer sets the http.Server used for HTTP connections. Its Handler
+// is replaced by the handler passed to Serve.
+func WithHTTPServer(s *http.Server) Option {
+	return func(o *options) { o.httpServer = s }
+}
+
+// WithHTTP2Server sets the http2.Server used for cleartext HTTP/2
+// connections.
+func WithHTTP2Server(s *http2.Server) Option {
+	return func(o *options) { o.http2Server = s }
+}
+
+// Serve serves grpcServer and httpHandler on l and blocks until the mux
+// stops.
+//
+// Connections are matched in this order: HTTP/2 with a gRPC content-type go
+// to grpcServer, or to the server of their route (see WithGRPCRoute), any
+// other HTTP/2 connection (h2c with prior knowledge) is served by
+// httpHandler over HTTP/2, and everything else is served by httpHandler over
+// HTTP/1, including h2c upgrades.
+func Serve(l net.Listener, grpcServer *grpc.Server, httpHandler http.Handler,
+	opts ...Option) error {
+
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	hs := o.httpServer
+	if hs == nil {
+		hs = &http.Server{}
+	}
+	h2s := o.http2Server
+	if h2s == nil {
+		h2s = &http2.Server{}
+	}
+	hs.Handler = h2c.NewHandler(httpHandler, h2s)
+
+	m := cmux.New(l)
+	// gRPC clients (grpc-go, grpc-java, the Cloud Run front end, ...) wait
+	// for the server's SETTINGS frame before sending any headers, so the
+	// matcher must send it while sniffing.
+	grpcl := m.MatchWithWriters(cmux.HTTP2MatchHeaderFieldPrefixSendSettings(
+		"content-type", "application/grpc"))
+	h2cl := m.Match(cmux.HTTP2())
+	httpl := m.Match(cmux.Any())
+
+	var (
+		mu     sync.Mutex
+		srvErr error
+	)
+	fail := func(err error) {
+		if isClosed(err) {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if srvErr == nil {
+			srvErr = err
+			_ = l.Close()
+		}
+	}
+
+	if len(o.grpcRoutes) == 0 {
+		go func() { fail(grpcServer.Serve(grpcl)) }()
+	} else {
+		r := newGRPCRouter(grpcl, o.grpcRoutes)
+		for i, rt := range o.grpcRoutes {
+			s, rl := rt.server, r.ls[i]
+			go func() { fail(s.Serve(rl)) }()
+		}
+		defl := r.ls[len(o.grpcRoutes)]
+		go func() { fail(grpcServer.Serve(defl)) }()
+		go func() { fail(r.serve()) }()
+	}
+	go func() { fail(hs.Serve(httpl)) }()
+	go func() { fail(serveH2C(h2cl, hs, h2s)) }()
+
+	err := m.Serve()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if srvErr != nil {
+		return srvErr
+	}
+	return err
+}
+
+func serveH2C(l net.Listener, hs *http.Server, h2s *http2.Server) error {
+	opts := &http2.ServeConnOpts{
+		BaseConfig: hs,
+		Handler:    hs.Handler,
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		// The gRPC matcher has already sent a SETTINGS frame on this
+		// connection. The client's ACK for it would otherwise be seen by
+		// http2.Server as an ACK for a frame it never sent, which is a
+		// connection error.
+		go h2s.ServeConn(newSettingsAckFilter(c), opts)
+	}
+}
+
+func isClosed(err error) bool {
+	return err == nil || err == cmux.ErrListenerClosed ||
+		err == cmux.ErrServerClosed || err == http.ErrServerClosed ||
+		err == grpc.ErrServerStopped
+}
@@ -0,0 +1,266 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package grpcmux
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type protoHandler struct{}
+
+func (h protoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, r.Proto)
+}
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gs := grpc.NewServer()
+	healthpb.RegisterHealthServer(gs, health.NewServer())
+
+	errc := make(chan error, 1)
+	go func() { errc <- Serve(l, gs, protoHandler{}) }()
+	defer func() {
+		_ = l.Close()
+		if err := <-errc; !strings.Contains(err.Error(), "use of closed") {
+			t.Error(err)
+		}
+	}()
+
+	addr := l.Addr().String()
+
+	cc, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = cc.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(cc).Check(ctx,
+		&healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("unexpected health status %v", resp.Status)
+	}
+
+	h1 := &http.Client{Timeout: 5 * time.Second}
+	testGet(t, h1, "http://"+addr, "HTTP/1.1")
+
+	var dials uint32
+	h2c := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				atomic.AddUint32(&dials, 1)
+				return net.Dial(network, addr)
+			},
+		},
+	}
+	// Issue several requests to make sure the connection survives the
+	// SETTINGS exchange and is reused.
+	for i := 0; i < 3; i++ {
+		testGet(t, h2c, "http://"+addr, "HTTP/2.0")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadUint32(&dials); n != 1 {
+		t.Errorf("h2c connection was not reused: %d dials", n)
+	}
+}
+
+func TestServeGRPCRoute(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both servers have the health service, with different statuses, and
+	// the Watch method is routed to the admin server.
+	gs := grpc.NewServer()
+	hs := health.NewServer()
+	hs.SetServingStatus("svc", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(gs, hs)
+	admin := grpc.NewServer()
+	adminHS := health.NewServer()
+	adminHS.SetServingStatus("svc", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(admin, adminHS)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Serve(l, gs, protoHandler{},
+			WithGRPCRoute("/grpc.health.v1.Health/Watch", admin))
+	}()
+	defer func() {
+		_ = l.Close()
+		if err := <-errc; !strings.Contains(err.Error(), "use of closed") {
+			t.Error(err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req := &healthpb.HealthCheckRequest{Service: "svc"}
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = cc.Close() }()
+	resp, err := healthpb.NewHealthClient(cc).Check(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("unexpected status from the default server: %v", resp.Status)
+	}
+
+	adminCC, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = adminCC.Close() }()
+	w, err := healthpb.NewHealthClient(adminCC).Watch(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = w.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("unexpected status from the admin server: %v", resp.Status)
+	}
+}
+
+// peekedConn is a connection whose first request, as sniffed by cmux, is
+// for path.
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func newPeekedConn(t *testing.T, path string) *peekedConn {
+	var hdrs bytes.Buffer
+	enc := hpack.NewEncoder(&hdrs)
+	for _, f := range []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":path", Value: path},
+	} {
+		if err := enc.WriteField(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var b bytes.Buffer
+	b.WriteString(http2.ClientPreface)
+	err := http2.NewFramer(&b, nil).WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: hdrs.Bytes(),
+		EndHeaders:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := net.Pipe()
+	return &peekedConn{Conn: c, peeked: b.Bytes()}
+}
+
+func (c *peekedConn) Peeked() []byte { return c.peeked }
+
+// connListener is a listener accepting the connections sent to it.
+type connListener struct {
+	net.Listener
+	connc chan net.Conn
+}
+
+func (l connListener) Accept() (net.Conn, error) {
+	c, ok := <-l.connc
+	if !ok {
+		return nil, errors.New("use of closed listener")
+	}
+	return c, nil
+}
+
+func TestGRPCRouterSlowRoute(t *testing.T) {
+	l := connListener{connc: make(chan net.Conn)}
+	r := newGRPCRouter(l, []grpcRoute{{prefix: "/slow."}})
+	errc := make(chan error, 1)
+	go func() { errc <- r.serve() }()
+
+	// The slow route never accepts its connections, and more of them than
+	// its backlog are routed to it.
+	for i := 0; i <= routeBacklog; i++ {
+		l.connc <- newPeekedConn(t, "/slow.Slow/Call")
+	}
+	l.connc <- newPeekedConn(t, "/other.Other/Call")
+	accepted := make(chan string, 1)
+	go func() {
+		c, err := r.ls[1].Accept()
+		if err != nil {
+			accepted <- err.Error()
+			return
+		}
+		accepted <- firstPath(c)
+	}()
+	select {
+	case p := <-accepted:
+		if p != "/other.Other/Call" {
+			t.Errorf("unexpected connection: %s", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a slow route held up the others")
+	}
+
+	close(l.connc)
+	if err := <-errc; err == nil {
+		t.Error("no error after the listener was closed")
+	}
+}
+
+func testGet(t *testing.T, c *http.Client, url, want string) {
+	r, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Body.Close() }()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("invalid response: want=%s got=%s", want, b)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package grpcmux
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/soheilhy/cmux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"google.golang.org/grpc"
+)
+
+// routeBacklog is the number of routed connections buffered for each route
+// until they are accepted, like the backlog of the listeners of a CMux.
+const routeBacklog = 1024
+
+type grpcRoute struct {
+	prefix string
+	server *grpc.Server
+}
+
+// WithGRPCRoute makes Serve hand the gRPC connections whose first RPC is for
+// a method path starting with prefix (e.g., "/admin.Admin/") to s instead
+// of the gRPC server passed to Serve. It can be used to isolate services
+// that need other interceptors or credentials on the same port. Routes are
+// tried in the order they are given.
+//
+// Connections are routed as a whole, so all the RPCs of a connection go to
+// the server of its first RPC: clients must use separate connections for the
+// services of different servers, as they usually do with one grpc.ClientConn
+// per service.
+func WithGRPCRoute(prefix string, s *grpc.Server) Option {
+	return func(o *options) {
+		o.grpcRoutes = append(o.grpcRoutes, grpcRoute{prefix: prefix, server: s})
+	}
+}
+
+// grpcRouter dispatches the connections accepted from a listener to the
+// listeners of the routes, according to the path of their first request.
+//
+// The path is read from the bytes sniffed by the gRPC matcher, so that a
+// single matcher, and a single SETTINGS frame, serves all the routes.
+type grpcRouter struct {
+	l      net.Listener
+	routes []grpcRoute
+	ls     []*routeListener
+}
+
+func newGRPCRouter(l net.Listener, routes []grpcRoute) *grpcRouter {
+	r := &grpcRouter{l: l, routes: routes}
+	// The last listener is for the connections matching no route.
+	for i := 0; i <= len(routes); i++ {
+		r.ls = append(r.ls, &routeListener{
+			Listener: l,
+			connc:    make(chan net.Conn, routeBacklog),
+			donec:    make(chan struct{}),
+		})
+	}
+	return r
+}
+
+func (r *grpcRouter) serve() error {
+	defer func() {
+		for _, rl := range r.ls {
+			rl.stop()
+		}
+	}()
+	for {
+		c, err := r.l.Accept()
+		if err != nil {
+			return err
+		}
+		// A route whose server is slow, or whose backlog is full, must
+		// not hold up the other routes.
+		go func() {
+			if !r.ls[r.route(firstPath(c))].deliver(c) {
+				_ = c.Close()
+			}
+		}()
+	}
+}
+
+// route returns the index of the listener of path.
+func (r *grpcRouter) route(path string) int {
+	for i, rt := range r.routes {
+		if strings.HasPrefix(path, rt.prefix) {
+			return i
+		}
+	}
+	return len(r.routes)
+}
+
+// firstPath returns the :path of the first request of the HTTP/2 connection
+// c, as sniffed by cmux, or "" if it cannot be found.
+func firstPath(c net.Conn) string {
+	pc, ok := c.(interface{ Peeked() []byte })
+	if !ok {
+		return ""
+	}
+	b := pc.Peeked()
+	if !bytes.HasPrefix(b, []byte(http2.ClientPreface)) {
+		return ""
+	}
+
+	fr := http2.NewFramer(nil, bytes.NewReader(b[len(http2.ClientPreface):]))
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return ""
+		}
+		if mh, ok := f.(*http2.MetaHeadersFrame); ok {
+			return mh.PseudoValue("path")
+		}
+	}
+}
+
+// routeListener is the listener of a route.
+type routeListener struct {
+	net.Listener
+	connc chan net.Conn
+
+	once  sync.Once
+	donec chan struct{}
+}
+
+func (l *routeListener) deliver(c net.Conn) bool {
+	select {
+	case l.connc <- c:
+		return true
+	case <-l.donec:
+		return false
+	}
+}
+
+func (l *routeListener) stop() {
+	l.once.Do(func() { close(l.donec) })
+}
+
+func (l *routeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connc:
+		return c, nil
+	case <-l.donec:
+		return nil, cmux.ErrListenerClosed
+	}
+}
+
+// Close stops the listener. The other routes are not affected.
+func (l *routeListener) Close() error {
+	l.stop()
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package grpcmux
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+const frameHeaderLen = 9
+
+// settingsAckFilter drops the SETTINGS ACK frames sent by the client that do
+// not acknowledge a SETTINGS frame written through this connection.
+//
+// It keeps track of the non-ACK SETTINGS frames written by the server and of
+// the ACKs delivered to it, and discards any ACK that would exceed the former.
+type settingsAckFilter struct {
+	net.Conn
+
+	mu    sync.Mutex
+	sent  int
+	acked int
+
+	// Read side.
+	rhdr     [frameHeaderLen]byte
+	rpending []byte
+	rrem     int
+
+	// Write side.
+	whdr    [frameHeaderLen]byte
+	whdrLen int
+	wrem    int
+}
+
+func newSettingsAckFilter(c net.Conn) *settingsAckFilter {
+	// The client preface is not framed.
+	return &settingsAckFilter{Conn: c, rrem: len(http2.ClientPreface)}
+}
+
+func (f *settingsAckFilter) Read(p []byte) (int, error) {
+	for f.rrem == 0 && len(f.rpending) == 0 {
+		if _, err := io.ReadFull(f.Conn, f.rhdr[:]); err != nil {
+			return 0, err
+		}
+		length := frameLen(f.rhdr[:])
+		if isSettingsAck(f.rhdr[:]) && length == 0 && !f.ack() {
+			continue
+		}
+		f.rpending = f.rhdr[:]
+		f.rrem = length
+	}
+
+	if len(f.rpending) > 0 {
+		n := copy(p, f.rpending)
+		f.rpending = f.rpending[n:]
+		return n, nil
+	}
+
+	if len(p) > f.rrem {
+		p = p[:f.rrem]
+	}
+	n, err := f.Conn.Read(p)
+	f.rrem -= n
+	return n, err
+}
+
+func (f *settingsAckFilter) Write(p []byte) (int, error) {
+	// Account for SETTINGS frames before they hit the wire, so that the ACK
+	// can never be read before the frame is counted.
+	f.scanWrite(p)
+	return f.Conn.Write(p)
+}
+
+func (f *settingsAckFilter) scanWrite(p []byte) {
+	for len(p) > 0 {
+		if f.wrem > 0 {
+			n := f.wrem
+			if n > len(p) {
+				n = len(p)
+			}
+			f.wrem -= n
+			p = p[n:]
+			continue
+		}
+
+		n := copy(f.whdr[f.whdrLen:], p)
+		f.whdrLen += n
+		p = p[n:]
+		if f.whdrLen < frameHeaderLen {
+			return
+		}
+
+		f.whdrLen = 0
+		f.wrem = frameLen(f.whdr[:])
+		if http2.FrameType(f.whdr[3]) == http2.FrameSettings &&
+			!isSettingsAck(f.whdr[:]) {
+
+			f.mu.Lock()
+			f.sent++
+			f.mu.Unlock()
+		}
+	}
+}
+
+// ack records a SETTINGS ACK and returns whether it acknowledges a frame sent
+// by the server.
+func (f *settingsAckFilter) ack() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.acked >= f.sent {
+		return false
+	}
+	f.acked++
+	return true
+}
+
+func frameLen(hdr []byte) int {
+	return int(hdr[0])<<16 | int(hdr[1])<<8 | int(hdr[2])
+}
+
+func isSettingsAck(hdr []byte) bool {
+	return http2.FrameType(hdr[3]) == http2.FrameSettings &&
+		http2.Flags(hdr[4]).Has(http2.FlagSettingsAck)
+}
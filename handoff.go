@@ -0,0 +1,71 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"net"
+	"sync"
+)
+
+// handoffListener is a net.Listener accepting the connections handed over
+// by the handlers of another server, e.g., the WebSockets of
+// WebSocketListener or the tunnels of TunnelListener.
+type handoffListener struct {
+	addr  net.Addr
+	connc chan net.Conn
+	donec chan struct{}
+	once  sync.Once
+}
+
+func newHandoffListener(addr net.Addr) handoffListener {
+	return handoffListener{
+		addr:  addr,
+		connc: make(chan net.Conn),
+		donec: make(chan struct{}),
+	}
+}
+
+// handoff blocks until c is accepted, and returns ErrListenerClosed if the
+// listener is closed first.
+func (l *handoffListener) handoff(c net.Conn) error {
+	select {
+	case l.connc <- c:
+		return nil
+	case <-l.donec:
+		return ErrListenerClosed
+	}
+}
+
+// Accept waits for and returns the next connection handed over.
+func (l *handoffListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connc:
+		return c, nil
+	case <-l.donec:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close closes the listener. The connections already accepted are not
+// closed.
+func (l *handoffListener) Close() error {
+	l.once.Do(func() { close(l.donec) })
+	return nil
+}
+
+// Addr returns the address the listener was created with.
+func (l *handoffListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// healthProbeTimeout bounds the time spent answering a health probe.
+const healthProbeTimeout = 5 * time.Second
+
+// HealthProbe recognizes the health probes of load balancers and answers
+// them without involving the servers of the multiplexed protocols. Two kinds
+// of probes are recognized: TCP probes, which connect and close without
+// sending anything, and HTTP/1 GET or HEAD requests for one of the paths
+// passed to NewHealthProbe. HTTP probes are answered with 200 OK.
+//
+// The matcher must be registered before the matchers of the other listeners,
+// and the listener it is registered with must be served by the probe:
+//
+//	hp := cmux.NewHealthProbe("/healthz")
+//	go hp.Serve(m.Match(hp.Matcher()))
+//	httpl := m.Match(cmux.HTTP1Fast())
+type HealthProbe struct {
+	// The counters are accessed atomically and must stay 64-bit aligned.
+	tcp  uint64
+	http uint64
+
+	paths []string
+}
+
+// HealthProbeStats are the statistics of a HealthProbe.
+type HealthProbeStats struct {
+	// TCP is the number of TCP probes answered.
+	TCP uint64
+	// HTTP is the number of HTTP probes answered.
+	HTTP uint64
+}
+
+// NewHealthProbe returns a HealthProbe answering the HTTP probes for paths.
+// If no path is given, only TCP probes are recognized.
+func NewHealthProbe(paths ...string) *HealthProbe {
+	return &HealthProbe{paths: paths}
+}
+
+// Matcher returns a matcher matching the health probes.
+func (p *HealthProbe) Matcher() Matcher {
+	return p.match
+}
+
+func (p *HealthProbe) match(r io.Reader) bool {
+	br := bufio.NewReader(&io.LimitedReader{R: r, N: maxHTTPRead})
+	if _, err := br.Peek(1); err != nil {
+		return err == io.EOF
+	}
+
+	l, part, err := br.ReadLine()
+	if err != nil || part {
+		return false
+	}
+	method, uri, proto, ok := parseRequestLine(string(l))
+	if !ok || (method != http.MethodGet && method != http.MethodHead) {
+		return false
+	}
+	if v, _, ok := http.ParseHTTPVersion(proto); !ok || v != 1 {
+		return false
+	}
+	return p.isProbePath(uri)
+}
+
+func (p *HealthProbe) isProbePath(uri string) bool {
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+	for _, path := range p.paths {
+		if uri == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve answers the probes accepted on l until l returns an error, which
+// Serve returns.
+func (p *HealthProbe) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.serveConn(c)
+	}
+}
+
+func (p *HealthProbe) serveConn(c net.Conn) {
+	defer func() { _ = c.Close() }()
+	_ = c.SetDeadline(time.Now().Add(healthProbeTimeout))
+
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		if err == io.EOF {
+			atomic.AddUint64(&p.tcp, 1)
+		}
+		return
+	}
+	atomic.AddUint64(&p.http, 1)
+
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		ContentLength: 0,
+		Close:         true,
+	}
+	_ = resp.Write(c)
+}
+
+// Stats returns the statistics of the probe.
+func (p *HealthProbe) Stats() HealthProbeStats {
+	return HealthProbeStats{
+		TCP:  atomic.LoadUint64(&p.tcp),
+		HTTP: atomic.LoadUint64(&p.http),
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestHealthProbe(t *testing.T) {
+	defer leakCheck(t)()
+
+	l := newChanListener()
+	defer close(l.connCh)
+	muxl := New(l)
+	hp := NewHealthProbe("/healthz")
+	healthl := muxl.Match(hp.Matcher())
+	httpl := muxl.Match(HTTP1Fast())
+	serveErrors(t, muxl)
+
+	// An HTTP probe.
+	w, r := net.Pipe()
+	defer func() { _ = w.Close() }()
+	writeAsync(w, "GET /healthz?full=1 HTTP/1.1\r\nHost: lb\r\n\r\n")
+	l.connCh <- r
+	c, err := healthl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hp.serveConn(c)
+	resp, err := http.ReadResponse(bufio.NewReader(w), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !resp.Close {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+
+	// A TCP probe.
+	w2, r2 := net.Pipe()
+	_ = w2.Close()
+	l.connCh <- r2
+	c2, err := healthl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hp.serveConn(c2)
+
+	if s := hp.Stats(); s != (HealthProbeStats{TCP: 1, HTTP: 1}) {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	// A request for another path is left to the HTTP listener.
+	w3, r3 := net.Pipe()
+	defer func() { _ = w3.Close() }()
+	const req = "GET /api HTTP/1.1\r\n\r\n"
+	writeAsync(w3, req)
+	l.connCh <- r3
+	c3, err := httpl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c3.Close() }()
+	b := make([]byte, len(req))
+	if _, err := io.ReadFull(c3, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != req {
+		t.Errorf("unexpected request: %q", b)
+	}
+}
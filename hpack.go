@@ -0,0 +1,302 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"errors"
+	"io"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// hpackMaxTableSize is the maximum size of the dynamic table, i.e., the
+// default SETTINGS_HEADER_TABLE_SIZE.
+const hpackMaxTableSize = 4 << 10
+
+var errHPACK = errors.New("mux: invalid hpack header block")
+
+type hpackField struct {
+	name, value []byte
+}
+
+// hpackStaticTable is the static table of RFC 7541, Appendix A.
+var hpackStaticTable = func() []hpackField {
+	fields := [...][2]string{
+		{":authority", ""},
+		{":method", "GET"},
+		{":method", "POST"},
+		{":path", "/"},
+		{":path", "/index.html"},
+		{":scheme", "http"},
+		{":scheme", "https"},
+		{":status", "200"},
+		{":status", "204"},
+		{":status", "206"},
+		{":status", "304"},
+		{":status", "400"},
+		{":status", "404"},
+		{":status", "500"},
+		{"accept-charset", ""},
+		{"accept-encoding", "gzip, deflate"},
+		{"accept-language", ""},
+		{"accept-ranges", ""},
+		{"accept", ""},
+		{"access-control-allow-origin", ""},
+		{"age", ""},
+		{"allow", ""},
+		{"authorization", ""},
+		{"cache-control", ""},
+		{"content-disposition", ""},
+		{"content-encoding", ""},
+		{"content-language", ""},
+		{"content-length", ""},
+		{"content-location", ""},
+		{"content-range", ""},
+		{"content-type", ""},
+		{"cookie", ""},
+		{"date", ""},
+		{"etag", ""},
+		{"expect", ""},
+		{"expires", ""},
+		{"from", ""},
+		{"host", ""},
+		{"if-match", ""},
+		{"if-modified-since", ""},
+		{"if-none-match", ""},
+		{"if-range", ""},
+		{"if-unmodified-since", ""},
+		{"last-modified", ""},
+		{"link", ""},
+		{"location", ""},
+		{"max-forwards", ""},
+		{"proxy-authenticate", ""},
+		{"proxy-authorization", ""},
+		{"range", ""},
+		{"referer", ""},
+		{"refresh", ""},
+		{"retry-after", ""},
+		{"server", ""},
+		{"set-cookie", ""},
+		{"strict-transport-security", ""},
+		{"transfer-encoding", ""},
+		{"user-agent", ""},
+		{"vary", ""},
+		{"via", ""},
+		{"www-authenticate", ""},
+	}
+	t := make([]hpackField, len(fields))
+	for i, f := range fields {
+		t[i] = hpackField{name: []byte(f[0]), value: []byte(f[1])}
+	}
+	return t
+}()
+
+// hpackDecoder is a minimal HPACK decoder that decodes a single header block
+// without allocating once its buffers have grown, unlike hpack.Decoder which
+// allocates the strings of every field. It is reset and reused across
+// connections. It is checked against hpack.Decoder by FuzzHPACKDecoder.
+//
+// The fields it returns point into the header block and into its own
+// buffers, so they are only valid until the decoder is reset.
+type hpackDecoder struct {
+	buf []byte // the rest of the header block.
+	// first is whether the next representation is the first of the block.
+	first bool
+
+	// table is the dynamic table, oldest entry first.
+	table   []hpackField
+	size    int
+	maxSize int
+
+	// arena holds the decoded Huffman-encoded strings.
+	arena []byte
+}
+
+func (d *hpackDecoder) reset(block []byte) {
+	d.buf = block
+	d.first = true
+	d.table = d.table[:0]
+	d.size = 0
+	d.maxSize = hpackMaxTableSize
+	d.arena = d.arena[:0]
+}
+
+// next decodes the next field of the header block. It returns io.EOF at the
+// end of the block.
+func (d *hpackDecoder) next() (hpackField, error) {
+	for len(d.buf) > 0 {
+		b := d.buf[0]
+		first := d.first
+		d.first = false
+		switch {
+		case b&0x80 != 0:
+			// Indexed header field.
+			i, err := d.readInt(7)
+			if err != nil {
+				return hpackField{}, err
+			}
+			return d.at(i)
+		case b&0xc0 == 0x40:
+			// Literal header field with incremental indexing.
+			f, err := d.readLiteral(6)
+			if err != nil {
+				return hpackField{}, err
+			}
+			d.add(f)
+			return f, nil
+		case b&0xe0 == 0x20:
+			// Dynamic table size update. It must come first, as in
+			// hpack.Decoder, which allows it later only while the table
+			// is empty.
+			if !first && d.size > 0 {
+				return hpackField{}, errHPACK
+			}
+			size, err := d.readInt(5)
+			if err != nil {
+				return hpackField{}, err
+			}
+			if size > hpackMaxTableSize {
+				return hpackField{}, errHPACK
+			}
+			d.maxSize = int(size)
+			d.evict()
+		default:
+			// Literal header field without indexing or never indexed.
+			return d.readLiteral(4)
+		}
+	}
+	return hpackField{}, io.EOF
+}
+
+func (d *hpackDecoder) at(i uint64) (hpackField, error) {
+	if i == 0 {
+		return hpackField{}, errHPACK
+	}
+	if i <= uint64(len(hpackStaticTable)) {
+		return hpackStaticTable[i-1], nil
+	}
+	i -= uint64(len(hpackStaticTable))
+	if i > uint64(len(d.table)) {
+		return hpackField{}, errHPACK
+	}
+	return d.table[len(d.table)-int(i)], nil
+}
+
+func (d *hpackDecoder) add(f hpackField) {
+	size := len(f.name) + len(f.value) + 32
+	if size > d.maxSize {
+		// An entry larger than the table empties the table.
+		d.table = d.table[:0]
+		d.size = 0
+		return
+	}
+	d.table = append(d.table, f)
+	d.size += size
+	d.evict()
+}
+
+func (d *hpackDecoder) evict() {
+	n := 0
+	for d.size > d.maxSize {
+		f := d.table[n]
+		d.size -= len(f.name) + len(f.value) + 32
+		n++
+	}
+	if n > 0 {
+		d.table = d.table[:copy(d.table, d.table[n:])]
+	}
+}
+
+func (d *hpackDecoder) readLiteral(n uint) (f hpackField, err error) {
+	i, err := d.readInt(n)
+	if err != nil {
+		return hpackField{}, err
+	}
+	if i == 0 {
+		f.name, err = d.readString()
+	} else {
+		var indexed hpackField
+		indexed, err = d.at(i)
+		f.name = indexed.name
+	}
+	if err != nil {
+		return hpackField{}, err
+	}
+	if f.value, err = d.readString(); err != nil {
+		return hpackField{}, err
+	}
+	return f, nil
+}
+
+// readInt reads an integer with an n-bit prefix, as specified in RFC 7541,
+// Section 5.1.
+func (d *hpackDecoder) readInt(n uint) (uint64, error) {
+	if len(d.buf) == 0 {
+		return 0, errHPACK
+	}
+	mask := uint64(1)<<n - 1
+	i := uint64(d.buf[0]) & mask
+	d.buf = d.buf[1:]
+	if i < mask {
+		return i, nil
+	}
+
+	var m uint
+	for len(d.buf) > 0 {
+		b := d.buf[0]
+		d.buf = d.buf[1:]
+		i += uint64(b&0x7f) << m
+		if b&0x80 == 0 {
+			return i, nil
+		}
+		if m += 7; m >= 63 {
+			return 0, errHPACK
+		}
+	}
+	return 0, errHPACK
+}
+
+// readString reads a string literal, as specified in RFC 7541, Section 5.2.
+func (d *hpackDecoder) readString() ([]byte, error) {
+	if len(d.buf) == 0 {
+		return nil, errHPACK
+	}
+	huffman := d.buf[0]&0x80 != 0
+	l, err := d.readInt(7)
+	if err != nil {
+		return nil, err
+	}
+	if l > uint64(len(d.buf)) {
+		return nil, errHPACK
+	}
+	s := d.buf[:l]
+	d.buf = d.buf[l:]
+	if !huffman {
+		return s, nil
+	}
+
+	start := len(d.arena)
+	if _, err := hpack.HuffmanDecode(d, s); err != nil {
+		return nil, errHPACK
+	}
+	end := len(d.arena)
+	return d.arena[start:end:end], nil
+}
+
+// Write appends p to the arena. It is used to Huffman-decode strings.
+func (d *hpackDecoder) Write(p []byte) (int, error) {
+	d.arena = append(d.arena, p...)
+	return len(p), nil
+}
@@ -0,0 +1,33 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package cmux
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func FuzzHPACKDecoder(f *testing.F) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 64; i++ {
+		f.Add(randomHPACKBlock(rnd))
+	}
+	f.Fuzz(func(t *testing.T, block []byte) {
+		checkHPACKDecoder(t, block)
+	})
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build !race
+// +build !race
+
+// sync.Pool drops items at random under the race detector, so allocations
+// are only checked without it.
+
+package cmux
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHTTP2HeaderFieldMatcherAllocs(t *testing.T) {
+	m := HTTP2HeaderField("content-type", "application/grpc")
+	r := bytes.NewReader(benchHTTP2HeaderPayload)
+	if !m(r) {
+		t.Fatal("header field not matched")
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(benchHTTP2HeaderPayload)
+		if !m(r) {
+			t.Fatal("header field not matched")
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("matching allocates %v times", allocs)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestHPACKDecoder(t *testing.T) {
+	long := strings.Repeat("x", 3000)
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "example.com"},
+		{Name: "content-type", Value: "application/grpc"},
+		{Name: "x-long", Value: long},
+		{Name: "x-secret", Value: "s3cr3t", Sensitive: true},
+		{Name: "content-type", Value: "application/grpc"},
+		{Name: "x-long-2", Value: long},
+		{Name: "x-custom", Value: "\x00\xff binary"},
+		{Name: "x-custom", Value: "\x00\xff binary"},
+	}
+
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	// Emits a dynamic table size update.
+	enc.SetMaxDynamicTableSizeLimit(hpackMaxTableSize)
+	enc.SetMaxDynamicTableSize(hpackMaxTableSize - 1)
+	for _, f := range fields {
+		if err := enc.WriteField(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var d hpackDecoder
+	d.reset(block.Bytes())
+	for i := 0; ; i++ {
+		f, err := d.next()
+		if err == io.EOF {
+			if i != len(fields) {
+				t.Errorf("decoded %d fields, want %d", i, len(fields))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("field %d: %v", i, err)
+		}
+		if i >= len(fields) {
+			t.Fatalf("unexpected field %q", f.name)
+		}
+		if string(f.name) != fields[i].Name || string(f.value) != fields[i].Value {
+			t.Errorf("field %d: got %q: %q, want %q: %q", i, f.name, f.value,
+				fields[i].Name, fields[i].Value)
+		}
+	}
+}
+
+func TestHPACKDecoderInvalid(t *testing.T) {
+	for _, block := range [][]byte{
+		{0x80},                   // Index 0.
+		{0xbf, 0x00},             // Index 63, not in the dynamic table.
+		{0x40, 0x05, 'a'},        // Truncated name.
+		{0x3f, 0xe2, 0x1f},       // Table size update above the maximum.
+		{0xff, 0xff, 0xff, 0xff}, // Truncated integer.
+	} {
+		var d hpackDecoder
+		d.reset(block)
+		var err error
+		for err == nil {
+			_, err = d.next()
+		}
+		if err != errHPACK {
+			t.Errorf("%x: got error %v, want %v", block, err, errHPACK)
+		}
+	}
+}
+
+// checkHPACKDecoder checks that hpackDecoder decodes block to the fields
+// hpack.Decoder decodes it to, and fails when hpack.Decoder fails.
+func checkHPACKDecoder(t testing.TB, block []byte) {
+	want, wantErr := hpack.NewDecoder(hpackMaxTableSize, nil).DecodeFull(block)
+
+	var d hpackDecoder
+	d.reset(block)
+	var got []hpack.HeaderField
+	var err error
+	for {
+		var f hpackField
+		if f, err = d.next(); err != nil {
+			break
+		}
+		got = append(got, hpack.HeaderField{Name: string(f.name), Value: string(f.value)})
+	}
+	if err == io.EOF {
+		err = nil
+	}
+
+	if (err == nil) != (wantErr == nil) {
+		t.Fatalf("%x: got error %v, want %v", block, err, wantErr)
+	}
+	if err != nil {
+		return
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%x: decoded %d fields, want %d", block, len(got), len(want))
+	}
+	for i := range got {
+		if got[i].Name != want[i].Name || got[i].Value != want[i].Value {
+			t.Fatalf("%x: field %d: got %q: %q, want %q: %q", block, i,
+				got[i].Name, got[i].Value, want[i].Name, want[i].Value)
+		}
+	}
+}
+
+// randomHPACKBlock returns a header block encoding random fields, some of
+// which are indexed, with random table size updates.
+func randomHPACKBlock(rnd *rand.Rand) []byte {
+	names := []string{":method", ":path", ":authority", "content-type", "x-a", "x-b"}
+	values := []string{"", "GET", "/", "application/grpc", "\x00\xff", strings.Repeat("v", 200)}
+
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	enc.SetMaxDynamicTableSizeLimit(hpackMaxTableSize)
+	if rnd.Intn(4) == 0 {
+		enc.SetMaxDynamicTableSize(uint32(rnd.Intn(hpackMaxTableSize)))
+	}
+	for n := rnd.Intn(10); n > 0; n-- {
+		f := hpack.HeaderField{
+			Name:      names[rnd.Intn(len(names))],
+			Value:     values[rnd.Intn(len(values))],
+			Sensitive: rnd.Intn(8) == 0,
+		}
+		if err := enc.WriteField(f); err != nil {
+			panic(err)
+		}
+	}
+	return block.Bytes()
+}
+
+func TestHPACKDecoderAgainstHPACK(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		block := randomHPACKBlock(rnd)
+		// Corrupt most blocks, to also compare the failures.
+		switch rnd.Intn(4) {
+		case 0:
+			if len(block) > 0 {
+				block = block[:rnd.Intn(len(block))]
+			}
+		case 1, 2:
+			for n := rnd.Intn(4) + 1; n > 0 && len(block) > 0; n-- {
+				block[rnd.Intn(len(block))] = byte(rnd.Intn(256))
+			}
+		}
+		checkHPACKDecoder(t, block)
+	}
+}
+
+// continuationReader returns the client preface and a HEADERS frame
+// followed by CONTINUATION frames, none of which ends the header block,
+// up to limit bytes.
+type continuationReader struct {
+	buf   bytes.Buffer
+	read  int
+	limit int
+	// onRead is called before each read, if set.
+	onRead func()
+}
+
+func (r *continuationReader) Read(p []byte) (int, error) {
+	if r.onRead != nil {
+		r.onRead()
+	}
+	if r.buf.Len() == 0 {
+		if r.read >= r.limit {
+			return 0, io.EOF
+		}
+		const frameLen = 16384
+		typ := http2.FrameContinuation
+		if r.read == 0 {
+			r.buf.WriteString(http2.ClientPreface)
+			typ = http2.FrameHeaders
+		}
+		r.buf.Write([]byte{frameLen >> 16, frameLen >> 8 & 0xff, frameLen & 0xff,
+			byte(typ), 0, 0, 0, 0, 1})
+		r.buf.Write(make([]byte, frameLen))
+	}
+	n, err := r.buf.Read(p)
+	r.read += n
+	return n, err
+}
+
+func TestHTTP2HeaderBlockLimit(t *testing.T) {
+	mem := newSniffMemory(1 << 30)
+	src := &continuationReader{limit: 4 * maxHTTP2HeaderBlock}
+	br := &bufferedReader{source: src, mem: mem}
+	br.reset(true)
+	// blockHeld is the most memory accounted for the header block.
+	var blockHeld int64
+	src.onRead = func() {
+		if n := atomic.LoadInt64(&mem.used) - atomic.LoadInt64(&br.held); n > blockHeld {
+			blockHeld = n
+		}
+	}
+
+	if HTTP2HeaderField("foo", "bar")(br) {
+		t.Fatal("endless header block matched")
+	}
+	if src.read > 2*maxHTTP2HeaderBlock {
+		t.Errorf("read %d bytes of header block", src.read)
+	}
+	if blockHeld < maxHTTP2HeaderBlock/2 {
+		t.Errorf("header block not accounted in sniff memory: %d bytes", blockHeld)
+	}
+	if used, held := atomic.LoadInt64(&mem.used), atomic.LoadInt64(&br.held); used != held {
+		t.Errorf("header block still accounted after matching: %d bytes", used-held)
+	}
+}
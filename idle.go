@@ -0,0 +1,105 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+type idleTimeoutListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+// IdleTimeoutListener wraps l so that the connections it accepts are closed
+// once no data has been read from or written to them for timeout. A Read
+// blocked waiting for data does not count as activity. It is meant for the
+// listeners of protocol servers that do not close idle connections
+// themselves (e.g., net/rpc), so that such connections do not leak.
+//
+// The timeout does not use deadlines, so it does not interfere with the
+// deadlines set by the protocol server. The accepted connections implement
+// NetConn to expose the wrapped connection.
+func IdleTimeoutListener(l net.Listener, timeout time.Duration) net.Listener {
+	return &idleTimeoutListener{Listener: l, timeout: timeout}
+}
+
+func (l *idleTimeoutListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newIdleConn(c, l.timeout), nil
+}
+
+type idleConn struct {
+	// last is the time of the last activity in nanoseconds since start. It
+	// is accessed atomically and must stay 64-bit aligned.
+	last int64
+
+	net.Conn
+	start   time.Time
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleConn(c net.Conn, timeout time.Duration) *idleConn {
+	ic := &idleConn{
+		Conn:    c,
+		start:   time.Now(),
+		timeout: timeout,
+	}
+	ic.timer = time.AfterFunc(timeout, ic.check)
+	return ic
+}
+
+func (c *idleConn) check() {
+	idle := time.Since(c.start) - time.Duration(atomic.LoadInt64(&c.last))
+	if idle >= c.timeout {
+		_ = c.Conn.Close()
+		return
+	}
+	c.timer.Reset(c.timeout - idle)
+}
+
+func (c *idleConn) touch(n int) {
+	if n > 0 {
+		atomic.StoreInt64(&c.last, int64(time.Since(c.start)))
+	}
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.touch(n)
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.touch(n)
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection.
+func (c *idleConn) NetConn() net.Conn {
+	return c.Conn
+}
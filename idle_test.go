@@ -0,0 +1,81 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeoutListener(t *testing.T) {
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+	const timeout = 100 * time.Millisecond
+
+	l := newChanListener()
+	muxl := New(l)
+	anyl := IdleTimeoutListener(muxl.Match(Any()), timeout)
+	go safeServe(errCh, muxl)
+	defer close(l.connCh)
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	l.connCh <- server
+
+	c, err := anyl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(interface{ NetConn() net.Conn }).NetConn().(*MuxConn); !ok {
+		t.Errorf("unexpected wrapped connection %T", c)
+	}
+
+	// Keep the connection busy for longer than the timeout.
+	go func() {
+		for i := 0; i < 6; i++ {
+			if _, err := io.WriteString(client, "ping"); err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(timeout / 3)
+		}
+	}()
+	start := time.Now()
+	var b [4]byte
+	for i := 0; i < 6; i++ {
+		if _, err := io.ReadFull(c, b[:]); err != nil {
+			t.Fatalf("connection closed while active after %v: %v",
+				time.Since(start), err)
+		}
+	}
+
+	// Then let it idle.
+	if _, err := c.Read(b[:]); err == nil {
+		t.Fatal("read succeeded on an idle connection")
+	}
+	if idle := time.Since(start); idle < timeout {
+		t.Errorf("connection closed too early: %v", idle)
+	}
+	_ = c.Close()
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package cmux
+
+import (
+	"net"
+	"net/netip"
+)
+
+// WithIPPolicy filters the connections by their remote IP before any byte
+// is read from them: a connection is rejected if its IP is in one of the
+// deny prefixes, or if allow is not empty and its IP is in none of the
+// allow prefixes. Connections without a remote IP, e.g. over Unix sockets,
+// are rejected only if allow is not empty.
+//
+// Rejected connections are closed, counted by CMux.Rejected and reported
+// to the ErrorHandler as ErrConnRejected, so that they never take a sniff
+// buffer or matcher time.
+func WithIPPolicy(allow, deny []netip.Prefix) Option {
+	return func(m *cMux) {
+		m.admitters = append(m.admitters, func(c net.Conn) (bool, string) {
+			ip, ok := remoteAddrIP(c)
+			if !ok {
+				if len(allow) > 0 {
+					return false, "remote address not allowed"
+				}
+				return true, ""
+			}
+			for _, p := range deny {
+				if p.Contains(ip) {
+					return false, "remote IP denied by " + p.String()
+				}
+			}
+			if len(allow) == 0 {
+				return true, ""
+			}
+			for _, p := range allow {
+				if p.Contains(ip) {
+					return true, ""
+				}
+			}
+			return false, "remote IP not allowed"
+		})
+	}
+}
+
+// remoteAddrIP returns the remote IP of c, with IPv4-mapped IPv6 addresses
+// unmapped.
+func remoteAddrIP(c net.Conn) (netip.Addr, bool) {
+	var ip net.IP
+	switch a := c.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return netip.Addr{}, false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	return addr.Unmap(), ok
+}
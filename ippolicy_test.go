@@ -0,0 +1,86 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package cmux
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestIPPolicy(t *testing.T) {
+	loopback := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	other := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	for _, test := range []struct {
+		name        string
+		allow, deny []netip.Prefix
+		admitted    bool
+	}{
+		{"no policy", nil, nil, true},
+		{"allowed", loopback, nil, true},
+		{"not allowed", other, nil, false},
+		{"denied", nil, loopback, false},
+		{"deny wins", loopback, loopback, false},
+		{"not denied", nil, other, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defer leakCheck(t)()
+			l, cleanup := testListener(t)
+			defer cleanup()
+
+			muxl := New(l, WithIPPolicy(test.allow, test.deny))
+			errs := make(chan error, 1)
+			muxl.HandleError(func(err error) bool {
+				errs <- err
+				return true
+			})
+			anyl := muxl.Match(Any())
+			go safeServe(nil, muxl)
+
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = c.Close() }()
+
+			if test.admitted {
+				ac, err := anyl.Accept()
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = ac.Close()
+			} else {
+				err := <-errs
+				if _, ok := err.(ErrConnRejected); !ok {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if _, err := c.Read(make([]byte, 1)); err == nil {
+					t.Error("rejected connection is still open")
+				}
+			}
+			want := uint64(1)
+			if test.admitted {
+				want = 0
+			}
+			if n := muxl.Rejected(); n != want {
+				t.Errorf("unexpected rejected count: %d", n)
+			}
+			cleanup()
+		})
+	}
+}
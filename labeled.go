@@ -0,0 +1,80 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"net"
+)
+
+// LabeledListener accepts the connections of all the listeners created with
+// MatchLabeled, along with the label of the listener that matched them. It
+// lets one accept loop serve several related protocols:
+//
+//	ll := m.MatchLabeled("http", cmux.HTTP1Fast())
+//	m.MatchLabeled("rpc", cmux.Any())
+//	for {
+//		c, label, err := ll.Accept()
+//		if err != nil {
+//			return err
+//		}
+//		switch label {
+//		case "http":
+//			...
+//		}
+//	}
+type LabeledListener interface {
+	// Accept waits for and returns the next connection matched by a
+	// labeled listener, and the label of that listener.
+	Accept() (net.Conn, string, error)
+	// Close closes the root listener.
+	Close() error
+	// Addr returns the address of the root listener.
+	Addr() net.Addr
+}
+
+type labeledListener struct {
+	mux *cMux
+}
+
+func (m *cMux) MatchLabeled(label string, matchers ...Matcher) LabeledListener {
+	if m.labeled == nil {
+		m.labeled = make(chan net.Conn, m.bufLen)
+	}
+	m.MatchNamed(label, matchers...)
+	// The listener shares its backlog with the other labeled listeners.
+	m.sls[len(m.sls)-1].l.connc = m.labeled
+	return labeledListener{mux: m}
+}
+
+func (l labeledListener) Accept() (net.Conn, string, error) {
+	select {
+	case c, ok := <-l.mux.labeled:
+		if !ok {
+			return nil, "", l.mux.closedErr()
+		}
+		muc, _ := muxConnOf(c)
+		return c, muc.info.MatchedProtocol, nil
+	case <-l.mux.donec:
+		return nil, "", l.mux.closedErr()
+	}
+}
+
+func (l labeledListener) Addr() net.Addr {
+	return l.mux.rootListener().Addr()
+}
+
+func (l labeledListener) Close() error {
+	return l.mux.rootListener().Close()
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMatchLabeled(t *testing.T) {
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+	l, cleanup := testListener(t)
+	defer cleanup()
+
+	muxl := New(l)
+	ll := muxl.MatchLabeled("a", PrefixMatcher("a"))
+	httpl := muxl.Match(HTTP1Fast())
+	if muxl.MatchLabeled("b", PrefixMatcher("b")) != ll {
+		t.Error("MatchLabeled returned another listener")
+	}
+	go safeServe(errCh, muxl)
+
+	for _, label := range []string{"b", "a"} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = c.Close() }()
+		writeAsync(c, label+" payload")
+
+		ac, got, err := ll.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != label {
+			t.Errorf("unexpected label: want=%q got=%q", label, got)
+		}
+		b := make([]byte, 1)
+		if _, err := ac.Read(b); err != nil || string(b) != label {
+			t.Errorf("unexpected read: %q, %v", b, err)
+		}
+		_ = ac.Close()
+	}
+
+	stats := muxl.Stats()
+	if stats[0].Matched != 1 || stats[2].Matched != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	cleanup()
+	if _, _, err := ll.Accept(); err != ErrListenerClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := httpl.Accept(); err != ErrListenerClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
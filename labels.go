@@ -0,0 +1,59 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"context"
+	"runtime/pprof"
+	"strconv"
+)
+
+// The pprof labels set by WithPprofLabels.
+const (
+	// ProtocolLabel is the name of the listener that accepted the
+	// connection, as reported by MuxConn.MatchedProtocol.
+	ProtocolLabel = "cmux_protocol"
+	// ListenerLabel is the index of the listener that accepted the
+	// connection, in the order the listeners were created, so that unnamed
+	// listeners can be told apart.
+	ListenerLabel = "cmux_listener"
+)
+
+// WithPprofLabels tags the goroutines serving matched connections with the
+// pprof labels ProtocolLabel and ListenerLabel, so that the CPU and heap
+// profiles of a multiplexed server can be broken down by protocol.
+//
+// The Accept method of each listener sets the labels on the calling
+// goroutine, replacing the labels it had. Goroutines inherit the labels of
+// the goroutine that starts them, so servers that start a goroutine per
+// connection from their accept loop, as http.Server and grpc.Server do, have
+// all their connection goroutines tagged. The labels are also carried by
+// MuxConn.Context, for servers that do not, e.g.:
+//
+//	if mc, ok := c.(interface{ Context() context.Context }); ok {
+//		pprof.SetGoroutineLabels(mc.Context())
+//	}
+func WithPprofLabels() Option {
+	return func(m *cMux) {
+		m.pprofLabels = true
+	}
+}
+
+// listenerLabels returns a context carrying the pprof labels of the i-th
+// listener, named name.
+func listenerLabels(i int, name string) context.Context {
+	return pprof.WithLabels(context.Background(),
+		pprof.Labels(ProtocolLabel, name, ListenerLabel, strconv.Itoa(i)))
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"runtime/pprof"
+	"strings"
+	"testing"
+)
+
+func TestPprofLabels(t *testing.T) {
+	defer leakCheck(t)()
+
+	l := newChanListener()
+	defer close(l.connCh)
+	muxl := New(l, WithPprofLabels())
+	muxl.Match(PrefixMatcher("bye"))
+	hellol := muxl.MatchNamed("hello", PrefixMatcher("hello"))
+	serveErrors(t, muxl)
+
+	w, r := net.Pipe()
+	defer func() { _ = w.Close() }()
+	writeAsync(w, "hello!")
+	l.connCh <- r
+
+	c, err := hellol.Accept()
+	// Accept labeled this goroutine.
+	defer pprof.SetGoroutineLabels(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	if v, _ := pprof.Label(c.(*MuxConn).Context(), ProtocolLabel); v != "hello" {
+		t.Errorf("unexpected label in the connection context: %q", v)
+	}
+	var b bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&b, 1); err != nil {
+		t.Fatal(err)
+	}
+	const want = `"cmux_listener":"1", "cmux_protocol":"hello"`
+	if !strings.Contains(b.String(), want) {
+		t.Errorf("goroutine profile does not contain %s:\n%s", want, b.String())
+	}
+}
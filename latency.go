@@ -0,0 +1,90 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets is the number of buckets of latency histograms. The i-th
+// bucket counts the latencies below 2^i microseconds, so the last one is
+// about 8.4s, and one more bucket counts the latencies above.
+const latencyBuckets = 24
+
+// latencyHistogram is a histogram of latencies with power-of-two buckets.
+// All the counts are accessed atomically.
+type latencyHistogram struct {
+	counts [latencyBuckets + 1]uint64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	if d > 0 {
+		i = bits.Len64(uint64(d / time.Microsecond))
+	}
+	if i > latencyBuckets {
+		i = latencyBuckets
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+}
+
+// snapshot returns the number of observations and the upper bounds of their
+// quantiles qs.
+func (h *latencyHistogram) snapshot(qs ...float64) (uint64, []time.Duration) {
+	var counts [latencyBuckets + 1]uint64
+	var total uint64
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+
+	bounds := make([]time.Duration, len(qs))
+	if total == 0 {
+		return 0, bounds
+	}
+	for j, q := range qs {
+		rank := uint64(q*float64(total) + 0.5)
+		if rank == 0 {
+			rank = 1
+		}
+		var seen uint64
+		for i, c := range counts {
+			if seen += c; seen >= rank {
+				bounds[j] = time.Duration(uint64(1)<<uint(i)) * time.Microsecond
+				break
+			}
+		}
+	}
+	return total, bounds
+}
+
+// MatcherStats are the statistics of a matcher. See ListenerStats.
+type MatcherStats struct {
+	// Calls is the number of connections the matcher was evaluated on.
+	Calls uint64
+	// P50 and P99 are upper bounds of the median and of the 99th percentile
+	// of the time the matcher took, i.e., of the time spent reading the
+	// connection and evaluating it. Their resolution is a power of two
+	// microseconds. The prefix matchers compiled together (see CMux.Match)
+	// are evaluated at once, and they all record the time it took.
+	P50, P99 time.Duration
+}
+
+func (h *latencyHistogram) matcherStats() MatcherStats {
+	calls, qs := h.snapshot(.5, .99)
+	return MatcherStats{Calls: calls, P50: qs[0], P99: qs[1]}
+}
@@ -0,0 +1,47 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	if s := h.matcherStats(); s != (MatcherStats{}) {
+		t.Errorf("unexpected stats of an empty histogram: %+v", s)
+	}
+
+	for i := 0; i < 98; i++ {
+		h.observe(3 * time.Microsecond)
+	}
+	h.observe(100 * time.Microsecond)
+	h.observe(time.Hour)
+
+	want := MatcherStats{
+		Calls: 100,
+		P50:   4 * time.Microsecond,
+		P99:   128 * time.Microsecond,
+	}
+	if s := h.matcherStats(); s != want {
+		t.Errorf("unexpected stats: want=%+v got=%+v", want, s)
+	}
+
+	calls, qs := h.snapshot(1)
+	if max := time.Duration(1<<latencyBuckets) * time.Microsecond; calls != 100 || qs[0] != max {
+		t.Errorf("unexpected maximum: want=%v got=%v", max, qs[0])
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+)
+
+// listenConfig are the socket options of the listener created by Listen.
+type listenConfig struct {
+	reusePort bool
+	keepAlive time.Duration
+	backlog   int
+}
+
+// WithReusePort makes Listen set SO_REUSEPORT on the listener, so that
+// several processes can listen on the same address, e.g., during a rolling
+// restart. It is only supported on Linux and the BSDs, and has no effect
+// with New.
+func WithReusePort() Option {
+	return func(m *cMux) {
+		m.listen.reusePort = true
+	}
+}
+
+// WithKeepAlive makes Listen set the TCP keep-alive period of the accepted
+// connections to d. Keep-alives are disabled if d is negative. It has no
+// effect with New.
+func WithKeepAlive(d time.Duration) Option {
+	return func(m *cMux) {
+		m.listen.keepAlive = d
+	}
+}
+
+// WithListenBacklog makes Listen set the size of the backlog of the listener
+// to n, instead of the system default. It is only supported on Linux and the
+// BSDs, and has no effect with New.
+func WithListenBacklog(n int) Option {
+	return func(m *cMux) {
+		m.listen.backlog = n
+	}
+}
+
+// Listen listens on the address, as net.Listen does, and returns a CMux
+// multiplexing the listener, configured with opts. Besides the options of
+// New, WithReusePort, WithKeepAlive and WithListenBacklog configure the
+// listener.
+func Listen(ctx context.Context, network, address string, opts ...Option) (CMux, error) {
+	m := New(nil, opts...).(*cMux)
+	l, err := m.listen.listen(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	m.root = l
+	return m, nil
+}
+
+func (c listenConfig) listen(ctx context.Context, network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		KeepAlive: c.keepAlive,
+		Control: func(network, address string, rc syscall.RawConn) error {
+			if !c.reusePort {
+				return nil
+			}
+			return controlErr(rc, setReusePort)
+		},
+	}
+	l, err := lc.Listen(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.backlog > 0 {
+		if err := setListenBacklog(l, c.backlog); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// controlErr calls f on the file descriptor of rc, and returns the error of
+// either.
+func controlErr(rc syscall.RawConn, f func(fd uintptr) error) error {
+	var ferr error
+	if err := rc.Control(func(fd uintptr) { ferr = f(fd) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// setListenBacklog sets the backlog of l, by listening again on its socket
+// with the new backlog.
+func setListenBacklog(l net.Listener, n int) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return ErrNotSyscallConn
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return controlErr(rc, func(fd uintptr) error {
+		return listenBacklog(fd, n)
+	})
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListen(t *testing.T) {
+	defer leakCheck(t)()
+
+	opts := []Option{WithKeepAlive(time.Minute)}
+	if runtime.GOOS == "linux" {
+		opts = append(opts, WithReusePort(), WithListenBacklog(16))
+	}
+	muxl, err := Listen(context.Background(), "tcp", "127.0.0.1:0", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hellol := muxl.Match(PrefixMatcher("hello"))
+	errCh := make(chan error, 1)
+	go func() { errCh <- muxl.Serve() }()
+
+	if runtime.GOOS == "linux" {
+		// The port can be shared.
+		l, err := Listen(context.Background(), "tcp", hellol.Addr().String(), WithReusePort())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = l.Close()
+	}
+
+	c, err := net.Dial("tcp", hellol.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	if _, err := io.WriteString(c, "hello!"); err != nil {
+		t.Fatal(err)
+	}
+	mc, err := hellol.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = mc.Close()
+
+	if err := muxl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; !strings.Contains(err.Error(), "use of closed") {
+		t.Errorf("unexpected error from Serve: %v", err)
+	}
+}
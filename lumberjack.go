@@ -0,0 +1,48 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Lumberjack matches the connections of Elastic Beats and the other shippers
+// speaking the Lumberjack version 2 protocol, by the frame they send first:
+// a window size frame ("2W" and a non-zero event count) or a compressed frame
+// ("2C", a non-zero length and a zlib stream).
+func Lumberjack() Matcher {
+	return func(r io.Reader) bool {
+		var b [7]byte
+		if _, err := io.ReadFull(r, b[:6]); err != nil || b[0] != '2' {
+			return false
+		}
+		n := binary.BigEndian.Uint32(b[2:6])
+		switch b[1] {
+		case 'W':
+			return n > 0
+		case 'C':
+			if n == 0 {
+				return false
+			}
+			// The zlib header: deflate, with a valid check.
+			if _, err := io.ReadFull(r, b[:2]); err != nil {
+				return false
+			}
+			return b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+		}
+		return false
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+)
+
+func TestLumberjack(t *testing.T) {
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	_, _ = zw.Write([]byte("2J\x00\x00\x00\x01\x00\x00\x00\x02{}"))
+	_ = zw.Close()
+	compressed := []byte("2C\x00\x00\x00\x00")
+	binary.BigEndian.PutUint32(compressed[2:], uint32(z.Len()))
+	compressed = append(compressed, z.Bytes()...)
+
+	for _, test := range []struct {
+		name  string
+		frame []byte
+		match bool
+	}{
+		{"window", []byte("2W\x00\x00\x08\x00" + string(compressed)), true},
+		{"compressed", compressed, true},
+		{"empty window", []byte("2W\x00\x00\x00\x00"), false},
+		{"not zlib", []byte("2C\x00\x00\x00\x04abcd"), false},
+		{"version 1", []byte("1W\x00\x00\x08\x00"), false},
+		{"json", []byte("2J\x00\x00\x00\x01\x00\x00\x00\x02{}"), false},
+		{"http", []byte("GET / HTTP/1.1\r\n\r\n"), false},
+	} {
+		if got := Lumberjack()(bytes.NewReader(test.frame)); got != test.match {
+			t.Errorf("%s: want=%v got=%v", test.name, test.match, got)
+		}
+	}
+}
@@ -16,21 +16,27 @@ package cmux
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
+	"encoding/binary"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"regexp"
 	"strings"
+	"sync"
 
 	"golang.org/x/net/http2"
-	"golang.org/x/net/http2/hpack"
 )
 
 // Any is a Matcher that matches any connection.
 func Any() Matcher {
-	return func(r io.Reader) bool { return true }
+	return anyMatcher
 }
 
+func anyMatcher(io.Reader) bool { return true }
+
 // PrefixMatcher returns a matcher that matches a connection if it
 // starts with any of the strings in strs.
 func PrefixMatcher(strs ...string) Matcher {
@@ -38,8 +44,11 @@ func PrefixMatcher(strs ...string) Matcher {
 	return pt.matchPrefix
 }
 
-func prefixByteMatcher(list ...[]byte) Matcher {
-	pt := newPatriciaTree(list...)
+// PrefixByteMatcher returns a matcher that matches a connection if it
+// starts with any of the byte sequences in prefixes. It is meant for binary
+// protocols whose prefixes are not text, e.g. magic numbers.
+func PrefixByteMatcher(prefixes ...[]byte) Matcher {
+	pt := newPatriciaTree(prefixes...)
 	return pt.matchPrefix
 }
 
@@ -63,6 +72,18 @@ func HTTP1Fast(extMethods ...string) Matcher {
 	return PrefixMatcher(append(defaultHTTPMethods, extMethods...)...)
 }
 
+// HTTP1Methods returns a matcher matching the HTTP 1 requests using one of
+// methods, e.g. the WebDAV methods PROPFIND and MKCOL, by the prefix of the
+// request line. Unlike HTTP1Fast, the methods must be followed by a space and
+// the default methods are not matched unless they are listed.
+func HTTP1Methods(methods ...string) Matcher {
+	prefixes := make([]string, len(methods))
+	for i, m := range methods {
+		prefixes[i] = m + " "
+	}
+	return PrefixMatcher(prefixes...)
+}
+
 // TLS matches HTTPS requests.
 //
 // By default, any TLS handshake packet is matched. An optional whitelist
@@ -81,7 +102,7 @@ func TLS(versions ...int) Matcher {
 	for _, v := range versions {
 		prefixes = append(prefixes, []byte{22, byte(v >> 8 & 0xff), byte(v & 0xff)})
 	}
-	return prefixByteMatcher(prefixes...)
+	return PrefixByteMatcher(prefixes...)
 }
 
 const maxHTTPRead = 4096
@@ -90,20 +111,75 @@ const maxHTTPRead = 4096
 // the conection contains an HTTP request.
 func HTTP1() Matcher {
 	return func(r io.Reader) bool {
-		br := bufio.NewReader(&io.LimitedReader{R: r, N: maxHTTPRead})
-		l, part, err := br.ReadLine()
-		if err != nil || part {
+		_, _, proto, ok := readRequestLine(r)
+		if !ok {
 			return false
 		}
 
-		_, _, proto, ok := parseRequestLine(string(l))
+		v, _, ok := http.ParseHTTPVersion(proto)
+		return ok && v == 1
+	}
+}
+
+// HTTP1Version returns a matcher matching the HTTP 1 requests whose request
+// line has one of the given protocol versions, e.g. "HTTP/1.0". Like HTTP1,
+// it parses the first line or upto 4096 bytes of the request.
+func HTTP1Version(versions ...string) Matcher {
+	return func(r io.Reader) bool {
+		_, _, proto, ok := readRequestLine(r)
 		if !ok {
 			return false
 		}
+		if v, _, ok := http.ParseHTTPVersion(proto); !ok || v != 1 {
+			return false
+		}
+		for _, v := range versions {
+			if proto == v {
+				return true
+			}
+		}
+		return false
+	}
+}
 
-		v, _, ok := http.ParseHTTPVersion(proto)
-		return ok && v == 1
+// HTTPConnect matches the HTTP 1 CONNECT requests, e.g. those of the clients
+// of a forward proxy. If hosts are given, only the requests for a target in
+// hosts match. A host with a port matches that exact target, and one without
+// a port matches the target on any port. Hosts are compared case-insensitively.
+func HTTPConnect(hosts ...string) Matcher {
+	return func(r io.Reader) bool {
+		method, target, proto, ok := readRequestLine(r)
+		if !ok || method != http.MethodConnect {
+			return false
+		}
+		if v, _, ok := http.ParseHTTPVersion(proto); !ok || v != 1 {
+			return false
+		}
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			return false
+		}
+		if len(hosts) == 0 {
+			return true
+		}
+		for _, h := range hosts {
+			if strings.EqualFold(h, target) || strings.EqualFold(h, host) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// readRequestLine reads the first line, upto 4096 bytes, of an HTTP request
+// from r and splits it.
+func readRequestLine(r io.Reader) (method, uri, proto string, ok bool) {
+	br := bufio.NewReader(&io.LimitedReader{R: r, N: maxHTTPRead})
+	l, part, err := br.ReadLine()
+	if err != nil || part {
+		return
 	}
+	return parseRequestLine(string(l))
 }
 
 // grabbed from net/http.
@@ -144,12 +220,46 @@ func HTTP1HeaderFieldPrefix(name, valuePrefix string) Matcher {
 	}
 }
 
+// HTTP1HeaderPredicate returns a matcher matching the first request of an
+// HTTP 1 connection if pred returns true for one of its header fields. pred
+// is called for each value of each field, with the name in canonical form
+// (see net/http.CanonicalHeaderKey), and for the Host field.
+func HTTP1HeaderPredicate(pred func(name, value string) bool) Matcher {
+	return func(r io.Reader) bool {
+		req, err := http.ReadRequest(bufio.NewReader(r))
+		if err != nil {
+			return false
+		}
+		if req.Host != "" && pred("Host", req.Host) {
+			return true
+		}
+		for name, values := range req.Header {
+			for _, v := range values {
+				if pred(name, v) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// HTTP1HeaderFieldRegex returns a matcher matching the header fields of the
+// first request of an HTTP 1 connection. If one of the values of the header
+// with key name matches re, this will match.
+func HTTP1HeaderFieldRegex(name string, re *regexp.Regexp) Matcher {
+	name = http.CanonicalHeaderKey(name)
+	return HTTP1HeaderPredicate(func(gotName, gotValue string) bool {
+		return gotName == name && re.MatchString(gotValue)
+	})
+}
+
 // HTTP2HeaderField returns a matcher matching the header fields of the first
 // headers frame.
 func HTTP2HeaderField(name, value string) Matcher {
 	return func(r io.Reader) bool {
-		return matchHTTP2Field(ioutil.Discard, r, name, func(gotValue string) bool {
-			return gotValue == value
+		return matchHTTP2Field(ioutil.Discard, r, name, func(gotValue []byte) bool {
+			return string(gotValue) == value
 		})
 	}
 }
@@ -158,9 +268,10 @@ func HTTP2HeaderField(name, value string) Matcher {
 // first headers frame. If the header with key name has a value prefixed with
 // valuePrefix, this will match.
 func HTTP2HeaderFieldPrefix(name, valuePrefix string) Matcher {
+	prefix := []byte(valuePrefix)
 	return func(r io.Reader) bool {
-		return matchHTTP2Field(ioutil.Discard, r, name, func(gotValue string) bool {
-			return strings.HasPrefix(gotValue, valuePrefix)
+		return matchHTTP2Field(ioutil.Discard, r, name, func(gotValue []byte) bool {
+			return bytes.HasPrefix(gotValue, prefix)
 		})
 	}
 }
@@ -170,8 +281,8 @@ func HTTP2HeaderFieldPrefix(name, valuePrefix string) Matcher {
 // does not block on receiving a SETTING frame.
 func HTTP2MatchHeaderFieldSendSettings(name, value string) MatchWriter {
 	return func(w io.Writer, r io.Reader) bool {
-		return matchHTTP2Field(w, r, name, func(gotValue string) bool {
-			return gotValue == value
+		return matchHTTP2Field(w, r, name, func(gotValue []byte) bool {
+			return string(gotValue) == value
 		})
 	}
 }
@@ -180,34 +291,76 @@ func HTTP2MatchHeaderFieldSendSettings(name, value string) MatchWriter {
 // and writes the settings to the server. Prefer HTTP2HeaderFieldPrefix over
 // this one, if the client does not block on receiving a SETTING frame.
 func HTTP2MatchHeaderFieldPrefixSendSettings(name, valuePrefix string) MatchWriter {
+	prefix := []byte(valuePrefix)
 	return func(w io.Writer, r io.Reader) bool {
-		return matchHTTP2Field(w, r, name, func(gotValue string) bool {
-			return strings.HasPrefix(gotValue, valuePrefix)
+		return matchHTTP2Field(w, r, name, func(gotValue []byte) bool {
+			return bytes.HasPrefix(gotValue, prefix)
 		})
 	}
 }
 
-func hasHTTP2Preface(r io.Reader) bool {
-	var b [len(http2.ClientPreface)]byte
-	last := 0
+// HTTP2HeaderFieldRegex returns a matcher matching the header fields of the
+// first headers frame. If the header with key name has a value matching re,
+// this will match.
+func HTTP2HeaderFieldRegex(name string, re *regexp.Regexp) Matcher {
+	return func(r io.Reader) bool {
+		return matchHTTP2Field(ioutil.Discard, r, name, re.Match)
+	}
+}
 
-	for {
-		n, err := r.Read(b[last:])
-		if err != nil {
-			return false
-		}
+// HTTP2MatchHeaderFieldRegexSendSettings matches the header field against re
+// and writes the settings to the server, e.g., with
+// `^application/grpc(\+proto|\+json)?$` to match the gRPC content types.
+// Prefer HTTP2HeaderFieldRegex over this one, if the client does not block
+// on receiving a SETTING frame.
+func HTTP2MatchHeaderFieldRegexSendSettings(name string, re *regexp.Regexp) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP2Field(w, r, name, re.Match)
+	}
+}
 
-		last += n
-		eq := string(b[:last]) == http2.ClientPreface[:last]
-		if last == len(http2.ClientPreface) {
-			return eq
-		}
-		if !eq {
-			return false
-		}
+// HTTP2PathPrefix returns a matcher matching the first headers frame if its
+// :path pseudo-header field starts with prefix, e.g.,
+// "/grpc.health.v1.Health/".
+func HTTP2PathPrefix(prefix string) Matcher {
+	return HTTP2HeaderFieldPrefix(":path", prefix)
+}
+
+// HTTP2PathPrefixSendSettings matches the :path prefix and writes the
+// settings to the server. Prefer HTTP2PathPrefix over this one, if the
+// client does not block on receiving a SETTING frame.
+func HTTP2PathPrefixSendSettings(prefix string) MatchWriter {
+	return HTTP2MatchHeaderFieldPrefixSendSettings(":path", prefix)
+}
+
+// HTTP2Authority returns a matcher matching the first headers frame if its
+// :authority pseudo-header field is authority, e.g., "example.com:8443".
+// Unlike the other header fields, it is compared case insensitively.
+func HTTP2Authority(authority string) Matcher {
+	return func(r io.Reader) bool {
+		return matchHTTP2Field(ioutil.Discard, r, ":authority", func(gotValue []byte) bool {
+			return strings.EqualFold(string(gotValue), authority)
+		})
+	}
+}
+
+// HTTP2AuthoritySendSettings matches the :authority and writes the settings
+// to the server. Prefer HTTP2Authority over this one, if the client does not
+// block on receiving a SETTING frame.
+func HTTP2AuthoritySendSettings(authority string) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP2Field(w, r, ":authority", func(gotValue []byte) bool {
+			return strings.EqualFold(string(gotValue), authority)
+		})
 	}
 }
 
+func hasHTTP2Preface(r io.Reader) bool {
+	st := http2MatchStates.Get().(*http2MatchState)
+	defer http2MatchStates.Put(st)
+	return st.readPreface(r)
+}
+
 func matchHTTP1Field(r io.Reader, name string, matches func(string) bool) (matched bool) {
 	req, err := http.ReadRequest(bufio.NewReader(r))
 	if err != nil {
@@ -217,51 +370,209 @@ func matchHTTP1Field(r io.Reader, name string, matches func(string) bool) (match
 	return matches(req.Header.Get(name))
 }
 
-func matchHTTP2Field(w io.Writer, r io.Reader, name string, matches func(string) bool) (matched bool) {
-	if !hasHTTP2Preface(r) {
+// http2Settings is an empty SETTINGS frame.
+var http2Settings = [http2FrameHeaderLen]byte{3: byte(http2.FrameSettings)}
+
+const http2FrameHeaderLen = 9
+
+// maxHTTP2HeaderBlock is the maximum size of the header block read by the
+// HTTP/2 header field matchers. It is the default maximum size of the header
+// list of the net/http servers, so that no block they accept is refused.
+const maxHTTP2HeaderBlock = http.DefaultMaxHeaderBytes
+
+// http2MatchState is the scratch space of the HTTP/2 header field matchers.
+// It is pooled, so that matching does not allocate.
+type http2MatchState struct {
+	hdr   [http2FrameHeaderLen]byte
+	skip  [512]byte
+	block []byte
+	dec   hpackDecoder
+	// mem is the sniff memory the block is accounted for in, if limited,
+	// and held what is accounted.
+	mem  *sniffMemory
+	held int64
+}
+
+var http2MatchStates = sync.Pool{
+	New: func() interface{} {
+		return &http2MatchState{}
+	},
+}
+
+func (st *http2MatchState) release() {
+	if st.mem != nil {
+		st.mem.add(-st.held)
+		st.mem, st.held = nil, 0
+	}
+	if cap(st.block) > maxPooledBufferSize ||
+		cap(st.dec.arena) > maxPooledBufferSize {
+		return
+	}
+	st.dec.reset(nil)
+	http2MatchStates.Put(st)
+}
+
+func matchHTTP2Field(w io.Writer, r io.Reader, name string, matches func([]byte) bool) (matched bool) {
+	st := http2MatchStates.Get().(*http2MatchState)
+	defer st.release()
+
+	if !st.readPreface(r) {
 		return false
 	}
 
-	done := false
-	framer := http2.NewFramer(w, r)
-	hdec := hpack.NewDecoder(uint32(4<<10), func(hf hpack.HeaderField) {
-		if hf.Name == name {
-			done = true
-			if matches(hf.Value) {
-				matched = true
-			}
+	block, ok := st.readHeaderBlock(w, r)
+	if !ok {
+		return false
+	}
+	st.dec.reset(block)
+	for {
+		f, err := st.dec.next()
+		if err == io.EOF {
+			return matched
 		}
-	})
+		if err != nil {
+			return false
+		}
+		if string(f.name) == name && matches(f.value) {
+			matched = true
+		}
+	}
+}
+
+// readPreface reads the client connection preface from r, and returns
+// whether it is correct. It returns as soon as the bytes read so far do not
+// match.
+func (st *http2MatchState) readPreface(r io.Reader) bool {
+	b := st.skip[:len(http2.ClientPreface)]
+	last := 0
+
 	for {
-		f, err := framer.ReadFrame()
+		n, err := r.Read(b[last:])
 		if err != nil {
 			return false
 		}
 
-		switch f := f.(type) {
-		case *http2.SettingsFrame:
+		last += n
+		eq := string(b[:last]) == http2.ClientPreface[:last]
+		if last == len(http2.ClientPreface) {
+			return eq
+		}
+		if !eq {
+			return false
+		}
+	}
+}
+
+// readHeaderBlock reads the frames up to the end of the first header block,
+// answering the SETTINGS frames on w, and returns the block.
+func (st *http2MatchState) readHeaderBlock(w io.Writer, r io.Reader) ([]byte, bool) {
+	st.block = st.block[:0]
+	// stream is the stream of the HEADERS frame, if we are waiting for
+	// its CONTINUATION frames.
+	var stream uint32
+	for {
+		if _, err := io.ReadFull(r, st.hdr[:]); err != nil {
+			return nil, false
+		}
+		length := int(st.hdr[0])<<16 | int(st.hdr[1])<<8 | int(st.hdr[2])
+		typ := http2.FrameType(st.hdr[3])
+		flags := http2.Flags(st.hdr[4])
+		id := binary.BigEndian.Uint32(st.hdr[5:]) & (1<<31 - 1)
+
+		if stream != 0 && (typ != http2.FrameContinuation || id != stream) {
+			// A header block must not be interleaved with other frames.
+			return nil, false
+		}
+
+		switch typ {
+		case http2.FrameSettings:
+			if id != 0 || length%6 != 0 || !st.discard(r, length) {
+				return nil, false
+			}
 			// Sender acknoweldged the SETTINGS frame. No need to write
 			// SETTINGS again.
-			if f.IsAck() {
+			if flags.Has(http2.FlagSettingsAck) {
 				break
 			}
-			if err := framer.WriteSettings(); err != nil {
-				return false
+			if _, err := w.Write(http2Settings[:]); err != nil {
+				return nil, false
 			}
-		case *http2.ContinuationFrame:
-			if _, err := hdec.Write(f.HeaderBlockFragment()); err != nil {
-				return false
+		case http2.FrameHeaders, http2.FrameContinuation:
+			if id == 0 || (typ == http2.FrameContinuation && stream == 0) {
+				return nil, false
 			}
-			done = done || f.FrameHeader.Flags&http2.FlagHeadersEndHeaders != 0
-		case *http2.HeadersFrame:
-			if _, err := hdec.Write(f.HeaderBlockFragment()); err != nil {
-				return false
+			if !st.readFragment(r, length, typ, flags) {
+				return nil, false
+			}
+			if flags.Has(http2.FlagHeadersEndHeaders) {
+				return st.block, true
+			}
+			stream = id
+		default:
+			if !st.discard(r, length) {
+				return nil, false
 			}
-			done = done || f.FrameHeader.Flags&http2.FlagHeadersEndHeaders != 0
 		}
+	}
+}
 
-		if done {
-			return matched
+// readFragment appends the header block fragment of a HEADERS or
+// CONTINUATION frame to the block. It fails if the block would grow beyond
+// maxHTTP2HeaderBlock. The fragment is accounted for in the sniff memory of
+// the mux, if r is the sniffed connection, until st is released.
+func (st *http2MatchState) readFragment(r io.Reader, length int, typ http2.FrameType, flags http2.Flags) bool {
+	start := len(st.block)
+	if start+length > maxHTTP2HeaderBlock {
+		return false
+	}
+	if br, ok := r.(*bufferedReader); ok && br.mem != nil {
+		st.mem = br.mem
+		st.held += int64(length)
+		st.mem.add(int64(length))
+	}
+	// append grows the block geometrically across fragments.
+	st.block = append(st.block[:start], make([]byte, length)...)
+	if _, err := io.ReadFull(r, st.block[start:]); err != nil {
+		return false
+	}
+	if typ == http2.FrameContinuation {
+		return true
+	}
+
+	frag := st.block[start:]
+	var padding int
+	if flags.Has(http2.FlagHeadersPadded) {
+		if len(frag) < 1 {
+			return false
+		}
+		padding = int(frag[0])
+		frag = frag[1:]
+	}
+	if flags.Has(http2.FlagHeadersPriority) {
+		if len(frag) < 5 {
+			return false
+		}
+		frag = frag[5:]
+	}
+	if padding > len(frag) {
+		return false
+	}
+	frag = frag[:len(frag)-padding]
+	st.block = st.block[:start+copy(st.block[start:], frag)]
+	return true
+}
+
+// discard reads and drops n bytes from r.
+func (st *http2MatchState) discard(r io.Reader, n int) bool {
+	for n > 0 {
+		b := st.skip[:]
+		if n < len(b) {
+			b = b[:n]
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return false
 		}
+		n -= len(b)
 	}
+	return true
 }
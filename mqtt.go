@@ -0,0 +1,81 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+)
+
+// The MQTT protocol levels, as sent in CONNECT packets.
+const (
+	MQTT31  = 3
+	MQTT311 = 4
+	MQTT5   = 5
+)
+
+// MQTT matches the MQTT connections by decoding the fixed header, the
+// protocol name and the protocol level of the CONNECT packet clients send
+// first. If versions are passed, only the clients of these protocol levels
+// are matched, e.g., MQTT(MQTT5); otherwise MQTT 3.1, 3.1.1 and 5.0 are.
+func MQTT(versions ...byte) Matcher {
+	if len(versions) == 0 {
+		versions = []byte{MQTT31, MQTT311, MQTT5}
+	}
+	return func(r io.Reader) bool {
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil || b[0] != 0x10 {
+			return false
+		}
+		// The remaining length, a variable byte integer of up to 4 bytes.
+		for i := 0; ; i++ {
+			if i == 4 {
+				return false
+			}
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return false
+			}
+			if b[0]&0x80 == 0 {
+				break
+			}
+		}
+
+		// The protocol name, "MQTT" or "MQIsdp" for MQTT 3.1, followed by
+		// the protocol level.
+		var hdr [2 + 6 + 1]byte
+		if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+			return false
+		}
+		n := int(hdr[0])<<8 | int(hdr[1])
+		if n != 4 && n != 6 {
+			return false
+		}
+		if _, err := io.ReadFull(r, hdr[2:2+n+1]); err != nil {
+			return false
+		}
+		name, level := string(hdr[2:2+n]), hdr[2+n]
+		switch {
+		case name == "MQTT" && (level == MQTT311 || level == MQTT5):
+		case name == "MQIsdp" && level == MQTT31:
+		default:
+			return false
+		}
+		for _, v := range versions {
+			if v == level {
+				return true
+			}
+		}
+		return false
+	}
+}
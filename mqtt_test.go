@@ -0,0 +1,58 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMQTT(t *testing.T) {
+	const (
+		connect31  = "\x10\x1a\x00\x06MQIsdp\x03\x02\x00\x3c\x00\x0cclient-31abc"
+		connect311 = "\x10\x12\x00\x04MQTT\x04\x02\x00\x3c\x00\x06client"
+		connect5   = "\x10\x13\x00\x04MQTT\x05\x02\x00\x3c\x00\x00\x06client"
+	)
+	for _, test := range []struct {
+		packet           string
+		any, v5, v31only bool
+	}{
+		{connect31, true, false, true},
+		{connect311, true, false, false},
+		{connect5, true, true, false},
+		// A remaining length of two bytes.
+		{"\x10\x80\x01\x00\x04MQTT\x05", true, true, false},
+		{"\x10\x80\x80\x80\x80\x01\x00\x04MQTT\x05", false, false, false},
+		{"\x10\x12\x00\x04MQTT\x03", false, false, false},
+		{"\x10\x12\x00\x06MQIsdp\x04", false, false, false},
+		{"\x10\x12\x00\x04HTTP\x04", false, false, false},
+		{"\x20\x02\x00\x00", false, false, false},
+		{"GET / HTTP/1.1\r\n\r\n", false, false, false},
+	} {
+		for _, m := range []struct {
+			name  string
+			m     Matcher
+			match bool
+		}{
+			{"MQTT()", MQTT(), test.any},
+			{"MQTT(MQTT5)", MQTT(MQTT5), test.v5},
+			{"MQTT(MQTT31)", MQTT(MQTT31), test.v31only},
+		} {
+			if got := m.m(strings.NewReader(test.packet)); got != m.match {
+				t.Errorf("%q: %s: want=%v got=%v", test.packet, m.name, m.match, got)
+			}
+		}
+	}
+}
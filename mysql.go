@@ -0,0 +1,153 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// The capability flags of the MySQL handshake.
+const (
+	mysqlClientLongPassword     = 0x00000001
+	mysqlClientFoundRows        = 0x00000002
+	mysqlClientLongFlag         = 0x00000004
+	mysqlClientConnectWithDB    = 0x00000008
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientTransactions     = 0x00002000
+	mysqlClientSecureConnection = 0x00008000
+	mysqlClientPluginAuth       = 0x00080000
+
+	mysqlCapabilities = mysqlClientLongPassword | mysqlClientFoundRows |
+		mysqlClientLongFlag | mysqlClientConnectWithDB |
+		mysqlClientProtocol41 | mysqlClientTransactions |
+		mysqlClientSecureConnection | mysqlClientPluginAuth
+)
+
+const (
+	mysqlAuthPlugin = "mysql_native_password"
+	// mysqlMaxResponseLen is the maximum length of a HandshakeResponse41
+	// payload.
+	mysqlMaxResponseLen = 4096
+	// mysqlResponseFixedLen is the length of the fixed fields of a
+	// HandshakeResponse41: the capabilities, the max packet size, the
+	// character set and the filler.
+	mysqlResponseFixedLen = 4 + 4 + 1 + 23
+)
+
+// MySQL returns a MatchWriter matching the connections of MySQL and MariaDB
+// clients. MySQL is a protocol in which the server speaks first, so, as
+// ServerFirst does, it sends an initial handshake (HandshakeV10) to the
+// clients that sent nothing for delay, announcing serverVersion and
+// mysql_native_password authentication, and matches the ones that answer
+// with a valid HandshakeResponse41.
+//
+// Unlike with ServerFirst, the handshake carries a random challenge, so the
+// server of the listener must not send its own: it reads the response of the
+// client right away and checks it against the challenge of the handshake
+// returned by MuxConn.Greeting, as MySQL proxies can do. The handshake does
+// not offer TLS, so clients requiring it are not matched.
+func MySQL(delay time.Duration, serverVersion string) MatchWriter {
+	g := &greeter{
+		delay: delay,
+		key:   "mysql",
+		greeting: func(muc *MuxConn) []byte {
+			return mysqlHandshake(serverVersion, uint32(muc.ID()))
+		},
+	}
+	return g.matchWriter(mysqlHandshakeResponse)
+}
+
+// mysqlChallenge fills b with random bytes. Like MySQL, it redraws the NULs,
+// which would end the challenge, and the '$'s, which delimit the fields of
+// the password hashes of caching_sha2_password.
+func mysqlChallenge(b []byte) {
+	_, _ = rand.Read(b)
+	var c [1]byte
+	for i := range b {
+		for b[i] == 0 || b[i] == '$' {
+			if _, err := rand.Read(c[:]); err != nil {
+				c[0] = 1
+			}
+			b[i] = c[0]
+		}
+	}
+}
+
+// mysqlHandshake returns a HandshakeV10 packet with a random challenge.
+func mysqlHandshake(serverVersion string, connID uint32) []byte {
+	var challenge [20]byte
+	mysqlChallenge(challenge[:])
+
+	caps := uint32(mysqlCapabilities)
+	p := make([]byte, 4, 128)
+	p = append(p, 0x0a)
+	p = append(p, serverVersion...)
+	p = append(p, 0)
+	p = appendUint32LE(p, connID)
+	p = append(p, challenge[:8]...)
+	p = append(p, 0)
+	p = append(p, byte(caps), byte(caps>>8))
+	// utf8mb4_general_ci, and SERVER_STATUS_AUTOCOMMIT.
+	p = append(p, 45, 0x02, 0x00)
+	p = append(p, byte(caps>>16), byte(caps>>24))
+	p = append(p, byte(len(challenge)+1))
+	p = append(p, make([]byte, 10)...)
+	p = append(p, challenge[8:]...)
+	p = append(p, 0)
+	p = append(p, mysqlAuthPlugin...)
+	p = append(p, 0)
+
+	n := len(p) - 4
+	p[0], p[1], p[2], p[3] = byte(n), byte(n>>8), byte(n>>16), 0
+	return p
+}
+
+func appendUint32LE(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// mysqlHandshakeResponse matches a HandshakeResponse41 packet.
+func mysqlHandshakeResponse(r io.Reader) bool {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil || hdr[3] != 1 {
+		return false
+	}
+	n := int(hdr[0]) | int(hdr[1])<<8 | int(hdr[2])<<16
+	if n <= mysqlResponseFixedLen || n > mysqlMaxResponseLen {
+		return false
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return false
+	}
+	if binary.LittleEndian.Uint32(p)&mysqlClientProtocol41 == 0 {
+		return false
+	}
+	for _, b := range p[9:mysqlResponseFixedLen] {
+		if b != 0 {
+			return false
+		}
+	}
+	// The user name is NUL terminated.
+	for _, b := range p[mysqlResponseFixedLen:] {
+		if b == 0 {
+			return true
+		}
+	}
+	return false
+}
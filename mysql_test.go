@@ -0,0 +1,133 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testMySQLResponse returns a HandshakeResponse41 packet of user.
+func testMySQLResponse(caps uint32, user string) []byte {
+	p := appendUint32LE(make([]byte, 4), caps)
+	p = appendUint32LE(p, 1<<24)
+	p = append(p, 45)
+	p = append(p, make([]byte, 23)...)
+	p = append(p, user...)
+	p = append(p, 0)
+	// An empty auth response.
+	p = append(p, 0)
+	n := len(p) - 4
+	p[0], p[1], p[2], p[3] = byte(n), byte(n>>8), byte(n>>16), 1
+	return p
+}
+
+func TestMySQLHandshakeResponse(t *testing.T) {
+	valid := testMySQLResponse(mysqlCapabilities, "root")
+	for _, test := range []struct {
+		name   string
+		packet []byte
+		match  bool
+	}{
+		{"valid", valid, true},
+		{"protocol 3.20", testMySQLResponse(mysqlClientLongPassword, "root"), false},
+		{"sequence", append([]byte{valid[0], valid[1], valid[2], 0}, valid[4:]...), false},
+		{"filler", append(append([]byte(nil), valid[:20]...), append([]byte{1}, valid[21:]...)...), false},
+		{"no user", valid[:len(valid)-2], false},
+		{"http", []byte("GET / HTTP/1.1\r\n\r\n"), false},
+	} {
+		if got := mysqlHandshakeResponse(bytes.NewReader(test.packet)); got != test.match {
+			t.Errorf("%s: want=%v got=%v", test.name, test.match, got)
+		}
+	}
+}
+
+func TestMySQLChallenge(t *testing.T) {
+	var seen [256]bool
+	for i := 0; i < 1000; i++ {
+		var b [20]byte
+		mysqlChallenge(b[:])
+		for _, c := range b {
+			seen[c] = true
+		}
+	}
+	if seen[0] || seen['$'] {
+		t.Error("challenge with a NUL or a '$'")
+	}
+	// The other bytes are all drawn, including the ones with the high bit.
+	for c, ok := range seen {
+		if !ok && c != 0 && c != '$' {
+			t.Errorf("byte %#x never drawn", c)
+		}
+	}
+}
+
+func TestMySQL(t *testing.T) {
+	defer leakCheck(t)()
+	l, cleanup := testListener(t)
+	defer cleanup()
+
+	muxl := New(l)
+	muxl.SetReadTimeout(5 * time.Second)
+	mysqll := muxl.MatchWithWriters(MySQL(50*time.Millisecond, "8.0.36-cmux"))
+	muxl.Match(HTTP2())
+	go safeServe(nil, muxl)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	var hdr [4]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	handshake := make([]byte, int(hdr[0])|int(hdr[1])<<8|int(hdr[2])<<16)
+	if _, err := io.ReadFull(c, handshake); err != nil {
+		t.Fatal(err)
+	}
+	if hdr[3] != 0 || handshake[0] != 0x0a ||
+		!bytes.HasPrefix(handshake[1:], []byte("8.0.36-cmux\x00")) ||
+		!bytes.HasSuffix(handshake, []byte(mysqlAuthPlugin+"\x00")) {
+		t.Fatalf("unexpected handshake: %q", handshake)
+	}
+	resp := testMySQLResponse(mysqlCapabilities, "root")
+	writeAsync(c, string(resp))
+
+	ac, err := mysqll.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ac.Close() }()
+	if g := ac.(*MuxConn).Greeting(); !bytes.Equal(g, append(hdr[:], handshake...)) {
+		t.Errorf("unexpected greeting: %q", g)
+	}
+	b := make([]byte, len(resp))
+	if _, err := io.ReadFull(ac, b); err != nil || !bytes.Equal(b, resp) {
+		t.Errorf("unexpected response: %q, %v", b, err)
+	}
+	// The server writes through: an OK packet.
+	ok := []byte{7, 0, 0, 2, 0, 0, 0, 2, 0, 0, 0}
+	if _, err := ac.Write(ok); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, b[:len(ok)]); err != nil || !bytes.Equal(b[:len(ok)], ok) {
+		t.Errorf("unexpected OK packet: %q, %v", b[:len(ok)], err)
+	}
+	cleanup()
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// maxNetstringDigits is the maximum number of digits of the length of
+	// a netstring, i.e. netstrings are shorter than 1GB.
+	maxNetstringDigits = 9
+	// maxNetstringRead is the maximum length of a netstring whose payload
+	// is read to check its trailing comma.
+	maxNetstringRead = 4096
+)
+
+// Netstring matches the connections starting with a netstring, i.e.
+// "<len>:<payload>,", like the requests of SCGI clients. The length must be
+// a decimal number without leading zeros. The trailing comma is only checked
+// when the payload is at most 4096 bytes long, so that matching does not
+// buffer large payloads.
+func Netstring() Matcher {
+	return func(r io.Reader) bool {
+		var b [1]byte
+		n, digits := 0, 0
+		for {
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return false
+			}
+			c := b[0]
+			if c == ':' {
+				break
+			}
+			if c < '0' || c > '9' || digits == maxNetstringDigits ||
+				(digits == 1 && n == 0) {
+				return false
+			}
+			n = n*10 + int(c-'0')
+			digits++
+		}
+		if digits == 0 {
+			return false
+		}
+		if n > maxNetstringRead {
+			return true
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, int64(n)); err != nil {
+			return false
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return false
+		}
+		return b[0] == ','
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNetstring(t *testing.T) {
+	const scgi = "70:CONTENT_LENGTH\x0027\x00SCGI\x001\x00REQUEST_METHOD\x00POST\x00" +
+		"REQUEST_URI\x00/deepthought\x00,What is the answer to life?"
+	for _, test := range []struct {
+		name  string
+		data  string
+		match bool
+	}{
+		{"scgi", scgi, true},
+		{"empty", "0:,", true},
+		{"long", "5000:" + strings.Repeat("x", 10), true},
+		{"no comma", "3:abc;", false},
+		{"short", "5:abc", false},
+		{"leading zero", "03:abc,", false},
+		{"no length", ":abc,", false},
+		{"too long", "1234567890:", false},
+		{"http", "GET / HTTP/1.1\r\n\r\n", false},
+	} {
+		if got := Netstring()(strings.NewReader(test.data)); got != test.match {
+			t.Errorf("%s: want=%v got=%v", test.name, test.match, got)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"net"
+	"time"
+)
+
+// WithNoBytesHandler hands the connections that sent nothing before the
+// read timeout expired over to h instead of closing them, e.g., to greet
+// the clients of a protocol in which the server speaks first, or to log
+// port scans. h owns the connection, whose read deadline is cleared, and
+// is called on the goroutine that matched it. It takes precedence over
+// MatchNoBytes.
+//
+// The connections closed by their client without sending anything are
+// always closed and reported as ErrNoBytes.
+func WithNoBytesHandler(h func(c net.Conn)) Option {
+	return func(m *cMux) {
+		m.noBytesHandler = h
+	}
+}
+
+func (m *cMux) MatchNoBytes() net.Listener {
+	if m.noBytes < 0 {
+		m.MatchWithWritersNamed("")
+		m.noBytes = len(m.sls) - 1
+	}
+	return m.sls[m.noBytes].l
+}
+
+// handleNoBytes handles muc, which sent nothing before failing to be read
+// from.
+func (m *cMux) handleNoBytes(muc *MuxConn, donec <-chan struct{}) {
+	ne, ok := muc.buf.sniffErr.(net.Error)
+	err := ErrNoBytes{
+		connError: connError{c: muc.Conn, id: muc.info.ID},
+		timeout:   ok && ne.Timeout(),
+	}
+	if err.timeout {
+		if h := m.noBytesHandler; h != nil {
+			muc.buf.release()
+			muc.logClose(err)
+			_ = muc.Conn.SetReadDeadline(time.Time{})
+			h(muc.Conn)
+			return
+		}
+		if m.noBytes >= 0 {
+			m.deliver(muc, m.noBytes, donec)
+			return
+		}
+	}
+	m.reject(muc, err)
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestErrNoBytes(t *testing.T) {
+	defer leakCheck(t)()
+
+	l := newChanListener()
+	defer close(l.connCh)
+	muxl := New(l)
+	muxl.SetReadTimeout(50 * time.Millisecond)
+	muxl.MatchUnmatched()
+	muxl.Match(PrefixMatcher("hello"))
+	errc := serveErrors(t, muxl)
+
+	// A connection closed without sending anything.
+	w, r := net.Pipe()
+	_ = w.Close()
+	l.connCh <- r
+	err := <-errc
+	if e, ok := err.(ErrNoBytes); !ok || e.Timeout() || e.ConnID() == 0 {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// A connection sending nothing before the read timeout.
+	w, r = net.Pipe()
+	defer func() { _ = w.Close() }()
+	l.connCh <- r
+	err = <-errc
+	if e, ok := err.(ErrNoBytes); !ok || !e.Timeout() {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMatchNoBytes(t *testing.T) {
+	defer leakCheck(t)()
+
+	l := newChanListener()
+	defer close(l.connCh)
+	muxl := New(l)
+	muxl.SetReadTimeout(50 * time.Millisecond)
+	muxl.Match(PrefixMatcher("hello"))
+	serverFirst := muxl.MatchNoBytes()
+	if muxl.MatchNoBytes() != serverFirst {
+		t.Error("MatchNoBytes returned another listener")
+	}
+	serveErrors(t, muxl)
+
+	w, r := net.Pipe()
+	defer func() { _ = w.Close() }()
+	l.connCh <- r
+	c, err := serverFirst.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	// The server speaks first.
+	writeAsync(c, "220 ready\r\n")
+	b := make([]byte, 11)
+	if _, err := io.ReadFull(w, b); err != nil {
+		t.Fatal(err)
+	}
+	writeAsync(w, "HELO")
+	b = make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "HELO" {
+		t.Errorf("unexpected read: %q, %v", b, err)
+	}
+}
+
+func TestNoBytesHandler(t *testing.T) {
+	defer leakCheck(t)()
+
+	l := newChanListener()
+	defer close(l.connCh)
+	handled := make(chan net.Conn, 1)
+	muxl := New(l, WithNoBytesHandler(func(c net.Conn) { handled <- c }))
+	muxl.SetReadTimeout(50 * time.Millisecond)
+	muxl.Match(PrefixMatcher("hello"))
+	muxl.MatchNoBytes()
+	serveErrors(t, muxl)
+
+	w, r := net.Pipe()
+	defer func() { _ = w.Close() }()
+	l.connCh <- r
+	if c := <-handled; c != r {
+		t.Errorf("unexpected connection: %v", c)
+	}
+	_ = r.Close()
+}
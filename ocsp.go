@@ -0,0 +1,187 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// ocspDefaultRefresh is the refresh interval of the staples for which
+	// the fetcher returns no refresh time.
+	ocspDefaultRefresh = time.Hour
+	// ocspRetry is the interval between the attempts to refresh a staple
+	// after a failed one.
+	ocspRetry = time.Minute
+)
+
+// OCSPFetcher fetches the OCSP response of cert, e.g. from the responder
+// named in its leaf certificate with golang.org/x/crypto/ocsp. It returns
+// the DER-encoded response, when to fetch it again, usually halfway to its
+// NextUpdate, and its NextUpdate, after which the response is not served
+// anymore. A zero nextUpdate means that the response does not expire.
+type OCSPFetcher func(cert *tls.Certificate) (staple []byte, refresh, nextUpdate time.Time, err error)
+
+// OCSPStapler staples OCSP responses to the certificates of a TLS server,
+// e.g. of a TLSStage, and keeps them fresh:
+//
+//	s := cmux.NewOCSPStapler(fetch, nil)
+//	if err := s.Staple(cert); err != nil {
+//		...
+//	}
+//	config.GetCertificate = s.GetCertificate(cmux.CertificatesBySNI(certs, cert))
+type OCSPStapler struct {
+	fetch OCSPFetcher
+	errh  func(error)
+
+	mu sync.RWMutex
+	// stapled maps the leaf certificates passed to Staple to their current
+	// staple.
+	stapled map[string]*ocspStaple
+	donec   chan struct{}
+	once    sync.Once
+}
+
+// ocspStaple is the current staple of a certificate.
+type ocspStaple struct {
+	// cert is a copy of the certificate with the staple.
+	cert       *tls.Certificate
+	nextUpdate time.Time
+}
+
+// NewOCSPStapler returns an OCSPStapler fetching the staples with fetch. The
+// errors of the refreshes are passed to errh, if it is not nil, and the
+// previous staples are served until a refresh succeeds or they reach their
+// NextUpdate.
+func NewOCSPStapler(fetch OCSPFetcher, errh func(error)) *OCSPStapler {
+	return &OCSPStapler{
+		fetch:   fetch,
+		errh:    errh,
+		stapled: make(map[string]*ocspStaple),
+		donec:   make(chan struct{}),
+	}
+}
+
+// Staple fetches the staple of cert, and refreshes it until the stapler is
+// closed. It returns the error of the first fetch, in which case cert is not
+// stapled. cert itself is not modified: GetCertificate returns a copy of it
+// with the staple.
+//
+// The staples are kept by leaf certificate: stapling a certificate already
+// stapled, even from another *tls.Certificate, does nothing.
+func (s *OCSPStapler) Staple(cert *tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errNoOCSPCertificate
+	}
+	key := string(cert.Certificate[0])
+	if s.isStapled(key) {
+		return nil
+	}
+	staple, refresh, err := s.refresh(cert)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	_, ok := s.stapled[key]
+	if !ok {
+		s.stapled[key] = staple
+	}
+	s.mu.Unlock()
+	if ok {
+		// Stapled concurrently.
+		return nil
+	}
+
+	go func() {
+		t := time.NewTimer(time.Until(refresh))
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				staple, next, err := s.refresh(cert)
+				if err != nil {
+					if s.errh != nil {
+						s.errh(err)
+					}
+					next = time.Now().Add(ocspRetry)
+				} else {
+					s.mu.Lock()
+					s.stapled[key] = staple
+					s.mu.Unlock()
+				}
+				t.Reset(time.Until(next))
+			case <-s.donec:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+var errNoOCSPCertificate = errors.New("mux: no certificate to staple")
+
+func (s *OCSPStapler) isStapled(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.stapled[key]
+	return ok
+}
+
+// refresh fetches the staple of cert, and returns when to refresh it.
+func (s *OCSPStapler) refresh(cert *tls.Certificate) (*ocspStaple, time.Time, error) {
+	staple, refresh, nextUpdate, err := s.fetch(cert)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !refresh.After(time.Now()) {
+		refresh = time.Now().Add(ocspDefaultRefresh)
+	}
+	c := *cert
+	c.OCSPStaple = staple
+	return &ocspStaple{cert: &c, nextUpdate: nextUpdate}, refresh, nil
+}
+
+// GetCertificate wraps a tls.Config.GetCertificate callback, e.g. one of
+// CertificatesBySNI, so that the certificates it returns carry their
+// current staple. The certificates that were not passed to Staple, or whose
+// staple expired, are returned as is.
+func (s *OCSPStapler) GetCertificate(get func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := get(hello)
+		if err != nil || cert == nil {
+			return cert, err
+		}
+		if len(cert.Certificate) == 0 {
+			return cert, nil
+		}
+		s.mu.RLock()
+		staple, ok := s.stapled[string(cert.Certificate[0])]
+		s.mu.RUnlock()
+		if !ok || !staple.nextUpdate.IsZero() && time.Now().After(staple.nextUpdate) {
+			return cert, nil
+		}
+		return staple.cert, nil
+	}
+}
+
+// Close stops refreshing the staples. The current staples are still
+// served.
+func (s *OCSPStapler) Close() error {
+	s.once.Do(func() { close(s.donec) })
+	return nil
+}
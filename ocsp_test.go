@@ -0,0 +1,128 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOCSPStapler(t *testing.T) {
+	cert := testCertificate(t, "example.com")
+	var fetches int32
+	s := NewOCSPStapler(func(c *tls.Certificate) ([]byte, time.Time, time.Time, error) {
+		if c != cert {
+			return nil, time.Time{}, time.Time{}, errors.New("unexpected certificate")
+		}
+		n := atomic.AddInt32(&fetches, 1)
+		return []byte(fmt.Sprintf("staple %d", n)), time.Now().Add(50 * time.Millisecond),
+			time.Time{}, nil
+	}, nil)
+	defer func() { _ = s.Close() }()
+	if err := s.Staple(cert); err != nil {
+		t.Fatal(err)
+	}
+	// Stapling the certificate again, even a copy of it, does nothing.
+	certCopy := *cert
+	if err := s.Staple(&certCopy); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("unexpected number of fetches: %d", n)
+	}
+	config := &tls.Config{
+		GetCertificate: s.GetCertificate(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}),
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	staple := func(config *tls.Config) string {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = sc.Close() }()
+		go func() { _, _ = TLSStage(config)(newPipelineConn(sc)) }()
+		tc := tls.Client(c, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+		defer func() { _ = tc.Close() }()
+		if err := tc.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		return string(tc.OCSPResponse())
+	}
+
+	if st := staple(config); st != "staple 1" {
+		t.Errorf("unexpected staple: %q", st)
+	}
+	if cert.OCSPStaple != nil {
+		t.Error("the certificate was modified")
+	}
+	// The staple is refreshed.
+	deadline := time.Now().Add(5 * time.Second)
+	for staple(config) == "staple 1" {
+		if time.Now().After(deadline) {
+			t.Fatal("the staple was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A staple that cannot be refreshed is not served after its NextUpdate.
+	var expiring int32
+	exp := NewOCSPStapler(func(*tls.Certificate) ([]byte, time.Time, time.Time, error) {
+		if atomic.AddInt32(&expiring, 1) > 1 {
+			return nil, time.Time{}, time.Time{}, errors.New("responder down")
+		}
+		return []byte("expiring"), time.Now().Add(10 * time.Millisecond),
+			time.Now().Add(200 * time.Millisecond), nil
+	}, nil)
+	defer func() { _ = exp.Close() }()
+	if err := exp.Staple(cert); err != nil {
+		t.Fatal(err)
+	}
+	config = &tls.Config{
+		GetCertificate: exp.GetCertificate(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}),
+	}
+	if st := staple(config); st != "expiring" {
+		t.Errorf("unexpected staple: %q", st)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if st := staple(config); st != "" {
+		t.Errorf("expired staple served: %q", st)
+	}
+
+	fail := NewOCSPStapler(func(*tls.Certificate) ([]byte, time.Time, time.Time, error) {
+		return nil, time.Time{}, time.Time{}, errors.New("responder down")
+	}, nil)
+	defer func() { _ = fail.Close() }()
+	if err := fail.Staple(cert); err == nil {
+		t.Error("no error for a failed fetch")
+	}
+}
@@ -17,13 +17,19 @@ package cmux
 import (
 	"bytes"
 	"io"
+	"sync"
 )
 
 // patriciaTree is a simple patricia tree that handles []byte instead of string
 // and cannot be changed after instantiation.
+//
+// Matching is safe for concurrent use and does not serialize callers: the read
+// buffers come from a sync.Pool, which keeps per-P caches.
 type patriciaTree struct {
 	root     *ptNode
+	prefixes [][]byte
 	maxDepth int // max depth of the tree.
+	bufs     sync.Pool
 }
 
 func newPatriciaTree(bs ...[]byte) *patriciaTree {
@@ -33,10 +39,16 @@ func newPatriciaTree(bs ...[]byte) *patriciaTree {
 			max = len(b)
 		}
 	}
-	return &patriciaTree{
+	t := &patriciaTree{
 		root:     newNode(bs),
+		prefixes: bs,
 		maxDepth: max + 1,
 	}
+	t.bufs.New = func() interface{} {
+		b := make([]byte, t.maxDepth)
+		return &b
+	}
+	return t
 }
 
 func newPatriciaTreeString(strs ...string) *patriciaTree {
@@ -48,15 +60,48 @@ func newPatriciaTreeString(strs ...string) *patriciaTree {
 }
 
 func (t *patriciaTree) matchPrefix(r io.Reader) bool {
-	buf := make([]byte, t.maxDepth)
-	n, _ := io.ReadFull(r, buf)
-	return t.root.match(buf[:n], true)
+	return t.read(r, true)
 }
 
 func (t *patriciaTree) match(r io.Reader) bool {
-	buf := make([]byte, t.maxDepth)
-	n, _ := io.ReadFull(r, buf)
-	return t.root.match(buf[:n], false)
+	return t.read(r, false)
+}
+
+func (t *patriciaTree) read(r io.Reader, prefix bool) bool {
+	if p, ok := r.(*prefixProbe); ok {
+		p.tree = t
+		return false
+	}
+	if br, ok := r.(*bufferedReader); ok && br.sniffing {
+		// Match against the sniffed bytes in place.
+		if prefix {
+			return t.root.match(br.next(t.prefixLen(br)), true)
+		}
+		return t.root.match(br.next(t.maxDepth), false)
+	}
+
+	bp := t.bufs.Get().(*[]byte)
+	defer t.bufs.Put(bp)
+	n, _ := io.ReadFull(r, *bp)
+	return t.root.match((*bp)[:n], prefix)
+}
+
+// prefixLen returns the number of sniffed bytes of br that decide whether a
+// prefix of the tree matches. It only waits for more bytes while they can
+// still make a prefix match, so that a short message of another protocol,
+// e.g., a SOCKS greeting, does not wait for bytes that never come.
+func (t *patriciaTree) prefixLen(br *bufferedReader) int {
+	n := br.bufferSize - br.bufferRead
+	if n < 1 {
+		n = 1
+	}
+	for ; n < t.maxDepth; n++ {
+		b := br.peek(n)
+		if len(b) < n || t.root.match(b, true) || !t.root.viable(b) {
+			return len(b)
+		}
+	}
+	return t.maxDepth
 }
 
 type ptNode struct {
@@ -146,6 +191,20 @@ func splitPrefix(bss [][]byte) (prefix []byte, rest [][]byte) {
 	return prefix, rest
 }
 
+// viable returns whether b is a prefix of one of the strings of n, i.e.,
+// whether more bytes may still make b match.
+func (n *ptNode) viable(b []byte) bool {
+	l := len(n.prefix)
+	if l >= len(b) {
+		return bytes.HasPrefix(n.prefix, b)
+	}
+	if !bytes.Equal(b[:l], n.prefix) {
+		return false
+	}
+	next, ok := n.next[b[l]]
+	return ok && next.viable(b[l+1:])
+}
+
 func (n *ptNode) match(b []byte, prefix bool) bool {
 	l := len(n.prefix)
 	if l > 0 {
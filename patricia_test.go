@@ -16,6 +16,7 @@ package cmux
 
 import (
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -54,3 +55,34 @@ func TestPatriciaNonOverlapping(t *testing.T) {
 func TestPatriciaOverlapping(t *testing.T) {
 	testPTree(t, "foo", "far", "farther", "boo", "ba", "bar")
 }
+
+func TestPatriciaConcurrent(t *testing.T) {
+	pt := newPatriciaTreeString("foo", "far", "farther", "boo", "ba", "bar")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if !pt.matchPrefix(strings.NewReader("farther away")) {
+					t.Error("farther away is not matched as a prefix")
+					return
+				}
+				if pt.matchPrefix(strings.NewReader("bo")) {
+					t.Error("bo matches")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkPatriciaParallel(b *testing.B) {
+	pt := newPatriciaTreeString(defaultHTTPMethods...)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pt.matchPrefix(strings.NewReader("OPTIONS * HTTP/1.1"))
+		}
+	})
+}
@@ -0,0 +1,282 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stage is a step of a Pipeline. It is passed the connection produced by the
+// previous stage and returns the connection handed to the next one, usually c
+// itself or a wrapper of it. Bytes a stage peeks at are not consumed, so the
+// next stage reads them again unless the stage discards them. A stage that
+// returns an error rejects the connection, which is then closed.
+type Stage func(c *PipelineConn) (net.Conn, error)
+
+// PipelineConn is the connection passed to a Stage. Its reads are buffered,
+// so that a stage can look at the upcoming bytes before deciding what to do
+// with them.
+type PipelineConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func newPipelineConn(c net.Conn) *PipelineConn {
+	if pc, ok := c.(*PipelineConn); ok {
+		return pc
+	}
+	return &PipelineConn{Conn: c, br: bufio.NewReader(c)}
+}
+
+// Read reads the buffered bytes first, then from the connection.
+func (c *PipelineConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+// Peek returns the next n bytes without consuming them. n must not exceed
+// 4096 bytes.
+func (c *PipelineConn) Peek(n int) ([]byte, error) {
+	return c.br.Peek(n)
+}
+
+// Discard consumes the next n bytes.
+func (c *PipelineConn) Discard(n int) (int, error) {
+	return c.br.Discard(n)
+}
+
+// NetConn returns the wrapped connection. Reads on the returned connection
+// bypass the buffered bytes.
+func (c *PipelineConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// TLSStage returns a Stage that terminates TLS with config. The handshake is
+// complete when the next stage is called, so the connection state, e.g. the
+// negotiated protocol, is available to it.
+//
+// To serve several domains, set the GetCertificate or GetConfigForClient
+// callback of config, e.g. to CertificatesBySNI or ConfigsBySNI.
+func TLSStage(config *tls.Config) Stage {
+	return func(c *PipelineConn) (net.Conn, error) {
+		tc := tls.Server(c, config)
+		if err := tc.Handshake(); err != nil {
+			return nil, err
+		}
+		return tc, nil
+	}
+}
+
+// Pipeline processes the connections of a listener through a sequence of
+// stages, declared in order, before they are matched by a CMux. It replaces
+// hand-built chains of listener wrappers and recursive muxes:
+//
+//	p := cmux.NewPipeline(l).Then(cmux.ProxyHeaderStage(), cmux.TLSStage(config))
+//	m := p.Mux()
+//	grpcl := m.Match(cmux.HTTP2())
+//	httpl := m.Match(cmux.Any())
+//
+// The stages of different connections run concurrently, so a slow client
+// does not hold up the others, up to a limit set with SetMaxConcurrency.
+type Pipeline struct {
+	root   net.Listener
+	stages []Stage
+	// timeout is the deadline of the stages, if timeoutSet. Otherwise, it
+	// is the read timeout of mux, if any.
+	timeout    time.Duration
+	timeoutSet bool
+	mux        *cMux
+	// slots has a value for each connection going through the stages, if
+	// the number of such connections is limited.
+	slots chan struct{}
+	errh  ErrorHandler
+
+	once  sync.Once
+	connc chan acceptResult
+	donec chan struct{}
+	close sync.Once
+	// err is the error that stopped the root listener. It is set before
+	// failc is closed.
+	err   error
+	failc chan struct{}
+}
+
+type acceptResult struct {
+	c   net.Conn
+	err error
+}
+
+// defaultPipelineConcurrency is the default maximum number of connections
+// going through the stages of a Pipeline at the same time.
+const defaultPipelineConcurrency = 1024
+
+// NewPipeline returns a Pipeline for the connections of l, with no stages.
+func NewPipeline(l net.Listener) *Pipeline {
+	return &Pipeline{
+		root:  l,
+		slots: make(chan struct{}, defaultPipelineConcurrency),
+		errh:  func(_ error) bool { return true },
+		connc: make(chan acceptResult),
+		donec: make(chan struct{}),
+		failc: make(chan struct{}),
+	}
+}
+
+// Then appends stages to the pipeline. It must be called before the pipeline
+// starts accepting connections.
+func (p *Pipeline) Then(stages ...Stage) *Pipeline {
+	p.stages = append(p.stages, stages...)
+	return p
+}
+
+// SetTimeout sets a deadline of d for all the stages of a connection. Zero
+// means no deadline. By default, the deadline is the read timeout of the
+// CMux returned by Mux, if any, and there is no deadline otherwise.
+func (p *Pipeline) SetTimeout(d time.Duration) {
+	p.timeout = d
+	p.timeoutSet = true
+}
+
+// SetMaxConcurrency limits the number of connections going through the
+// stages at the same time to n. While n connections are, the pipeline stops
+// accepting connections, leaving them in the backlog of the root listener.
+// The default is 1024, and n <= 0 means no limit. It must be called before
+// the pipeline starts accepting connections.
+func (p *Pipeline) SetMaxConcurrency(n int) {
+	p.slots = nil
+	if n > 0 {
+		p.slots = make(chan struct{}, n)
+	}
+}
+
+// HandleError registers an error handler for the errors of the stages. The
+// return value of h is ignored: the connection is always closed.
+func (p *Pipeline) HandleError(h ErrorHandler) {
+	p.errh = h
+}
+
+// Mux returns a CMux matching the connections produced by the last stage.
+func (p *Pipeline) Mux(opts ...Option) CMux {
+	m := New(p, opts...)
+	p.mux = m.(*cMux)
+	return m
+}
+
+// Accept waits for and returns the next connection produced by the last
+// stage. Errors of the root listener are returned as is.
+func (p *Pipeline) Accept() (net.Conn, error) {
+	p.once.Do(func() { go p.serve() })
+	select {
+	case r := <-p.connc:
+		return r.c, r.err
+	case <-p.failc:
+		return nil, p.err
+	case <-p.donec:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close closes the root listener. Connections still going through the
+// stages are closed once they come out.
+func (p *Pipeline) Close() error {
+	p.close.Do(func() { close(p.donec) })
+	return p.root.Close()
+}
+
+// Addr returns the address of the root listener.
+func (p *Pipeline) Addr() net.Addr {
+	return p.root.Addr()
+}
+
+func (p *Pipeline) serve() {
+	for {
+		if p.slots != nil {
+			select {
+			case p.slots <- struct{}{}:
+			case <-p.donec:
+				return
+			}
+		}
+		c, err := p.root.Accept()
+		if err != nil {
+			p.release()
+			if !isTemporary(err) {
+				p.err = err
+				close(p.failc)
+				return
+			}
+			if !p.deliver(acceptResult{err: err}) {
+				return
+			}
+			continue
+		}
+		go p.process(c)
+	}
+}
+
+func (p *Pipeline) process(c net.Conn) {
+	out, ok := p.runStages(c)
+	p.release()
+	if ok && !p.deliver(acceptResult{c: out}) {
+		_ = out.Close()
+	}
+}
+
+// runStages passes c through the stages, and returns the connection produced
+// by the last one.
+func (p *Pipeline) runStages(c net.Conn) (net.Conn, bool) {
+	timeout := p.timeout
+	if !p.timeoutSet && p.mux != nil {
+		timeout = p.mux.readTimeout
+	}
+	if timeout > 0 {
+		_ = c.SetDeadline(time.Now().Add(timeout))
+	}
+	out := c
+	for _, s := range p.stages {
+		next, err := s(newPipelineConn(out))
+		if err != nil {
+			_ = c.Close()
+			_ = p.errh(err)
+			return nil, false
+		}
+		out = next
+	}
+	if timeout > 0 {
+		_ = c.SetDeadline(time.Time{})
+	}
+	return out, true
+}
+
+// release frees the slot of a connection that went through the stages.
+func (p *Pipeline) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+func (p *Pipeline) deliver(r acceptResult) bool {
+	select {
+	case p.connc <- r:
+		return true
+	case <-p.failc:
+		return false
+	case <-p.donec:
+		return false
+	}
+}
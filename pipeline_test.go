@@ -0,0 +1,206 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	defer leakCheck(t)()
+	generateTLSCert(t)
+	defer cleanupTLSCert(t)
+	cert, err := tls.LoadX509KeyPair("cert.pem", "key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stageErrs := make(chan error, 1)
+	p := NewPipeline(l).Then(
+		ProxyHeaderStage(),
+		TLSStage(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	)
+	p.SetTimeout(5 * time.Second)
+	p.HandleError(func(err error) bool {
+		stageErrs <- err
+		return true
+	})
+	m := p.Mux()
+	httpl := m.Match(HTTP1Fast())
+	errCh := make(chan error, 1)
+	go func() { errCh <- m.Serve() }()
+	defer func() {
+		_ = p.Close()
+		if err := <-errCh; err != ErrListenerClosed {
+			t.Error(err)
+		}
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	go func() {
+		if _, err := io.WriteString(c, "PROXY TCP4 192.0.2.1 198.51.100.1 5000 443\r\n"); err != nil {
+			return
+		}
+		tc := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+		_, _ = io.WriteString(tc, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	}()
+
+	hc, err := httpl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = hc.Close() }()
+	if a := hc.RemoteAddr().String(); a != "192.0.2.1:5000" {
+		t.Errorf("unexpected remote address: %s", a)
+	}
+	if _, ok := hc.(*TLSMuxConn); !ok {
+		t.Errorf("unexpected conn: %T", hc)
+	}
+	req, err := http.ReadRequest(bufio.NewReader(hc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Host != "example.com" {
+		t.Errorf("unexpected host: %q", req.Host)
+	}
+
+	// A connection failing a stage is reported and closed.
+	c2, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c2.Close() }()
+	writeAsync(c2, "GET / HTTP/1.1\r\n\r\n")
+	if err := <-stageErrs; err != ErrNoProxyHeader {
+		t.Errorf("unexpected stage error: %v", err)
+	}
+	if _, err := c2.Read(make([]byte, 1)); err == nil {
+		t.Error("connection failing a stage was not closed")
+	}
+}
+
+func TestPipelineRootError(t *testing.T) {
+	l := newChanListener()
+	p := NewPipeline(l)
+	close(l.connCh)
+	if _, err := p.Accept(); err == nil || !strings.Contains(err.Error(), "use of closed") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// The error sticks.
+	if _, err := p.Accept(); err == nil || !strings.Contains(err.Error(), "use of closed") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPipelineMuxTimeout(t *testing.T) {
+	defer leakCheck(t)()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stageErrs := make(chan error, 1)
+	// The stage waits for bytes the client never sends.
+	p := NewPipeline(l).Then(func(c *PipelineConn) (net.Conn, error) {
+		_, err := c.Peek(1)
+		return c, err
+	})
+	p.HandleError(func(err error) bool {
+		stageErrs <- err
+		return true
+	})
+	m := p.Mux()
+	m.SetReadTimeout(50 * time.Millisecond)
+	m.Match(Any())
+	errCh := make(chan error, 1)
+	go func() { errCh <- m.Serve() }()
+	defer func() {
+		_ = p.Close()
+		if err := <-errCh; err != ErrListenerClosed {
+			t.Error(err)
+		}
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	select {
+	case err := <-stageErrs:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("unexpected stage error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stage did not time out")
+	}
+}
+
+func TestPipelineMaxConcurrency(t *testing.T) {
+	defer leakCheck(t)()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	p := NewPipeline(l).Then(func(c *PipelineConn) (net.Conn, error) {
+		entered <- struct{}{}
+		<-release
+		return c, nil
+	})
+	p.SetMaxConcurrency(1)
+	go func() {
+		for {
+			c, err := p.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	defer func() { _ = p.Close() }()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = c.Close() }()
+	}
+	<-entered
+	select {
+	case <-entered:
+		t.Fatal("two connections in the stages at the same time")
+	case <-time.After(100 * time.Millisecond):
+	}
+	release <- struct{}{}
+	<-entered
+	release <- struct{}{}
+}
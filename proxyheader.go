@@ -0,0 +1,181 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrNoProxyHeader is returned by the stage of ProxyHeaderStage for
+// connections that do not start with a valid PROXY protocol header.
+var ErrNoProxyHeader = errors.New("mux: missing or invalid PROXY header")
+
+const (
+	proxyV1MaxLen = 107
+	proxyV2HdrLen = 16
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection whose addresses were given by a PROXY header.
+type proxyConn struct {
+	net.Conn
+	remote, local net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr { return c.remote }
+func (c *proxyConn) LocalAddr() net.Addr  { return c.local }
+
+// NetConn returns the wrapped connection.
+func (c *proxyConn) NetConn() net.Conn { return c.Conn }
+
+// ProxyProtoV2 matches the connections starting with the 12-byte signature
+// of a PROXY protocol version 2 header, i.e., the connections coming through
+// a load balancer speaking it, so that they can be routed apart from the
+// direct ones. The header is left in place; a Pipeline with
+// ProxyHeaderStage can consume it and record the addresses it carries:
+//
+//	proxied := NewPipeline(m.Match(ProxyProtoV2())).Then(ProxyHeaderStage())
+//	direct := m.Match(Any())
+func ProxyProtoV2() Matcher {
+	return PrefixByteMatcher(proxyV2Signature)
+}
+
+// ProxyHeaderStage returns a Stage that consumes the PROXY protocol header
+// (version 1 or 2) that load balancers such as HAProxy send before the
+// payload of a connection. The connection passed to the next stage reports
+// the client and server addresses of the header as its RemoteAddr and
+// LocalAddr, except for LOCAL and UNKNOWN headers, which keep the actual
+// ones.
+//
+// The header is also recorded as the Proxy of the ConnInfo of connections
+// accepted by cmux.
+//
+// Connections without a header are rejected with ErrNoProxyHeader, since
+// the header can only be trusted when every client sends one.
+func ProxyHeaderStage() Stage {
+	return func(c *PipelineConn) (net.Conn, error) {
+		b, err := c.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		var remote, local net.Addr
+		version := 2
+		if b[0] == 'P' {
+			version = 1
+			remote, local, err = readProxyV1(c)
+		} else {
+			remote, local, err = readProxyV2(c)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if muc, ok := muxConnOf(c); ok {
+			muc.info.Proxy = &ProxyInfo{
+				Version:     version,
+				Source:      remote,
+				Destination: local,
+			}
+		}
+		if remote == nil {
+			return c, nil
+		}
+		return &proxyConn{Conn: c, remote: remote, local: local}, nil
+	}
+}
+
+func readProxyV1(c *PipelineConn) (remote, local net.Addr, err error) {
+	line, err := c.br.ReadSlice('\n')
+	if err != nil || len(line) > proxyV1MaxLen ||
+		!bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrNoProxyHeader
+	}
+	f := strings.Fields(string(line))
+	if len(f) < 2 || f[0] != "PROXY" {
+		return nil, nil, ErrNoProxyHeader
+	}
+	if f[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, nil, ErrNoProxyHeader
+	}
+	src, dst := net.ParseIP(f[2]), net.ParseIP(f[3])
+	sport, serr := strconv.ParseUint(f[4], 10, 16)
+	dport, derr := strconv.ParseUint(f[5], 10, 16)
+	if src == nil || dst == nil || serr != nil || derr != nil {
+		return nil, nil, ErrNoProxyHeader
+	}
+	return &net.TCPAddr{IP: src, Port: int(sport)},
+		&net.TCPAddr{IP: dst, Port: int(dport)}, nil
+}
+
+func readProxyV2(c *PipelineConn) (remote, local net.Addr, err error) {
+	hdr, err := c.Peek(proxyV2HdrLen)
+	if err != nil || !bytes.HasPrefix(hdr, proxyV2Signature) ||
+		hdr[12]>>4 != 2 {
+		return nil, nil, ErrNoProxyHeader
+	}
+	cmd, fam := hdr[12]&0xf, hdr[13]
+	n := int(binary.BigEndian.Uint16(hdr[14:]))
+	if proxyV2HdrLen+n > c.br.Size() {
+		return nil, nil, ErrNoProxyHeader
+	}
+	b, err := c.Peek(proxyV2HdrLen + n)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs := b[proxyV2HdrLen:]
+	defer func() {
+		if err == nil {
+			_, err = c.Discard(len(b))
+		}
+	}()
+
+	switch cmd {
+	case 0: // LOCAL
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, ErrNoProxyHeader
+	}
+	var ipLen int
+	switch fam >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC and AF_UNIX
+		return nil, nil, nil
+	}
+	if len(addrs) < 2*ipLen+4 {
+		return nil, nil, ErrNoProxyHeader
+	}
+	src := net.IP(append([]byte(nil), addrs[:ipLen]...))
+	dst := net.IP(append([]byte(nil), addrs[ipLen:2*ipLen]...))
+	sport := int(binary.BigEndian.Uint16(addrs[2*ipLen:]))
+	dport := int(binary.BigEndian.Uint16(addrs[2*ipLen+2:]))
+	if fam&0xf == 2 { // DGRAM
+		return &net.UDPAddr{IP: src, Port: sport},
+			&net.UDPAddr{IP: dst, Port: dport}, nil
+	}
+	return &net.TCPAddr{IP: src, Port: sport},
+		&net.TCPAddr{IP: dst, Port: dport}, nil
+}
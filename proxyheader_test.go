@@ -0,0 +1,140 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestProxyHeaderStage(t *testing.T) {
+	v2 := func(cmdFam string, addrs string) string {
+		return string(proxyV2Signature) + cmdFam +
+			string([]byte{0, byte(len(addrs))}) + addrs
+	}
+	ipv4 := "\xc0\x00\x02\x01\xc6\x33\x64\x01\x13\x88\x01\xbb"
+	for _, test := range []struct {
+		name, header  string
+		remote, local string
+		err           error
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 5000 443\r\n",
+			"192.0.2.1:5000", "198.51.100.1:443", nil},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 5000 443\r\n",
+			"[2001:db8::1]:5000", "[2001:db8::2]:443", nil},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "pipe", "pipe", nil},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 5000 70000\r\n",
+			"", "", ErrNoProxyHeader},
+		{"v2 tcp4", v2("\x21\x11", ipv4),
+			"192.0.2.1:5000", "198.51.100.1:443", nil},
+		{"v2 tlvs", v2("\x21\x11", ipv4+"\x04\x00\x01x"),
+			"192.0.2.1:5000", "198.51.100.1:443", nil},
+		{"v2 local", v2("\x20\x00", ""), "pipe", "pipe", nil},
+		{"v2 short", v2("\x21\x11", ipv4[:8]), "", "", ErrNoProxyHeader},
+		{"none", "GET / HTTP/1.1\r\n", "", "", ErrNoProxyHeader},
+	} {
+		c, w := net.Pipe()
+		go func() {
+			_, _ = w.Write([]byte(test.header + "payload"))
+			_ = w.Close()
+		}()
+		pc, err := ProxyHeaderStage()(newPipelineConn(c))
+		if err != test.err {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			_ = c.Close()
+			continue
+		}
+		if err != nil {
+			_ = c.Close()
+			continue
+		}
+		if a := pc.RemoteAddr().String(); a != test.remote {
+			t.Errorf("%s: unexpected remote address: %s", test.name, a)
+		}
+		if a := pc.LocalAddr().String(); a != test.local {
+			t.Errorf("%s: unexpected local address: %s", test.name, a)
+		}
+		b, err := ioutil.ReadAll(pc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "payload" {
+			t.Errorf("%s: unexpected payload: %q", test.name, b)
+		}
+		_ = pc.Close()
+	}
+}
+
+func TestProxyProtoV2(t *testing.T) {
+	defer leakCheck(t)()
+	l, cleanup := testListener(t)
+	defer cleanup()
+
+	muxl := New(l)
+	proxied := NewPipeline(muxl.Match(ProxyProtoV2())).Then(ProxyHeaderStage())
+	direct := muxl.Match(Any())
+	go safeServe(nil, muxl)
+
+	header := string(proxyV2Signature) + "\x21\x11\x00\x0c" +
+		"\xc0\x00\x02\x01\xc6\x33\x64\x01\x13\x88\x01\xbb"
+	for _, test := range []struct {
+		payload string
+		l       net.Listener
+		remote  string
+	}{
+		{header + "payload", proxied, "192.0.2.1:5000"},
+		{"payload", direct, ""},
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = c.Close() }()
+		writeAsync(c, test.payload)
+
+		ac, err := test.l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.remote == "" {
+			test.remote = c.LocalAddr().String()
+		}
+		if a := ac.RemoteAddr().String(); a != test.remote {
+			t.Errorf("unexpected remote address: want=%s got=%s", test.remote, a)
+		}
+		muc, ok := muxConnOf(ac)
+		if !ok {
+			t.Fatal("not a cmux connection")
+		}
+		info, _ := ConnInfoFromContext(muc.Context())
+		if test.l == proxied {
+			if p := info.Proxy; p == nil || p.Version != 2 ||
+				p.Source.String() != test.remote ||
+				p.Destination.String() != "198.51.100.1:443" {
+				t.Errorf("unexpected proxy info: %+v", p)
+			}
+		} else if info.Proxy != nil {
+			t.Errorf("unexpected proxy info: %+v", info.Proxy)
+		}
+		b := make([]byte, len("payload"))
+		if _, err := io.ReadFull(ac, b); err != nil || string(b) != "payload" {
+			t.Errorf("unexpected payload: %q, %v", b, err)
+		}
+		_ = ac.Close()
+	}
+	cleanup()
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// recordTimeFormat is the format of the timestamps of the recording files.
+// It sorts in chronological order.
+const recordTimeFormat = "20060102T150405.000000000Z"
+
+type recordingListener struct {
+	net.Listener
+	dir      string
+	maxBytes int64
+}
+
+// RecordingListener wraps l so that the bytes read from the connections it
+// accepts are recorded into files in dir, e.g. to debug a protocol offline
+// or to build a regression corpus. If maxBytes is positive, only the first
+// maxBytes bytes of each connection are recorded.
+//
+// The files hold the raw inbound stream, so that they can be replayed by
+// piping them to the server. They are named after the time the connection
+// was accepted, in UTC, and its ID, e.g. 20161016T150405.000000000Z-42.in.
+// When l is a listener returned by a CMux, the sniffed bytes are recorded
+// too, since the server reads them again. A connection whose file cannot be
+// created is served without being recorded.
+func RecordingListener(l net.Listener, dir string, maxBytes int64) net.Listener {
+	return &recordingListener{Listener: l, dir: dir, maxBytes: maxBytes}
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	var id uint64
+	if muc, ok := muxConnOf(c); ok {
+		id = muc.ID()
+	}
+	name := fmt.Sprintf("%s-%d.in", time.Now().UTC().Format(recordTimeFormat), id)
+	f, err := os.Create(filepath.Join(l.dir, name))
+	if err != nil {
+		return c, nil
+	}
+	return &recordingConn{Conn: c, f: f, left: l.maxBytes, limited: l.maxBytes > 0}, nil
+}
+
+type recordingConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	f       *os.File
+	left    int64
+	limited bool
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.record(p[:n])
+	}
+	return n, err
+}
+
+func (c *recordingConn) record(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return
+	}
+	if c.limited && int64(len(b)) > c.left {
+		b = b[:c.left]
+	}
+	if _, err := c.f.Write(b); err != nil {
+		c.closeFile()
+		return
+	}
+	c.left -= int64(len(b))
+	if c.limited && c.left == 0 {
+		c.closeFile()
+	}
+}
+
+// closeFile stops recording. It must be called with mu held.
+func (c *recordingConn) closeFile() {
+	if c.f != nil {
+		_ = c.f.Close()
+		c.f = nil
+	}
+}
+
+func (c *recordingConn) Close() error {
+	c.mu.Lock()
+	c.closeFile()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection.
+func (c *recordingConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestRecordingListener(t *testing.T) {
+	defer leakCheck(t)()
+	dir, err := ioutil.TempDir("", "cmux-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	l, cleanup := testListener(t)
+	defer cleanup()
+	muxl := New(l)
+	rl := RecordingListener(muxl.Match(PrefixMatcher("rec")), dir, 8)
+	go safeServe(nil, muxl)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	const payload = "record this stream"
+	writeAsync(c, payload)
+
+	ac, err := rl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len(payload))
+	if _, err := io.ReadFull(ac, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != payload {
+		t.Errorf("unexpected payload: %q", b)
+	}
+	_ = ac.Close()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("unexpected recordings: %v", files)
+	}
+	muc, _ := muxConnOf(ac)
+	name := regexp.MustCompile(fmt.Sprintf(`^\d{8}T\d{6}\.\d{9}Z-%d\.in$`, muc.ID()))
+	if !name.MatchString(files[0].Name()) {
+		t.Errorf("unexpected file name: %s", files[0].Name())
+	}
+	rec, err := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rec) != payload[:8] {
+		t.Errorf("unexpected recording: %q", rec)
+	}
+	cleanup()
+}
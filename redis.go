@@ -0,0 +1,107 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxRedisRead is the maximum number of bytes read to find the command
+	// of a Redis connection.
+	maxRedisRead = 512
+	// maxRedisCommandLen is the maximum length of a Redis command name.
+	maxRedisCommandLen = 32
+)
+
+// RedisRESP matches the connections of Redis clients by decoding the first
+// command they send, either as a RESP array of bulk strings, the way client
+// libraries send commands, as a lone bulk or simple string, or as an inline
+// command, the way redis-cli and telnet users do. The command name must be
+// plausible, i.e., a word of letters and digits, optionally with dots or
+// underscores as in the commands of modules (e.g., "JSON.GET").
+//
+// Inline commands look like HTTP request lines ("GET key"), so the lines
+// ending with an HTTP version are not matched. Still, the HTTP matchers are
+// best registered first.
+func RedisRESP() Matcher {
+	return func(r io.Reader) bool {
+		br := bufio.NewReaderSize(&io.LimitedReader{R: r, N: maxRedisRead}, maxRedisRead)
+		line, ok := readRESPLine(br)
+		if !ok || line == "" {
+			return false
+		}
+		switch line[0] {
+		case '*':
+			n, err := strconv.Atoi(line[1:])
+			if err != nil || n < 1 {
+				return false
+			}
+			if line, ok = readRESPLine(br); !ok || line == "" || line[0] != '$' {
+				return false
+			}
+			return readRESPBulkCommand(br, line)
+		case '$':
+			return readRESPBulkCommand(br, line)
+		case '+':
+			return isRedisCommand(line[1:])
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !isRedisCommand(fields[0]) {
+			return false
+		}
+		last := fields[len(fields)-1]
+		return len(fields) < 3 || !strings.HasPrefix(last, "HTTP/")
+	}
+}
+
+// readRESPBulkCommand reads the bulk string whose header is hdr from br and
+// returns whether it is a plausible command.
+func readRESPBulkCommand(br *bufio.Reader, hdr string) bool {
+	n, err := strconv.Atoi(hdr[1:])
+	if err != nil || n < 1 || n > maxRedisCommandLen {
+		return false
+	}
+	cmd, ok := readRESPLine(br)
+	return ok && len(cmd) == n && isRedisCommand(cmd)
+}
+
+// readRESPLine reads a line terminated by CR LF from br.
+func readRESPLine(br *bufio.Reader) (string, bool) {
+	line, err := br.ReadString('\n')
+	if err != nil || !strings.HasSuffix(line, "\r\n") {
+		return "", false
+	}
+	return line[:len(line)-2], true
+}
+
+func isRedisCommand(s string) bool {
+	if s == "" || len(s) > maxRedisCommandLen {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case i > 0 && ('0' <= c && c <= '9' || c == '.' || c == '_'):
+		default:
+			return false
+		}
+	}
+	return true
+}
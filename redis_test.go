@@ -0,0 +1,49 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedisRESP(t *testing.T) {
+	for _, test := range []struct {
+		cmd   string
+		match bool
+	}{
+		{"*1\r\n$4\r\nPING\r\n", true},
+		{"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n", true},
+		{"*2\r\n$8\r\nJSON.GET\r\n$3\r\nkey\r\n", true},
+		{"$4\r\nPING\r\n", true},
+		{"+PING\r\n", true},
+		{"PING\r\n", true},
+		{"GET key\r\n", true},
+		{"set key value\r\n", true},
+		{"*0\r\n", false},
+		{"*1\r\n$5\r\nPING\r\n", false},
+		{"*1\r\n:1\r\n", false},
+		{"*1\r\n$4\r\nPI G\r\n", false},
+		{"$40\r\n" + strings.Repeat("A", 40) + "\r\n", false},
+		{"PING\n", false},
+		{"PING", false},
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", false},
+		{"\x16\x03\x01\x00\x05", false},
+	} {
+		if got := RedisRESP()(strings.NewReader(test.cmd)); got != test.match {
+			t.Errorf("%q: want=%v got=%v", test.cmd, test.match, got)
+		}
+	}
+}
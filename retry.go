@@ -0,0 +1,99 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"net"
+	"time"
+)
+
+// AcceptRetryPolicy decides whether Serve keeps accepting after the root
+// listener's Accept fails, and how long it waits before trying again. The
+// ErrorHandler is called with the error first, and serving stops if it
+// returns false, whatever the policy.
+type AcceptRetryPolicy struct {
+	// Retryable returns whether accepting should be retried after err. It
+	// defaults to the Temporary method of err, if err is a net.Error.
+	Retryable func(err error) bool
+	// MaxRetries is the number of consecutive failed accepts that are
+	// retried before Serve gives up and returns the last error. Zero means
+	// no limit.
+	MaxRetries int
+	// Backoff returns how long to wait before the n-th consecutive retry,
+	// starting from 1. It defaults to no wait. See ExponentialBackoff.
+	Backoff func(n int) time.Duration
+}
+
+// WithAcceptRetryPolicy sets how Serve handles the errors of the root
+// listener. By default, it retries immediately and indefinitely after the
+// errors that are temporary according to net.Error.
+func WithAcceptRetryPolicy(p AcceptRetryPolicy) Option {
+	return func(m *cMux) {
+		m.retry = p
+	}
+}
+
+// ExponentialBackoff returns an AcceptRetryPolicy.Backoff waiting min before
+// the first retry, and twice as long before each next one, up to max. For
+// example, net/http waits from 5ms to 1s.
+func ExponentialBackoff(min, max time.Duration) func(n int) time.Duration {
+	return func(n int) time.Duration {
+		d := min
+		for i := 1; i < n && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// retryAccept returns whether accepting should be retried after err, the
+// failures-th consecutive error of the root listener, and waits for the
+// backoff of the policy before returning true.
+func (m *cMux) retryAccept(err error, failures int) bool {
+	if !m.errh(err) {
+		return false
+	}
+
+	retryable := m.retry.Retryable
+	if retryable == nil {
+		retryable = isTemporary
+	}
+	if !retryable(err) {
+		return false
+	}
+	if m.retry.MaxRetries > 0 && failures > m.retry.MaxRetries {
+		return false
+	}
+
+	if m.retry.Backoff == nil {
+		return true
+	}
+	t := time.NewTimer(m.retry.Backoff(failures))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-m.donec:
+		return false
+	}
+}
+
+func isTemporary(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// failingListener fails to accept with err.
+type failingListener struct {
+	net.Listener
+	err     error
+	accepts int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts++
+	return nil, l.err
+}
+
+func TestAcceptRetryPolicy(t *testing.T) {
+	defer leakCheck(t)()
+
+	errBoom := errors.New("boom")
+	l := &failingListener{err: errBoom}
+	var backoffs []int
+	muxl := New(l, WithAcceptRetryPolicy(AcceptRetryPolicy{
+		Retryable:  func(err error) bool { return err == errBoom },
+		MaxRetries: 3,
+		Backoff: func(n int) time.Duration {
+			backoffs = append(backoffs, n)
+			return time.Millisecond
+		},
+	}))
+	if err := muxl.Serve(); err != errBoom {
+		t.Errorf("unexpected error from Serve: %v", err)
+	}
+	if l.accepts != 4 || len(backoffs) != 3 || backoffs[2] != 3 {
+		t.Errorf("unexpected retries: %d accepts, backoffs %v", l.accepts, backoffs)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff(5*time.Millisecond, time.Second)
+	for n, want := range map[int]time.Duration{
+		1:   5 * time.Millisecond,
+		2:   10 * time.Millisecond,
+		8:   640 * time.Millisecond,
+		9:   time.Second,
+		100: time.Second,
+	} {
+		if d := b(n); d != want {
+			t.Errorf("unexpected backoff %d: want=%v got=%v", n, want, d)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"time"
+)
+
+// rfbVersion is the ProtocolVersion message of RFB 3.8.
+const rfbVersion = "RFB 003.008\n"
+
+// RFB returns a MatchWriter matching the connections of VNC clients. RFB is
+// a protocol in which the server speaks first, so, as ServerFirst does, it
+// sends the RFB 3.8 ProtocolVersion message to the clients that sent nothing
+// for delay, and matches the ones that answer with a valid ProtocolVersion.
+//
+// The VNC server of the listener must greet with the same version, whose
+// message is dropped. See ServerFirst for the other caveats.
+func RFB(delay time.Duration) MatchWriter {
+	return ServerFirst(delay, []byte(rfbVersion), rfbProtocolVersion)
+}
+
+// rfbProtocolVersion matches the ProtocolVersion message of RFB 3.x,
+// "RFB 003.xxx\n".
+func rfbProtocolVersion(r io.Reader) bool {
+	var b [len(rfbVersion)]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return false
+	}
+	if string(b[:8]) != "RFB 003." || b[11] != '\n' {
+		return false
+	}
+	for _, c := range b[8:11] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRFBProtocolVersion(t *testing.T) {
+	for _, test := range []struct {
+		version string
+		match   bool
+	}{
+		{"RFB 003.008\n", true},
+		{"RFB 003.003\n", true},
+		{"RFB 003.889\n", true},
+		{"RFB 004.001\n", false},
+		{"RFB 003.00x\n", false},
+		{"RFB 003.008", false},
+		{"GET / HTTP/1.1\r\n", false},
+	} {
+		if got := rfbProtocolVersion(strings.NewReader(test.version)); got != test.match {
+			t.Errorf("%q: want=%v got=%v", test.version, test.match, got)
+		}
+	}
+}
+
+func TestRFB(t *testing.T) {
+	defer leakCheck(t)()
+	l, cleanup := testListener(t)
+	defer cleanup()
+
+	muxl := New(l)
+	muxl.SetReadTimeout(5 * time.Second)
+	vncl := muxl.MatchWithWriters(RFB(50 * time.Millisecond))
+	muxl.Match(TLS())
+	go safeServe(nil, muxl)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	b := make([]byte, len(rfbVersion))
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != rfbVersion {
+		t.Fatalf("unexpected version: %q, %v", b, err)
+	}
+	writeAsync(c, "RFB 003.008\n")
+
+	ac, err := vncl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ac.Close() }()
+	if _, err := io.ReadFull(ac, b); err != nil || string(b) != rfbVersion {
+		t.Errorf("unexpected version: %q, %v", b, err)
+	}
+	// The version of the server is dropped, not its security types.
+	if _, err := io.WriteString(ac, rfbVersion+"\x01\x02"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, b[:2]); err != nil || string(b[:2]) != "\x01\x02" {
+		t.Errorf("unexpected security types: %q, %v", b[:2], err)
+	}
+	cleanup()
+}
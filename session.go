@@ -0,0 +1,88 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"net"
+)
+
+// Session is a stream-multiplexing session, such as a yamux session, whose
+// streams are exposed as net.Conns. Sessions returning their streams as
+// io.ReadWriteClosers, such as smux sessions, are adapted by StreamSession.
+type Session interface {
+	// Accept waits for and returns the next stream opened by the peer.
+	Accept() (net.Conn, error)
+	// Close closes the session and all its streams.
+	Close() error
+	// LocalAddr returns the local address of the session.
+	LocalAddr() net.Addr
+}
+
+type sessionListener struct {
+	Session
+}
+
+// SessionListener returns a net.Listener that accepts the streams of s, so
+// that each stream can be multiplexed by a CMux.
+func SessionListener(s Session) net.Listener {
+	return sessionListener{Session: s}
+}
+
+func (l sessionListener) Addr() net.Addr {
+	return l.LocalAddr()
+}
+
+// NewSession instantiates a new connection multiplexer that matches each
+// stream of s instead of each connection of a listener.
+func NewSession(s Session) CMux {
+	return New(SessionListener(s))
+}
+
+// ReadWriteCloserSession is a stream-multiplexing session whose Accept returns
+// the streams as io.ReadWriteClosers, such as a smux session (possibly over
+// KCP).
+type ReadWriteCloserSession interface {
+	// Accept waits for and returns the next stream opened by the peer.
+	Accept() (io.ReadWriteCloser, error)
+	// Close closes the session and all its streams.
+	Close() error
+	// LocalAddr returns the local address of the session.
+	LocalAddr() net.Addr
+}
+
+type streamSession struct {
+	ReadWriteCloserSession
+}
+
+// StreamSession returns a Session accepting the streams of s whose dynamic
+// type implements net.Conn, as the streams of smux do. The other streams are
+// closed and skipped.
+func StreamSession(s ReadWriteCloserSession) Session {
+	return streamSession{ReadWriteCloserSession: s}
+}
+
+func (s streamSession) Accept() (net.Conn, error) {
+	for {
+		rwc, err := s.ReadWriteCloserSession.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := rwc.(net.Conn); ok {
+			return c, nil
+		}
+		_ = rwc.Close()
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+type testSession struct {
+	streams chan net.Conn
+}
+
+func (s *testSession) Accept() (net.Conn, error) {
+	if c, ok := <-s.streams; ok {
+		return c, nil
+	}
+	return nil, errors.New("use of closed session")
+}
+
+func (s *testSession) Close() error {
+	close(s.streams)
+	return nil
+}
+
+func (s *testSession) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestSession(t *testing.T) {
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+
+	s := &testSession{streams: make(chan net.Conn, 2)}
+	muxl := NewSession(s)
+	httpl := muxl.Match(HTTP1Fast())
+	anyl := muxl.Match(Any())
+	go safeServe(errCh, muxl)
+	defer func() { _ = s.Close() }()
+
+	if httpl.Addr().String() != s.LocalAddr().String() {
+		t.Errorf("unexpected address %v", httpl.Addr())
+	}
+
+	for _, tc := range []struct {
+		payload string
+		l       net.Listener
+	}{
+		{"GET / HTTP/1.1\r\n", httpl},
+		{"SSH-2.0-OpenSSH\r\n", anyl},
+	} {
+		local, remote := net.Pipe()
+		s.streams <- remote
+		go func(payload string) {
+			_, _ = io.WriteString(local, payload)
+			_ = local.Close()
+		}(tc.payload)
+
+		c, err := tc.l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tc.payload {
+			t.Errorf("unexpected stream payload: want=%q got=%q", tc.payload, b)
+		}
+		_ = c.Close()
+	}
+}
+
+// testSmuxStream is shaped like *smux.Stream, which implements net.Conn.
+type testSmuxStream struct {
+	net.Conn
+}
+
+// testSmuxSession is shaped like *smux.Session, whose Accept returns the
+// streams as io.ReadWriteClosers.
+type testSmuxSession struct {
+	streams chan io.ReadWriteCloser
+}
+
+func (s *testSmuxSession) Accept() (io.ReadWriteCloser, error) {
+	if c, ok := <-s.streams; ok {
+		return c, nil
+	}
+	return nil, errors.New("use of closed session")
+}
+
+func (s *testSmuxSession) Close() error {
+	close(s.streams)
+	return nil
+}
+
+func (s *testSmuxSession) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// testRWC is a stream that is not a net.Conn.
+type testRWC struct {
+	closed bool
+}
+
+func (c *testRWC) Read([]byte) (int, error)    { return 0, io.EOF }
+func (c *testRWC) Write(b []byte) (int, error) { return len(b), nil }
+func (c *testRWC) Close() error                { c.closed = true; return nil }
+
+func TestStreamSession(t *testing.T) {
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+
+	s := &testSmuxSession{streams: make(chan io.ReadWriteCloser, 2)}
+	muxl := NewSession(StreamSession(s))
+	httpl := muxl.Match(HTTP1Fast())
+	go safeServe(errCh, muxl)
+	defer func() { _ = s.Close() }()
+
+	const payload = "GET / HTTP/1.1\r\n"
+	rwc := &testRWC{}
+	s.streams <- rwc
+	local, remote := net.Pipe()
+	s.streams <- &testSmuxStream{Conn: remote}
+	go func() {
+		_, _ = io.WriteString(local, payload)
+		_ = local.Close()
+	}()
+
+	c, err := httpl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != payload {
+		t.Errorf("unexpected stream payload: want=%q got=%q", payload, b)
+	}
+	_ = c.Close()
+	if !rwc.closed {
+		t.Error("stream that is not a net.Conn was not closed")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// shadowBacklog is the number of reads buffered for a shadow connection
+	// before it is dropped for being too slow.
+	shadowBacklog = 64
+	// shadowWriteTimeout bounds each write to a shadow connection.
+	shadowWriteTimeout = 5 * time.Second
+)
+
+type shadowListener struct {
+	net.Listener
+	dial func() (net.Conn, error)
+}
+
+// ShadowListener wraps l so that the bytes read from the connections it
+// accepts are also written to shadow connections opened with dial, one per
+// accepted connection, e.g. to load-test a new implementation of a protocol
+// with real traffic. dial can connect to an upstream or to an in-process
+// listener.
+//
+// Shadowing never affects the clients: shadows are dialed in the
+// background, with the bytes read meanwhile buffered, what the shadows write
+// is discarded, a connection whose shadow cannot be dialed is served without
+// one, and a shadow that falls behind or does not accept a write within
+// shadowWriteTimeout is dropped. The shadow connection is
+// closed once the accepted connection is closed and everything read from it
+// has been written to the shadow.
+//
+// When l is a listener returned by a CMux, the sniffed bytes are mirrored
+// too, since the server reads them again.
+func ShadowListener(l net.Listener, dial func() (net.Conn, error)) net.Listener {
+	return &shadowListener{Listener: l, dial: dial}
+}
+
+func (l *shadowListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newShadowConn(c, l.dial), nil
+}
+
+type shadowConn struct {
+	net.Conn
+
+	mu sync.Mutex
+	// bufc carries the bytes to write to the shadow. It is closed, and done
+	// set, once the shadow is dropped or the connection closed.
+	bufc chan []byte
+	done bool
+}
+
+func newShadowConn(c net.Conn, dial func() (net.Conn, error)) *shadowConn {
+	sc := &shadowConn{Conn: c, bufc: make(chan []byte, shadowBacklog)}
+	go sc.shadow(dial)
+	return sc
+}
+
+// shadow dials the shadow connection and writes the mirrored bytes to it.
+// The bytes read while dialing wait in bufc.
+func (c *shadowConn) shadow(dial func() (net.Conn, error)) {
+	shadow, err := dial()
+	if err != nil {
+		c.drop()
+		return
+	}
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, shadow)
+	}()
+	for b := range c.bufc {
+		if err != nil {
+			continue
+		}
+		_ = shadow.SetWriteDeadline(time.Now().Add(shadowWriteTimeout))
+		if _, err = shadow.Write(b); err != nil {
+			c.drop()
+		}
+	}
+	_ = shadow.Close()
+}
+
+func (c *shadowConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mirror(p[:n])
+	}
+	return n, err
+}
+
+func (c *shadowConn) mirror(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return
+	}
+	select {
+	case c.bufc <- append([]byte(nil), b...):
+	default:
+		// Drop the shadow rather than slowing the client down.
+		c.stop()
+	}
+}
+
+// stop stops mirroring. It must be called with mu held.
+func (c *shadowConn) stop() {
+	if !c.done {
+		c.done = true
+		close(c.bufc)
+	}
+}
+
+// drop stops mirroring to a shadow that failed.
+func (c *shadowConn) drop() {
+	c.mu.Lock()
+	c.stop()
+	c.mu.Unlock()
+}
+
+func (c *shadowConn) Close() error {
+	c.mu.Lock()
+	c.stop()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection.
+func (c *shadowConn) NetConn() net.Conn {
+	return c.Conn
+}
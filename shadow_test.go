@@ -0,0 +1,129 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestShadowListener(t *testing.T) {
+	defer leakCheck(t)()
+
+	shadowl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = shadowl.Close() }()
+	shadowed := make(chan string, 1)
+	go func() {
+		c, err := shadowl.Accept()
+		if err != nil {
+			shadowed <- err.Error()
+			return
+		}
+		defer func() { _ = c.Close() }()
+		// The response of the shadow is discarded.
+		_, _ = io.WriteString(c, "shadow response")
+		b, _ := ioutil.ReadAll(c)
+		shadowed <- string(b)
+	}()
+
+	l, cleanup := testListener(t)
+	defer cleanup()
+	muxl := New(l)
+	sl := ShadowListener(muxl.Match(Any()), func() (net.Conn, error) {
+		return net.Dial("tcp", shadowl.Addr().String())
+	})
+	go safeServe(nil, muxl)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	writeAsync(c, "hello")
+
+	ac, err := sl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(ac, b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(ac, "response"); err != nil {
+		t.Fatal(err)
+	}
+	_ = ac.Close()
+
+	resp, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "response" {
+		t.Errorf("unexpected response: %q", resp)
+	}
+	if s := <-shadowed; s != "hello" {
+		t.Errorf("unexpected shadowed stream: %q", s)
+	}
+	cleanup()
+}
+
+func TestShadowListenerSlowDial(t *testing.T) {
+	defer leakCheck(t)()
+
+	dialing := make(chan struct{})
+	shadowed := make(chan string, 1)
+	l, cleanup := testListener(t)
+	defer cleanup()
+	muxl := New(l)
+	sl := ShadowListener(muxl.Match(Any()), func() (net.Conn, error) {
+		<-dialing
+		c, sc := net.Pipe()
+		go func() {
+			b, _ := ioutil.ReadAll(sc)
+			shadowed <- string(b)
+		}()
+		return c, nil
+	})
+	go safeServe(nil, muxl)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	writeAsync(c, "hello")
+
+	// The connection is served while its shadow is being dialed.
+	ac, err := sl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(ac, b); err != nil {
+		t.Fatal(err)
+	}
+	_ = ac.Close()
+
+	close(dialing)
+	if s := <-shadowed; s != "hello" {
+		t.Errorf("unexpected shadowed stream: %q", s)
+	}
+	cleanup()
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+)
+
+// The SOCKS 5 authentication methods, as defined in RFC 1928.
+const (
+	SOCKS5AuthNone     = 0x00
+	SOCKS5AuthGSSAPI   = 0x01
+	SOCKS5AuthPassword = 0x02
+)
+
+// maxSOCKS4StringLen is the maximum length of the user ID and of the domain
+// name of a SOCKS 4 request, including the terminating NUL.
+const maxSOCKS4StringLen = 256
+
+// SOCKS5 matches the SOCKS 5 connections by decoding the greeting clients
+// send first, i.e., the version and the authentication methods they
+// support. If methods are passed, only the clients offering one of them are
+// matched, e.g., SOCKS5(SOCKS5AuthPassword).
+//
+// SOCKS clients send nothing beyond the greeting before the reply of the
+// server, so SOCKS5 must be matched before the matchers waiting for more
+// bytes than a greeting, such as HTTP1 or HTTP2, which would otherwise hold
+// the connection until the read timeout. Prefix matchers like HTTP1Fast or
+// TLS only read as much as they need and can come first.
+func SOCKS5(methods ...byte) Matcher {
+	return func(r io.Reader) bool {
+		var hdr [2]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil ||
+			hdr[0] != 0x05 || hdr[1] == 0 {
+			return false
+		}
+		offered := make([]byte, hdr[1])
+		if _, err := io.ReadFull(r, offered); err != nil {
+			return false
+		}
+		if len(methods) == 0 {
+			return true
+		}
+		for _, o := range offered {
+			for _, m := range methods {
+				if o == m {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// SOCKS4 matches the SOCKS 4 and 4a connections by decoding the CONNECT or
+// BIND request clients send first. As for SOCKS5, it must be matched before
+// the matchers waiting for more bytes than a request.
+func SOCKS4() Matcher {
+	return func(r io.Reader) bool {
+		// The version, the command, the port and the IP address.
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil ||
+			hdr[0] != 0x04 || (hdr[1] != 0x01 && hdr[1] != 0x02) {
+			return false
+		}
+		if !skipSOCKS4String(r) {
+			return false
+		}
+		// SOCKS 4a clients set the IP address to 0.0.0.x, x != 0, and
+		// send the domain name after the user ID.
+		if hdr[4] == 0 && hdr[5] == 0 && hdr[6] == 0 && hdr[7] != 0 {
+			return skipSOCKS4String(r)
+		}
+		return true
+	}
+}
+
+// skipSOCKS4String reads a NUL-terminated string from r.
+func skipSOCKS4String(r io.Reader) bool {
+	var b [1]byte
+	for i := 0; i < maxSOCKS4StringLen; i++ {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return false
+		}
+		if b[0] == 0 {
+			return true
+		}
+	}
+	return false
+}
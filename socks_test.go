@@ -0,0 +1,99 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSOCKS5(t *testing.T) {
+	for _, test := range []struct {
+		greeting      []byte
+		any, password bool
+	}{
+		{[]byte{5, 1, SOCKS5AuthNone}, true, false},
+		{[]byte{5, 2, SOCKS5AuthNone, SOCKS5AuthPassword}, true, true},
+		{[]byte{5, 0}, false, false},
+		{[]byte{5, 2, SOCKS5AuthNone}, false, false},
+		{[]byte{4, 1, SOCKS5AuthNone}, false, false},
+		{[]byte("GET / HTTP/1.1\r\n\r\n"), false, false},
+	} {
+		if got := SOCKS5()(bytes.NewReader(test.greeting)); got != test.any {
+			t.Errorf("%v: SOCKS5(): want=%v got=%v", test.greeting, test.any, got)
+		}
+		m := SOCKS5(SOCKS5AuthPassword, SOCKS5AuthGSSAPI)
+		if got := m(bytes.NewReader(test.greeting)); got != test.password {
+			t.Errorf("%v: SOCKS5(password): want=%v got=%v", test.greeting, test.password, got)
+		}
+	}
+}
+
+func TestSOCKS4(t *testing.T) {
+	for _, test := range []struct {
+		req   string
+		match bool
+	}{
+		{"\x04\x01\x00\x50\x7f\x00\x00\x01user\x00", true},
+		{"\x04\x02\x00\x50\x7f\x00\x00\x01\x00", true},
+		{"\x04\x01\x00\x50\x00\x00\x00\x01\x00example.com\x00", true},
+		{"\x04\x01\x00\x50\x00\x00\x00\x01\x00example.com", false},
+		{"\x04\x01\x00\x50\x7f\x00\x00\x01user", false},
+		{"\x04\x03\x00\x50\x7f\x00\x00\x01\x00", false},
+		{"\x05\x01\x00", false},
+	} {
+		if got := SOCKS4()(bytes.NewReader([]byte(test.req))); got != test.match {
+			t.Errorf("%q: want=%v got=%v", test.req, test.match, got)
+		}
+	}
+}
+
+// TestSOCKS5AfterPrefixMatchers checks that the prefix matchers registered
+// before SOCKS5 do not wait for more bytes than the greeting.
+func TestSOCKS5AfterPrefixMatchers(t *testing.T) {
+	defer leakCheck(t)()
+	greeting := []byte{5, 1, SOCKS5AuthNone}
+	for _, prefixes := range [][]Matcher{
+		{HTTP1Fast()},
+		{HTTP1Fast(), TLS()},
+	} {
+		l, cleanup := testListener(t)
+		muxl := New(l)
+		for _, m := range prefixes {
+			muxl.Match(m)
+		}
+		socksl := muxl.Match(SOCKS5())
+		go safeServe(nil, muxl)
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAsync(c, string(greeting))
+		ac, err := socksl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(greeting))
+		if _, err := io.ReadFull(ac, b); err != nil || !bytes.Equal(b, greeting) {
+			t.Errorf("unexpected greeting: %v, %v", b, err)
+		}
+		_ = ac.Close()
+		_ = c.Close()
+		cleanup()
+	}
+}
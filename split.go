@@ -0,0 +1,102 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"hash/fnv"
+	"net"
+	"sync/atomic"
+)
+
+// TrafficSplit is the share of the connections MatchSplit delivers to its
+// canary listener.
+type TrafficSplit struct {
+	// Percent is the percentage of the connections delivered to the canary
+	// listener, from 0 to 100.
+	Percent float64
+	// ByRemoteIP, if set, picks the listener of a connection by hashing
+	// its remote IP, so that all the connections of a client go to the same
+	// listener. Otherwise, the connections are split in order, e.g., every
+	// tenth one goes to the canary at 10%.
+	ByRemoteIP bool
+}
+
+type trafficSplit struct {
+	// n is the number of connections split so far. It is accessed
+	// atomically and must stay 64-bit aligned.
+	n uint64
+
+	TrafficSplit
+	canary muxListener
+}
+
+// splitScale is the resolution of the percentages: 1/splitScale of a
+// percent.
+const splitScale = 100
+
+func (s *trafficSplit) toCanary(c net.Conn) bool {
+	if s.Percent <= 0 {
+		return false
+	}
+	threshold := uint64(s.Percent * splitScale)
+	if s.ByRemoteIP {
+		h := fnv.New32a()
+		_, _ = h.Write(remoteIP(c))
+		return uint64(h.Sum32())%(100*splitScale) < threshold
+	}
+	// The n-th connection goes to the canary if it crosses a multiple of
+	// the canary's share.
+	n := atomic.AddUint64(&s.n, 1)
+	return n*threshold/(100*splitScale) > (n-1)*threshold/(100*splitScale)
+}
+
+// remoteIP returns the IP of the remote address of c, or the whole address
+// if it has no IP.
+func remoteIP(c net.Conn) []byte {
+	addr := c.RemoteAddr()
+	if addr == nil {
+		return nil
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	if ip != nil {
+		return ip
+	}
+	s := addr.String()
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return []byte(s)
+}
+
+func (m *cMux) MatchSplit(split TrafficSplit, matchers ...Matcher) (primary, canary net.Listener) {
+	m.Match(matchers...)
+	sl := &m.sls[len(m.sls)-1]
+	// The canary shares the name and the statistics of the primary, but
+	// has its own backlog.
+	cl := sl.l
+	cl.connc = make(chan net.Conn, m.bufLen)
+	cl.donec = make(chan struct{})
+	sl.split = &trafficSplit{TrafficSplit: split, canary: cl}
+	return sl.l, cl
+}
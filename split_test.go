@@ -0,0 +1,102 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTrafficSplit(t *testing.T) {
+	s := &trafficSplit{TrafficSplit: TrafficSplit{Percent: 25}}
+	c := &mockConn{}
+	canary := 0
+	for i := 0; i < 100; i++ {
+		if s.toCanary(c) {
+			canary++
+		}
+	}
+	if canary != 25 {
+		t.Errorf("unexpected canary connections: %d", canary)
+	}
+
+	s = &trafficSplit{TrafficSplit: TrafficSplit{Percent: 50, ByRemoteIP: true}}
+	canary = 0
+	for i := 0; i < 256; i++ {
+		c := &addrConn{remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: i}}
+		first := s.toCanary(c)
+		// The same IP always goes to the same listener.
+		c.remote.(*net.TCPAddr).Port++
+		if s.toCanary(c) != first {
+			t.Errorf("inconsistent split for %v", c.remote)
+		}
+		if first {
+			canary++
+		}
+	}
+	if canary < 64 || canary > 192 {
+		t.Errorf("unexpected canary clients: %d", canary)
+	}
+}
+
+func TestMatchSplit(t *testing.T) {
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+	l, cleanup := testListener(t)
+	defer cleanup()
+
+	muxl := New(l)
+	primary, canary := muxl.MatchSplit(TrafficSplit{Percent: 50}, Any())
+	go safeServe(errCh, muxl)
+
+	for i := 0; i < 4; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = c.Close() }()
+		// Every other connection goes to the canary.
+		want := primary
+		if i%2 == 1 {
+			want = canary
+		}
+		ac, err := want.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = ac.Close()
+	}
+
+	cleanup()
+	for _, sl := range []net.Listener{primary, canary} {
+		if _, err := sl.Accept(); err != ErrListenerClosed {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
+
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,57 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// maxSSHIdentLen is the maximum length of an SSH identification string,
+// including the CR LF, as defined in RFC 4253.
+const maxSSHIdentLen = 255
+
+// SSH matches the SSH connections by the identification string clients send
+// first, i.e. "SSH-2.0-" or "SSH-1.99-" for the clients also supporting SSH
+// 1.
+func SSH() Matcher {
+	return PrefixMatcher("SSH-2.0-", "SSH-1.99-")
+}
+
+// SSHSoftware matches the SSH connections whose client software version
+// contains substr, e.g. "OpenSSH_9" for the identification string
+// "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13". The comments following the
+// software version are not taken into account.
+func SSHSoftware(substr string) Matcher {
+	return func(r io.Reader) bool {
+		br := bufio.NewReaderSize(&io.LimitedReader{R: r, N: maxSSHIdentLen}, maxSSHIdentLen)
+		line, err := br.ReadSlice('\n')
+		if err != nil {
+			return false
+		}
+		ident := strings.TrimRight(string(line), "\r\n")
+		for _, proto := range []string{"SSH-2.0-", "SSH-1.99-"} {
+			if strings.HasPrefix(ident, proto) {
+				software := ident[len(proto):]
+				if i := strings.IndexByte(software, ' '); i >= 0 {
+					software = software[:i]
+				}
+				return strings.Contains(software, substr)
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSSH(t *testing.T) {
+	for _, test := range []struct {
+		ident   string
+		ssh     bool
+		openssh bool
+	}{
+		{"SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13\r\n", true, true},
+		{"SSH-2.0-OpenSSH_9.6\n", true, true},
+		{"SSH-1.99-OpenSSH_3.9p1\r\n", true, false},
+		{"SSH-2.0-PuTTY_Release_0.80 OpenSSH_9\r\n", true, false},
+		{"SSH-1.5-OpenSSH_9\r\n", false, false},
+		{"SSH-2.0-OpenSSH_9" + strings.Repeat("x", maxSSHIdentLen) + "\r\n", true, false},
+		{"GET / HTTP/1.1\r\n\r\n", false, false},
+	} {
+		if got := SSH()(strings.NewReader(test.ident)); got != test.ssh {
+			t.Errorf("%q: SSH: want=%v got=%v", test.ident, test.ssh, got)
+		}
+		if got := SSHSoftware("OpenSSH_9")(strings.NewReader(test.ident)); got != test.openssh {
+			t.Errorf("%q: SSHSoftware: want=%v got=%v", test.ident, test.openssh, got)
+		}
+	}
+}
+
+func TestSSHMux(t *testing.T) {
+	defer leakCheck(t)()
+	l, cleanup := testListener(t)
+	defer cleanup()
+
+	muxl := New(l)
+	sshl := muxl.Match(SSH())
+	muxl.Match(HTTP1Fast())
+	go safeServe(nil, muxl)
+
+	const ident = "SSH-2.0-OpenSSH_9.6\r\n"
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	writeAsync(c, ident)
+	ac, err := sshl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ac.Close() }()
+	b := make([]byte, len(ident))
+	if _, err := io.ReadFull(ac, b); err != nil || string(b) != ident {
+		t.Errorf("unexpected read: %q, %v", b, err)
+	}
+	cleanup()
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"sync/atomic"
+)
+
+// ListenerStats are the aggregate statistics of a listener returned by a
+// CMux.
+type ListenerStats struct {
+	// Name is the name of the listener, if any.
+	Name string
+	// Matched is the number of connections matched for the listener.
+	Matched uint64
+	// BytesRead is the number of bytes read from the connections of the
+	// listener, including the sniffed bytes.
+	BytesRead uint64
+	// BytesWritten is the number of bytes written to the connections of the
+	// listener, excluding what matchers wrote while sniffing.
+	BytesWritten uint64
+	// Matchers are the statistics of the matchers of the listener, in the
+	// order they were passed to Match.
+	Matchers []MatcherStats
+}
+
+// connStats are the counters of a connection or a listener. All the fields
+// are accessed atomically.
+type connStats struct {
+	matched uint64
+	read    uint64
+	written uint64
+}
+
+func (s *connStats) addRead(n int) {
+	if n > 0 {
+		atomic.AddUint64(&s.read, uint64(n))
+	}
+}
+
+func (s *connStats) addWritten(n int) {
+	if n > 0 {
+		atomic.AddUint64(&s.written, uint64(n))
+	}
+}
+
+func (s *connStats) listenerStats(name string) ListenerStats {
+	return ListenerStats{
+		Name:         name,
+		Matched:      atomic.LoadUint64(&s.matched),
+		BytesRead:    atomic.LoadUint64(&s.read),
+		BytesWritten: atomic.LoadUint64(&s.written),
+	}
+}
+
+func (m *cMux) Stats() []ListenerStats {
+	stats := make([]ListenerStats, 0, len(m.sls))
+	for i := range m.sls {
+		sl := &m.sls[i]
+		ls := sl.l.stats.listenerStats(sl.l.name)
+		ls.Matchers = make([]MatcherStats, len(sl.lat))
+		for j := range sl.lat {
+			ls.Matchers[j] = sl.lat[j].matcherStats()
+		}
+		stats = append(stats, ls)
+	}
+	return stats
+}
+
+// BytesRead returns the number of bytes read from the connection, including
+// the sniffed bytes.
+func (m *MuxConn) BytesRead() uint64 {
+	return atomic.LoadUint64(&m.stats.read)
+}
+
+// BytesWritten returns the number of bytes written to the connection,
+// excluding what matchers wrote while sniffing.
+func (m *MuxConn) BytesWritten() uint64 {
+	return atomic.LoadUint64(&m.stats.written)
+}
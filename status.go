@@ -0,0 +1,154 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRecentUnmatched is the number of unmatched connections remembered
+	// for StatusHandler.
+	maxRecentUnmatched = 16
+	// maxUnmatchedPrefix is the number of sniffed bytes remembered for each
+	// of them.
+	maxUnmatchedPrefix = 16
+)
+
+// unmatchedConn is a connection that was not matched.
+type unmatchedConn struct {
+	time   time.Time
+	addr   net.Addr
+	prefix []byte
+}
+
+// recentUnmatched is a ring of the last unmatched connections of a CMux.
+type recentUnmatched struct {
+	mu    sync.Mutex
+	conns [maxRecentUnmatched]unmatchedConn
+	n     int
+}
+
+// add records an unmatched connection from addr that sent sniffed.
+func (r *recentUnmatched) add(addr net.Addr, sniffed []byte) {
+	if len(sniffed) > maxUnmatchedPrefix {
+		sniffed = sniffed[:maxUnmatchedPrefix]
+	}
+	u := unmatchedConn{
+		time:   time.Now(),
+		addr:   addr,
+		prefix: append([]byte(nil), sniffed...),
+	}
+
+	r.mu.Lock()
+	r.conns[r.n%maxRecentUnmatched] = u
+	r.n++
+	r.mu.Unlock()
+}
+
+// last returns the recorded connections, the most recent first.
+func (r *recentUnmatched) last() []unmatchedConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.n
+	if n > maxRecentUnmatched {
+		n = maxRecentUnmatched
+	}
+	conns := make([]unmatchedConn, n)
+	for i := range conns {
+		conns[i] = r.conns[(r.n-1-i)%maxRecentUnmatched]
+	}
+	return conns
+}
+
+// StatusHandler returns an http.Handler rendering the state of m as plain
+// text: its listeners with their matchers, statistics and backlog sizes, and
+// the connections that were recently not matched, with the first bytes they
+// sent. It can be mounted on any http.ServeMux, e.g., next to the handlers
+// of net/http/pprof:
+//
+//	http.Handle("/debug/cmux", cmux.StatusHandler(m))
+//
+// The handler exposes the sniffed bytes of unmatched connections, so it
+// should only be reachable by operators.
+func StatusHandler(m CMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		cm, ok := m.(*cMux)
+		if !ok {
+			for i, ls := range m.Stats() {
+				writeListenerStatus(w, i, ls)
+			}
+			return
+		}
+		cm.writeStatus(w)
+	})
+}
+
+func (m *cMux) writeStatus(w io.Writer) {
+	stats := m.Stats()
+	fmt.Fprintf(w, "rejected before sniffing: %d\n", m.Rejected())
+	for i := range m.sls {
+		sl := &m.sls[i]
+		writeListenerStatus(w, i, stats[i])
+		for _, l := range sl.listeners() {
+			fmt.Fprintf(w, "\tbacklog %d/%d\n", len(l.connc), cap(l.connc))
+		}
+		if i == m.fallback {
+			fmt.Fprintln(w, "\tunmatched connections")
+		}
+		if i == m.noBytes {
+			fmt.Fprintln(w, "\tconnections sending nothing")
+		}
+		for j, k := range sl.kinds {
+			ms := stats[i].Matchers[j]
+			fmt.Fprintf(w, "\tmatcher %d: %s, %d calls, p50 %v, p99 %v\n",
+				j, describeMatcher(k), ms.Calls, ms.P50, ms.P99)
+		}
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "recently unmatched:")
+	for _, u := range m.unmatched.last() {
+		fmt.Fprintf(w, "\t%s %v %q\n", u.time.Format(time.RFC3339), u.addr, u.prefix)
+	}
+}
+
+func writeListenerStatus(w io.Writer, i int, ls ListenerStats) {
+	fmt.Fprintf(w, "listener %d %q: %d matched, %d bytes read, %d bytes written\n",
+		i, ls.Name, ls.Matched, ls.BytesRead, ls.BytesWritten)
+}
+
+// describeMatcher returns a short description of a matcher of kind k.
+func describeMatcher(k matcherKind) string {
+	if t := k.tree; t != nil {
+		ps := make([]string, len(t.prefixes))
+		for i, p := range t.prefixes {
+			ps[i] = fmt.Sprintf("%q", p)
+		}
+		return "prefix " + strings.Join(ps, " ")
+	}
+	if k.any {
+		return "any"
+	}
+	return "custom"
+}
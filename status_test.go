@@ -0,0 +1,55 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusHandler(t *testing.T) {
+	defer leakCheck(t)()
+
+	l := newChanListener()
+	defer close(l.connCh)
+	muxl := New(l)
+	muxl.MatchNamed("hello", PrefixMatcher("hello"))
+	muxl.MatchNamed("none", func(r io.Reader) bool { return false })
+	errc := serveErrors(t, muxl)
+
+	w, r := net.Pipe()
+	defer func() { _ = w.Close() }()
+	writeAsync(w, "bye!!!")
+	l.connCh <- r
+	<-errc
+
+	rec := httptest.NewRecorder()
+	StatusHandler(muxl).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/cmux", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`listener 0 "hello": 0 matched`,
+		`backlog 0/1024`,
+		`matcher 0: prefix "hello", 1 calls`,
+		`matcher 0: custom, 1 calls`,
+		`"bye!!!"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("status does not contain %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	tdsPacketPrelogin  = 0x12
+	tdsHeaderLen       = 8
+	tdsMaxPreloginLen  = 4096
+	tdsTokenVersion    = 0x00
+	tdsTokenTerminator = 0xff
+)
+
+// TDS matches the connections of Microsoft SQL Server clients, by the TDS
+// PRELOGIN packet they send first: its header must be valid, and its option
+// tokens must start with the VERSION token and fit in the packet. Clients
+// using TDS 8.0 strict encryption start with a TLS handshake instead.
+func TDS() Matcher {
+	return func(r io.Reader) bool {
+		var hdr [tdsHeaderLen]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil ||
+			hdr[0] != tdsPacketPrelogin {
+			return false
+		}
+		n := int(binary.BigEndian.Uint16(hdr[2:4]))
+		if n <= tdsHeaderLen || n > tdsMaxPreloginLen {
+			return false
+		}
+		b := make([]byte, n-tdsHeaderLen)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return false
+		}
+		return validTDSPrelogin(b)
+	}
+}
+
+// validTDSPrelogin returns whether b is a valid PRELOGIN payload.
+func validTDSPrelogin(b []byte) bool {
+	for i := 0; ; i += 5 {
+		if i >= len(b) {
+			return false
+		}
+		if b[i] == tdsTokenTerminator {
+			return i > 0
+		}
+		if i+5 > len(b) {
+			return false
+		}
+		off := int(binary.BigEndian.Uint16(b[i+1:]))
+		n := int(binary.BigEndian.Uint16(b[i+3:]))
+		if off+n > len(b) {
+			return false
+		}
+		if i == 0 && (b[i] != tdsTokenVersion || n != 6) {
+			return false
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTDS(t *testing.T) {
+	// A PRELOGIN packet with the VERSION and ENCRYPTION tokens.
+	prelogin := []byte{
+		0x12, 0x01, 0x00, 0x1a, 0x00, 0x00, 0x01, 0x00,
+		0x00, 0x00, 0x0b, 0x00, 0x06,
+		0x01, 0x00, 0x11, 0x00, 0x01,
+		0xff,
+		0x0f, 0x00, 0x07, 0xd0, 0x00, 0x00,
+		0x00,
+	}
+	corrupt := func(i int, b byte) []byte {
+		c := append([]byte(nil), prelogin...)
+		c[i] = b
+		return c
+	}
+	for _, test := range []struct {
+		name   string
+		packet []byte
+		match  bool
+	}{
+		{"prelogin", prelogin, true},
+		{"type", corrupt(0, 0x10), false},
+		{"short length", corrupt(3, 0x08), false},
+		{"long length", corrupt(3, 0x1b), false},
+		{"first token", corrupt(8, 0x01), false},
+		{"version length", corrupt(12, 0x04), false},
+		{"offset", corrupt(15, 0x1a), false},
+		{"no terminator", corrupt(18, 0x02), false},
+		{"http", []byte("GET / HTTP/1.1\r\n\r\n"), false},
+	} {
+		if got := TDS()(bytes.NewReader(test.packet)); got != test.match {
+			t.Errorf("%s: want=%v got=%v", test.name, test.match, got)
+		}
+	}
+}
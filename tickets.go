@@ -0,0 +1,113 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoTicketKeys is returned when a TicketKeyStore returns no keys.
+var ErrNoTicketKeys = errors.New("mux: no session ticket keys")
+
+// TicketKeyStore provides the session ticket keys of a TLS server. For the
+// sessions of a service to be resumed on any of its replicas, all the
+// replicas must use the same keys, e.g., from a store backed by a shared
+// database or secret manager.
+type TicketKeyStore interface {
+	// TicketKeys returns the current keys. The first key encrypts the new
+	// tickets, and all of them decrypt the tickets of the clients, so
+	// that the tickets issued with the previous keys are still accepted.
+	TicketKeys() ([][32]byte, error)
+}
+
+type localTicketKeys struct {
+	mu   sync.Mutex
+	keys [][32]byte
+	n    int
+}
+
+// LocalTicketKeys returns a TicketKeyStore for a single server: each call
+// to TicketKeys generates a new random key, and the store keeps the n most
+// recent ones, so that a ticket stays valid for n rotations. n is at least
+// 1.
+func LocalTicketKeys(n int) TicketKeyStore {
+	if n < 1 {
+		n = 1
+	}
+	return &localTicketKeys{n: n}
+}
+
+func (s *localTicketKeys) TicketKeys() ([][32]byte, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append([][32]byte{key}, s.keys...)
+	if len(s.keys) > s.n {
+		s.keys = s.keys[:s.n]
+	}
+	return append([][32]byte(nil), s.keys...), nil
+}
+
+// RotateTicketKeys sets the session ticket keys of config to the keys of
+// store, and refreshes them every interval until stop is called. The
+// sessions of the clients are resumed with the tickets encrypted with these
+// keys, e.g., by a TLSStage using config.
+//
+// It returns the error of getting the first keys. The errors of the later
+// refreshes are passed to errh, if it is not nil, and config keeps its
+// previous keys.
+func RotateTicketKeys(config *tls.Config, store TicketKeyStore, interval time.Duration, errh func(error)) (stop func(), err error) {
+	if err := setTicketKeys(config, store); err != nil {
+		return nil, err
+	}
+
+	donec := make(chan struct{})
+	var once sync.Once
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := setTicketKeys(config, store); err != nil && errh != nil {
+					errh(err)
+				}
+			case <-donec:
+				return
+			}
+		}
+	}()
+	return func() { once.Do(func() { close(donec) }) }, nil
+}
+
+func setTicketKeys(config *tls.Config, store TicketKeyStore) error {
+	keys, err := store.TicketKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return ErrNoTicketKeys
+	}
+	config.SetSessionTicketKeys(keys)
+	return nil
+}
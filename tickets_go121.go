@@ -0,0 +1,117 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build go1.21
+// +build go1.21
+
+package cmux
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/tls"
+	"sync"
+)
+
+// SessionCache stores the TLS sessions of a server by ID. It is the server
+// side counterpart of tls.ClientSessionCache: see UseSessionCache.
+type SessionCache interface {
+	// Get returns the session stored with id, if any.
+	Get(id string) (session []byte, ok bool)
+	// Put stores session with id.
+	Put(id string, session []byte)
+}
+
+type lruSessionCache struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      list.List // of *lruSession, most recent first.
+	capacity int
+}
+
+type lruSession struct {
+	id      string
+	session []byte
+}
+
+// NewLRUSessionCache returns a SessionCache keeping the capacity most
+// recently stored sessions in memory. capacity is at least 1.
+func NewLRUSessionCache(capacity int) SessionCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &lruSessionCache{entries: make(map[string]*list.Element), capacity: capacity}
+}
+
+func (c *lruSessionCache) Get(id string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*lruSession).session, true
+}
+
+func (c *lruSessionCache) Put(id string, session []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[id]; ok {
+		e.Value.(*lruSession).session = session
+		c.lru.MoveToFront(e)
+		return
+	}
+	if c.lru.Len() >= c.capacity {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*lruSession).id)
+	}
+	c.entries[id] = c.lru.PushFront(&lruSession{id: id, session: session})
+}
+
+// sessionIDLen is the length of the random IDs sent as session tickets.
+const sessionIDLen = 16
+
+// UseSessionCache makes the servers using config, e.g., with WithTLSConfig
+// or TLSStage, keep the state of the TLS sessions in cache, and send the
+// clients random session IDs as tickets instead of the encrypted state.
+// Sessions are only resumed while cache holds them, and the session ticket
+// keys of config, e.g., of RotateTicketKeys, are not used.
+//
+// To resume sessions on any replica of a service, cache must be shared by
+// the replicas. To not resume sessions at all, set the
+// SessionTicketsDisabled field of config instead.
+func UseSessionCache(config *tls.Config, cache SessionCache) {
+	config.WrapSession = func(_ tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+		session, err := ss.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		id := make([]byte, sessionIDLen)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		cache.Put(string(id), session)
+		return id, nil
+	}
+	config.UnwrapSession = func(id []byte, _ tls.ConnectionState) (*tls.SessionState, error) {
+		session, ok := cache.Get(string(id))
+		if !ok {
+			// Not resumed, e.g., the session was evicted.
+			return nil, nil
+		}
+		return tls.ParseSessionState(session)
+	}
+}
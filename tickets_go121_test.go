@@ -0,0 +1,95 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build go1.21
+// +build go1.21
+
+package cmux
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestLRUSessionCache(t *testing.T) {
+	c := NewLRUSessionCache(2)
+	c.Put("a", []byte("1"))
+	c.Put("b", []byte("2"))
+	// a is more recent than b once read.
+	if s, ok := c.Get("a"); !ok || string(s) != "1" {
+		t.Fatalf("unexpected session: %q, %v", s, ok)
+	}
+	c.Put("c", []byte("3"))
+	if _, ok := c.Get("b"); ok {
+		t.Error("the least recently used session was kept")
+	}
+	for _, id := range []string{"a", "c"} {
+		if _, ok := c.Get(id); !ok {
+			t.Errorf("session %s was evicted", id)
+		}
+	}
+}
+
+func TestUseSessionCache(t *testing.T) {
+	cert := testCertificate(t, "example.com")
+	shared := NewLRUSessionCache(8)
+	// Two replicas sharing the cache, and one with its own.
+	var servers []*tls.Config
+	for _, cache := range []SessionCache{shared, shared, NewLRUSessionCache(8)} {
+		config := &tls.Config{Certificates: []tls.Certificate{*cert}}
+		UseSessionCache(config, cache)
+		servers = append(servers, config)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	client := &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	for i, config := range servers {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(config *tls.Config) {
+			defer func() { _ = s.Close() }()
+			sc, err := TLSStage(config)(newPipelineConn(s))
+			if err != nil {
+				return
+			}
+			_, _ = io.WriteString(sc, "x")
+		}(config)
+
+		tc := tls.Client(c, client)
+		// Reading receives the session ticket.
+		if _, err := io.ReadFull(tc, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if resumed := tc.ConnectionState().DidResume; resumed != (i == 1) {
+			t.Errorf("connection %d: unexpected resumption: %v", i, resumed)
+		}
+		_ = tc.Close()
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type staticTicketKeys [][32]byte
+
+func (s staticTicketKeys) TicketKeys() ([][32]byte, error) { return s, nil }
+
+func TestLocalTicketKeys(t *testing.T) {
+	s := LocalTicketKeys(2)
+	first, err := s.TicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = s.TicketKeys()
+	keys, err := s.TicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("unexpected number of keys: %d", len(keys))
+	}
+	for _, k := range keys {
+		if k == first[0] {
+			t.Error("the oldest key was kept")
+		}
+	}
+}
+
+func TestRotateTicketKeys(t *testing.T) {
+	cert := testCertificate(t, "example.com")
+	store := staticTicketKeys{{1}, {2}}
+	// Two replicas sharing the keys.
+	var replicas []*tls.Config
+	for i := 0; i < 2; i++ {
+		config := &tls.Config{Certificates: []tls.Certificate{*cert}}
+		stop, err := RotateTicketKeys(config, store, time.Hour, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stop()
+		replicas = append(replicas, config)
+	}
+
+	if _, err := RotateTicketKeys(&tls.Config{}, staticTicketKeys{}, time.Hour, nil); err != ErrNoTicketKeys {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	client := &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	for i, config := range replicas {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(config *tls.Config) {
+			defer func() { _ = s.Close() }()
+			sc, err := TLSStage(config)(newPipelineConn(s))
+			if err != nil {
+				return
+			}
+			_, _ = io.WriteString(sc, "x")
+		}(config)
+
+		tc := tls.Client(c, client)
+		// Reading receives the session ticket.
+		if _, err := io.ReadFull(tc, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if resumed := tc.ConnectionState().DidResume; resumed != (i == 1) {
+			t.Errorf("connection %d: unexpected resumption: %v", i, resumed)
+		}
+		_ = tc.Close()
+	}
+}
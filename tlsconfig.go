@@ -0,0 +1,84 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+)
+
+// ErrNoCertificate is returned by the callback of CertificatesBySNI when
+// there is no certificate for the server name of a client.
+var ErrNoCertificate = errors.New("mux: no certificate for server name")
+
+// CertificatesBySNI returns a tls.Config.GetCertificate callback picking the
+// certificate of the server name (SNI) requested by the client from certs.
+// The keys of certs are domains, matched case-insensitively, and can be
+// wildcards such as "*.example.com", which match a single label. Exact
+// domains take precedence over wildcards. def, if not nil, is used for the
+// clients whose server name is not in certs or that send none.
+func CertificatesBySNI(certs map[string]*tls.Certificate, def *tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	lower := make(map[string]*tls.Certificate, len(certs))
+	for k, v := range certs {
+		lower[strings.ToLower(k)] = v
+	}
+	has := func(key string) bool { _, ok := lower[key]; return ok }
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if key, ok := sniKey(hello.ServerName, has); ok {
+			return lower[key], nil
+		}
+		if def != nil {
+			return def, nil
+		}
+		return nil, ErrNoCertificate
+	}
+}
+
+// ConfigsBySNI returns a tls.Config.GetConfigForClient callback picking the
+// configuration of the server name (SNI) requested by the client from
+// configs, e.g. to serve each domain with its own certificates and
+// protocols. The keys of configs are matched as by CertificatesBySNI. The
+// clients whose server name is not in configs are served with the
+// configuration the callback is set on.
+func ConfigsBySNI(configs map[string]*tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	lower := make(map[string]*tls.Config, len(configs))
+	for k, v := range configs {
+		lower[strings.ToLower(k)] = v
+	}
+	has := func(key string) bool { _, ok := lower[key]; return ok }
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if key, ok := sniKey(hello.ServerName, has); ok {
+			return lower[key], nil
+		}
+		return nil, nil
+	}
+}
+
+// sniKey returns the key of name among keys, trying name itself, then the
+// wildcard of its parent domain. The keys must be lower case.
+func sniKey(name string, has func(key string) bool) (string, bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "" {
+		return "", false
+	}
+	if has(name) {
+		return name, true
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 && has("*"+name[i:]) {
+		return "*" + name[i:], true
+	}
+	return "", false
+}
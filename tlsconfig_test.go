@@ -0,0 +1,130 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate for names.
+func testCertificate(t *testing.T, names ...string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestCertificatesBySNI(t *testing.T) {
+	a := testCertificate(t, "a.example.com")
+	wild := testCertificate(t, "*.example.com")
+	def := testCertificate(t, "default")
+	get := CertificatesBySNI(map[string]*tls.Certificate{
+		"A.example.com": a,
+		"*.example.com": wild,
+	}, def)
+
+	for name, want := range map[string]*tls.Certificate{
+		"a.example.com":   a,
+		"A.EXAMPLE.COM.":  a,
+		"b.example.com":   wild,
+		"a.b.example.com": def,
+		"example.com":     def,
+		"":                def,
+	} {
+		cert, err := get(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert != want {
+			t.Errorf("%q: got the certificate of %v", name, cert.Leaf.DNSNames)
+		}
+	}
+
+	get = CertificatesBySNI(map[string]*tls.Certificate{"a.example.com": a}, nil)
+	if _, err := get(&tls.ClientHelloInfo{ServerName: "b.example.com"}); err != ErrNoCertificate {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConfigsBySNI(t *testing.T) {
+	a := testCertificate(t, "a.example.com")
+	b := testCertificate(t, "b.example.com")
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*a},
+		GetConfigForClient: ConfigsBySNI(map[string]*tls.Config{
+			"b.example.com": {Certificates: []tls.Certificate{*b}},
+		}),
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		errc := make(chan error, 1)
+		go func() {
+			_, err := TLSStage(config)(newPipelineConn(s))
+			errc <- err
+		}()
+		tc := tls.Client(c, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		if err := tc.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if got := tc.ConnectionState().PeerCertificates[0].DNSNames[0]; got != name {
+			t.Errorf("%q: served the certificate of %q", name, got)
+		}
+		_ = tc.Close()
+		_ = s.Close()
+	}
+}
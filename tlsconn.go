@@ -0,0 +1,82 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// WithTLSConfig makes the mux terminate TLS with config: the handshake runs
+// before the matchers, so that they see the plaintext, e.g., to tell gRPC
+// from HTTP/1 with HTTP2HeaderField and HTTP1Fast on a TLS port. The root
+// listener must then be a plain listener, not a TLS one.
+//
+// The handshake is subject to the read timeout set with SetReadTimeout, and
+// its failures are reported as ErrTLSHandshake. The matched connections are
+// *TLSMuxConns, so that their TLS state, e.g. the protocol negotiated with
+// ALPN from config.NextProtos, is available to the servers.
+//
+// A Pipeline with a TLSStage terminates TLS the same way, along with other
+// stages. The sessions are resumed as set up in config: with session
+// tickets by default, whose keys RotateTicketKeys can share between
+// replicas, with a server-side session cache by UseSessionCache, or not at
+// all with config.SessionTicketsDisabled.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(m *cMux) {
+		m.tlsConfig = config
+	}
+}
+
+// TLSMuxConn is the MuxConn of a connection wrapping a *tls.Conn, e.g., when
+// the listener passed to New is a TLS listener. Like *tls.Conn, it has the
+// ConnectionState method, so that servers looking for it, such as the
+// http2.Server of golang.org/x/net, see the state of the TLS connection
+// (e.g., the negotiated protocol) through the mux.
+type TLSMuxConn struct {
+	*MuxConn
+}
+
+// ConnectionState returns the state of the wrapped TLS connection.
+func (c *TLSMuxConn) ConnectionState() tls.ConnectionState {
+	return c.tls.ConnectionState()
+}
+
+// Handshake runs the handshake of the wrapped TLS connection, if it has not
+// run yet.
+func (c *TLSMuxConn) Handshake() error {
+	return c.tls.Handshake()
+}
+
+// HandshakeContext is like Handshake, but aborts the handshake when ctx is
+// done. It requires a *tls.Conn with HandshakeContext (Go 1.17 or later), and
+// otherwise ignores ctx.
+func (c *TLSMuxConn) HandshakeContext(ctx context.Context) error {
+	if hc, ok := interface{}(c.tls).(interface {
+		HandshakeContext(context.Context) error
+	}); ok {
+		return hc.HandshakeContext(ctx)
+	}
+	return c.tls.Handshake()
+}
+
+// accepted returns the connection delivered to the listener that matched m.
+func (m *MuxConn) accepted() net.Conn {
+	if m.tls != nil {
+		return &TLSMuxConn{MuxConn: m}
+	}
+	return m
+}
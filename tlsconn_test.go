@@ -0,0 +1,97 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestWithTLSConfig(t *testing.T) {
+	defer leakCheck(t)()
+	cert := testCertificate(t, "example.com")
+	l, cleanup := testListener(t)
+	defer cleanup()
+
+	muxl := New(l, WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}))
+	muxl.SetReadTimeout(5 * time.Second)
+	errs := make(chan error, 1)
+	muxl.HandleError(func(err error) bool {
+		errs <- err
+		return true
+	})
+	h2l := muxl.Match(HTTP2())
+	httpl := muxl.Match(HTTP1Fast())
+	go safeServe(nil, muxl)
+
+	for _, test := range []struct {
+		proto, payload string
+		l              net.Listener
+	}{
+		{"h2", http2.ClientPreface, h2l},
+		{"http/1.1", "GET / HTTP/1.1\r\n\r\n", httpl},
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = c.Close() }()
+		tc := tls.Client(c, &tls.Config{
+			ServerName:         "example.com",
+			InsecureSkipVerify: true,
+			NextProtos:         []string{test.proto},
+		})
+		go func(payload string) { _, _ = io.WriteString(tc, payload) }(test.payload)
+
+		ac, err := test.l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmc, ok := ac.(*TLSMuxConn)
+		if !ok {
+			t.Fatalf("unexpected conn: %T", ac)
+		}
+		if p := tmc.ConnectionState().NegotiatedProtocol; p != test.proto {
+			t.Errorf("unexpected protocol: want=%q got=%q", test.proto, p)
+		}
+		b := make([]byte, len(test.payload))
+		if _, err := io.ReadFull(ac, b); err != nil || string(b) != test.payload {
+			t.Errorf("unexpected plaintext: %q, %v", b, err)
+		}
+		_ = ac.Close()
+	}
+
+	// A client not speaking TLS fails the handshake.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	writeAsync(c, "GET / HTTP/1.1\r\n\r\n")
+	if err := <-errs; err == nil {
+		t.Error("no error")
+	} else if _, ok := err.(ErrTLSHandshake); !ok {
+		t.Errorf("unexpected error: %v", err)
+	}
+	cleanup()
+}
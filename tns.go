@@ -0,0 +1,60 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	tnsPacketConnect = 0x01
+	tnsHeaderLen     = 8
+	// tnsConnectFixedLen is the length of a Connect packet up to the
+	// offset of its connect data.
+	tnsConnectFixedLen = 28
+	tnsMaxConnectLen   = 8192
+)
+
+// TNS matches the connections of Oracle clients, by the TNS Connect packet
+// they send first: its header must be valid, and its connect data must hold
+// a "(CONNECT_DATA=" clause. Connect data too long for the packet, which
+// clients send in a separate packet, are not supported.
+func TNS() Matcher {
+	return func(r io.Reader) bool {
+		var hdr [tnsHeaderLen]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil ||
+			hdr[4] != tnsPacketConnect {
+			return false
+		}
+		n := int(binary.BigEndian.Uint16(hdr[:2]))
+		if n < tnsConnectFixedLen || n > tnsMaxConnectLen {
+			return false
+		}
+		p := make([]byte, n)
+		copy(p, hdr[:])
+		if _, err := io.ReadFull(r, p[tnsHeaderLen:]); err != nil {
+			return false
+		}
+		dataLen := int(binary.BigEndian.Uint16(p[24:26]))
+		dataOff := int(binary.BigEndian.Uint16(p[26:28]))
+		if dataOff < tnsConnectFixedLen || dataOff+dataLen > n {
+			return false
+		}
+		data := bytes.ToUpper(p[dataOff : dataOff+dataLen])
+		return bytes.Contains(data, []byte("(CONNECT_DATA="))
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testTNSConnect returns a TNS Connect packet carrying data.
+func testTNSConnect(data string) []byte {
+	const off = 58
+	p := make([]byte, off+len(data))
+	binary.BigEndian.PutUint16(p[0:], uint16(len(p)))
+	p[4] = tnsPacketConnect
+	binary.BigEndian.PutUint16(p[8:], 0x013a)
+	binary.BigEndian.PutUint16(p[24:], uint16(len(data)))
+	binary.BigEndian.PutUint16(p[26:], off)
+	copy(p[off:], data)
+	return p
+}
+
+func TestTNS(t *testing.T) {
+	const data = "(DESCRIPTION=(CONNECT_DATA=(SERVICE_NAME=ORCL)(CID=(PROGRAM=sqlplus)))" +
+		"(ADDRESS=(PROTOCOL=TCP)(HOST=db)(PORT=1521)))"
+	connect := testTNSConnect(data)
+	refuse := append([]byte(nil), connect...)
+	refuse[4] = 0x04
+	for _, test := range []struct {
+		name   string
+		packet []byte
+		match  bool
+	}{
+		{"connect", connect, true},
+		{"lower case", testTNSConnect("(description=(connect_data=(sid=orcl)))"), true},
+		{"no connect data", testTNSConnect("(DESCRIPTION=(ADDRESS=(HOST=db)))"), false},
+		{"truncated", connect[:len(connect)-1], false},
+		{"type", refuse, false},
+		{"http", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), false},
+	} {
+		if got := TNS()(bytes.NewReader(test.packet)); got != test.match {
+			t.Errorf("%s: want=%v got=%v", test.name, test.match, got)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"io"
+	"net"
+	"net/http"
+)
+
+// TunnelConn is a connection tunneled through an HTTP CONNECT request, as
+// accepted from a TunnelListener.
+type TunnelConn struct {
+	net.Conn
+	r io.Reader
+
+	// Request is the CONNECT request that opened the tunnel. Its Host is the
+	// requested target.
+	Request *http.Request
+}
+
+// Read reads the bytes the client sent through the tunnel, including the
+// ones it sent along with the CONNECT request.
+func (c *TunnelConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// NetConn returns the hijacked connection. Reads on the returned connection
+// bypass the bytes buffered while reading the CONNECT request.
+func (c *TunnelConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// TunnelListener is a net.Listener that accepts the tunnels opened with HTTP
+// CONNECT requests passed to Handle, so that the protocol spoken inside them
+// (e.g., TLS or SSH) can be matched by a CMux. This lets a proxy apply a
+// protocol policy to its tunnels:
+//
+//	tl := cmux.NewTunnelListener(l.Addr())
+//	go http.Serve(l, tl)
+//	m := cmux.New(tl)
+//	tlsl := m.Match(cmux.TLS())
+//	...
+//
+// Only HTTP/1 requests can be tunneled, since they must be hijacked.
+type TunnelListener struct {
+	handoffListener
+}
+
+// NewTunnelListener returns a TunnelListener whose Addr is addr, usually the
+// address of the HTTP server receiving the CONNECT requests. The connections
+// it accepts are *TunnelConns.
+func NewTunnelListener(addr net.Addr) *TunnelListener {
+	return &TunnelListener{handoffListener: newHandoffListener(addr)}
+}
+
+// Handle responds 200 to the CONNECT request r, hijacks its connection and
+// hands the tunnel over to the listener. It blocks until the tunnel is
+// accepted, and returns ErrListenerClosed, after closing the connection, if
+// the listener is closed first. Nothing is written to w if r cannot be
+// hijacked.
+func (l *TunnelListener) Handle(w http.ResponseWriter, r *http.Request) error {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return ErrNotHijackable
+	}
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(rw, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		_ = c.Close()
+		return err
+	}
+	if err := rw.Flush(); err != nil {
+		_ = c.Close()
+		return err
+	}
+
+	tc := &TunnelConn{Conn: c, r: c, Request: r}
+	if rw.Reader.Buffered() > 0 {
+		tc.r = io.MultiReader(rw.Reader, c)
+	}
+	if err := l.handoff(tc); err != nil {
+		_ = c.Close()
+		return err
+	}
+	return nil
+}
+
+// ServeHTTP calls Handle for CONNECT requests and responds 405 to any other
+// request.
+func (l *TunnelListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.Header().Set("Allow", http.MethodConnect)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := l.Handle(w, r); err == ErrNotHijackable {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTunnelListener(t *testing.T) {
+	defer leakCheck(t)()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := NewTunnelListener(l.Addr())
+	s := &http.Server{Handler: tl}
+	go func() { _ = s.Serve(l) }()
+	defer func() { _ = s.Close() }()
+
+	// The tunnels are re-muxed by their inner protocol.
+	m := New(tl)
+	sshl := m.Match(PrefixMatcher("SSH-"))
+	m.Match(Any())
+	errCh := make(chan error, 1)
+	go func() { errCh <- m.Serve() }()
+	defer func() {
+		_ = tl.Close()
+		if err := <-errCh; err != ErrListenerClosed {
+			t.Error(err)
+		}
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	// The first bytes of the tunnel are sent along with the request.
+	const hello = "SSH-2.0-test\r\n"
+	writeAsync(c, "CONNECT example.com:22 HTTP/1.1\r\nHost: example.com:22\r\n\r\n"+hello)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+
+	sc, err := sshl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = sc.Close() }()
+	tc, ok := sc.(*MuxConn).NetConn().(*TunnelConn)
+	if !ok {
+		t.Fatalf("unexpected conn: %T", sc.(*MuxConn).NetConn())
+	}
+	if tc.Request.Host != "example.com:22" {
+		t.Errorf("unexpected target: %q", tc.Request.Host)
+	}
+	b := make([]byte, len(hello))
+	if _, err := io.ReadFull(sc, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != hello {
+		t.Errorf("unexpected tunnel payload: %q", b)
+	}
+
+	if _, err := io.WriteString(sc, "SSH-2.0-server\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	_ = sc.Close()
+	b, err = ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "SSH-2.0-server\r\n" {
+		t.Errorf("unexpected response: %q", b)
+	}
+}
+
+func TestTunnelListenerNotConnect(t *testing.T) {
+	tl := NewTunnelListener(nil)
+	rec := httptest.NewRecorder()
+	tl.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	if a := rec.Header().Get("Allow"); a != http.MethodConnect {
+		t.Errorf("unexpected Allow: %q", a)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package vhost routes connections to listeners by the server name they were
+// opened for: the SNI of TLS connections and the Host header of plaintext
+// HTTP/1 connections. It works at the connection level, so the listeners can
+// be served by arbitrary backends, including ones that terminate TLS
+// themselves.
+package vhost
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/soheilhy/cmux"
+)
+
+// maxHostRead is the maximum number of bytes read to find the Host header of
+// an HTTP/1 request.
+const maxHostRead = 8192
+
+// Router routes the connections of a listener by their server name.
+//
+// Domains are matched case-insensitively. A domain of the form
+// "*.example.com" matches any name ending in ".example.com"; exact domains
+// take precedence over wildcards, and longer wildcards over shorter ones.
+type Router struct {
+	mux       cmux.CMux
+	exact     map[string]int
+	wildcards map[string]int
+	routes    int
+}
+
+// New returns a Router for the connections of l. The options are passed to
+// the underlying CMux.
+func New(l net.Listener, opts ...cmux.Option) *Router {
+	return &Router{
+		mux:       cmux.New(l, opts...),
+		exact:     make(map[string]int),
+		wildcards: make(map[string]int),
+	}
+}
+
+// Listen returns a listener for the connections whose server name matches one
+// of domains. The name of the listener, as reported by
+// cmux.MuxConn.MatchedProtocol, is name. A domain already routed to another
+// listener is taken over by this one.
+//
+// Listen must be called before Serve.
+func (r *Router) Listen(name string, domains ...string) net.Listener {
+	i := r.routes
+	r.routes++
+	for _, d := range domains {
+		d = normalize(d)
+		if strings.HasPrefix(d, "*.") {
+			r.wildcards[d[2:]] = i
+		} else {
+			r.exact[d] = i
+		}
+	}
+	return r.mux.MatchNamed(name, func(rd io.Reader) bool {
+		return r.route(serverName(rd)) == i
+	})
+}
+
+// Default returns a listener for the connections whose server name matches no
+// domain, including the ones without a server name (e.g., TLS without SNI, or
+// protocols other than TLS and HTTP/1).
+//
+// Default must be called before Serve.
+func (r *Router) Default() net.Listener {
+	return r.mux.MatchNamed("default", func(rd io.Reader) bool {
+		return r.route(serverName(rd)) < 0
+	})
+}
+
+// Mux returns the underlying CMux, e.g. to set its read timeout or error
+// handler.
+func (r *Router) Mux() cmux.CMux {
+	return r.mux
+}
+
+// Serve starts routing the connections. See cmux.CMux.Serve.
+func (r *Router) Serve() error {
+	return r.mux.Serve()
+}
+
+// Close stops the router and closes the underlying listener. See
+// cmux.CMux.Close.
+func (r *Router) Close() error {
+	return r.mux.Close()
+}
+
+// route returns the index of the listener of name, or -1 if there is none.
+func (r *Router) route(name string) int {
+	if name == "" {
+		return -1
+	}
+	if i, ok := r.exact[name]; ok {
+		return i
+	}
+	for s := name; ; {
+		dot := strings.IndexByte(s, '.')
+		if dot < 0 {
+			return -1
+		}
+		s = s[dot+1:]
+		if i, ok := r.wildcards[s]; ok {
+			return i
+		}
+	}
+}
+
+// serverName returns the normalized server name of the connection read from
+// r, or "" if it has none.
+func serverName(r io.Reader) string {
+	br := bufio.NewReader(&io.LimitedReader{R: r, N: maxHostRead})
+	b, err := br.Peek(1)
+	if err != nil {
+		return ""
+	}
+	if b[0] == 0x16 {
+		// A TLS handshake record.
+		hello, err := cmux.ParseClientHello(br)
+		if err != nil {
+			return ""
+		}
+		return normalize(hello.ServerName)
+	}
+	if b[0] < 'A' || b[0] > 'Z' {
+		// Not an HTTP method, so do not wait for a request line.
+		return ""
+	}
+	req, err := http.ReadRequest(br)
+	if err != nil || req.ProtoMajor != 1 {
+		return ""
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return normalize(host)
+}
+
+func normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package vhost
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soheilhy/cmux"
+)
+
+func TestRoute(t *testing.T) {
+	r := New(nil)
+	r.Listen("a", "example.com", "*.example.com")
+	r.Listen("b", "api.example.com", "*.internal.example.com")
+
+	for name, want := range map[string]int{
+		"example.com":            0,
+		"www.example.com":        0,
+		"a.b.example.com":        0,
+		"api.example.com":        1,
+		"x.internal.example.com": 1,
+		"internal.example.com":   0,
+		"example.org":            -1,
+		"com":                    -1,
+		"":                       -1,
+	} {
+		if got := r.route(name); got != want {
+			t.Errorf("route(%q) = %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := New(l)
+	r.Mux().SetReadTimeout(time.Second)
+	ls := map[string]net.Listener{
+		"web": r.Listen("web", "Example.com", "*.example.com"),
+		"api": r.Listen("api", "api.example.com"),
+	}
+	ls["default"] = r.Default()
+	errc := make(chan error, 1)
+	go func() { errc <- r.Serve() }()
+	defer func() {
+		_ = r.Close()
+		if err := <-errc; !strings.Contains(err.Error(), "use of closed") {
+			t.Error(err)
+		}
+	}()
+
+	for _, test := range []struct {
+		name string
+		dial func(c net.Conn)
+		want string
+	}{
+		{"tls sni", tlsDialer("api.example.com"), "api"},
+		{"tls wildcard", tlsDialer("WWW.example.com."), "web"},
+		{"tls no sni", tlsDialer(""), "default"},
+		{"http host", httpDialer("api.example.com:8080"), "api"},
+		{"http exact", httpDialer("example.com"), "web"},
+		{"http unknown", httpDialer("example.org"), "default"},
+		{"other", func(c net.Conn) { _, _ = io.WriteString(c, "\x00hello") }, "default"},
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		go test.dial(c)
+		ac, err := ls[test.want].Accept()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if p := ac.(*cmux.MuxConn).MatchedProtocol(); p != test.want {
+			t.Errorf("%s: matched %q, want %q", test.name, p, test.want)
+		}
+		_ = ac.Close()
+		_ = c.Close()
+	}
+}
+
+func tlsDialer(serverName string) func(net.Conn) {
+	return func(c net.Conn) {
+		_ = tls.Client(c, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		}).Handshake()
+	}
+}
+
+func httpDialer(host string) func(net.Conn) {
+	return func(c net.Conn) {
+		_, _ = io.WriteString(c, "GET / HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// WebSocketBinaryMessage is the message type of binary WebSocket messages,
+// as defined in RFC 6455.
+const WebSocketBinaryMessage = 2
+
+// ErrNotBinaryMessage is returned from the Read of a WebSocket connection
+// when a message that is not binary, e.g. a text message, is received, since
+// only binary messages carry the tunneled byte stream.
+var ErrNotBinaryMessage = errors.New("mux: WebSocket message is not binary")
+
+// WebSocketConn is an accepted WebSocket connection. It is implemented by
+// *websocket.Conn of github.com/gorilla/websocket.
+type WebSocketConn interface {
+	NextReader() (messageType int, r io.Reader, err error)
+	NextWriter(messageType int) (io.WriteCloser, error)
+	Close() error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// wsConn is a net.Conn tunneled over the messages of a WebSocket.
+type wsConn struct {
+	WebSocketConn
+
+	rmu sync.Mutex
+	r   io.Reader
+	// rerr is the sticky error of reading a message that is not binary.
+	rerr error
+
+	wmu sync.Mutex
+}
+
+// WebSocketNetConn returns a net.Conn that reads the payload of the binary
+// messages received on ws as a byte stream and writes each Write as one
+// binary message. Reading fails with ErrNotBinaryMessage once another type
+// of message is received.
+func WebSocketNetConn(ws WebSocketConn) net.Conn {
+	return &wsConn{WebSocketConn: ws}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if c.rerr != nil {
+		return 0, c.rerr
+	}
+	for {
+		if c.r == nil {
+			t, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if t != WebSocketBinaryMessage {
+				c.rerr = ErrNotBinaryMessage
+				return 0, c.rerr
+			}
+			c.r = r
+		}
+
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			// End of this message. Move on to the next one, unless we
+			// already have something to return.
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	w, err := c.NextWriter(WebSocketBinaryMessage)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(p)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// WebSocketListener is a net.Listener that accepts the WebSocket connections
+// passed to Handle, so that the protocol tunneled in them can be matched by a
+// CMux.
+type WebSocketListener struct {
+	handoffListener
+}
+
+// NewWebSocketListener returns a WebSocketListener whose Addr is addr,
+// usually the address of the HTTP server accepting the WebSockets.
+func NewWebSocketListener(addr net.Addr) *WebSocketListener {
+	return &WebSocketListener{handoffListener: newHandoffListener(addr)}
+}
+
+// Handle hands ws over to the listener. It blocks until the connection is
+// accepted, and returns ErrListenerClosed if the listener is closed first.
+// The connection is owned by the listener's consumer once Handle returns nil.
+func (l *WebSocketListener) Handle(ws WebSocketConn) error {
+	return l.handoff(WebSocketNetConn(ws))
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// testWebSocket is an in-memory WebSocketConn.
+type testWebSocket struct {
+	in  chan []byte
+	out chan []byte
+}
+
+type testWSWriter struct {
+	bytes.Buffer
+	ws *testWebSocket
+}
+
+func (w *testWSWriter) Close() error {
+	w.ws.out <- w.Bytes()
+	return nil
+}
+
+func (ws *testWebSocket) NextReader() (int, io.Reader, error) {
+	b, ok := <-ws.in
+	if !ok {
+		return 0, nil, io.EOF
+	}
+	return WebSocketBinaryMessage, bytes.NewReader(b), nil
+}
+
+func (ws *testWebSocket) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &testWSWriter{ws: ws}, nil
+}
+
+func (ws *testWebSocket) Close() error                     { return nil }
+func (ws *testWebSocket) LocalAddr() net.Addr              { return nil }
+func (ws *testWebSocket) RemoteAddr() net.Addr             { return nil }
+func (ws *testWebSocket) SetReadDeadline(time.Time) error  { return nil }
+func (ws *testWebSocket) SetWriteDeadline(time.Time) error { return nil }
+
+func TestWebSocket(t *testing.T) {
+	defer leakCheck(t)()
+	errCh := make(chan error)
+	defer func() {
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+	}()
+
+	wsl := NewWebSocketListener(nil)
+	muxl := New(wsl)
+	httpl := muxl.Match(HTTP1Fast())
+	muxl.Match(Any())
+	go func() {
+		if err := muxl.Serve(); err != ErrListenerClosed {
+			errCh <- err
+		}
+	}()
+	defer func() { _ = wsl.Close() }()
+
+	const payload = "GET / HTTP/1.1\r\n\r\n"
+	ws := &testWebSocket{
+		in:  make(chan []byte, 3),
+		out: make(chan []byte, 1),
+	}
+	// The request spans several messages.
+	ws.in <- []byte(payload[:2])
+	ws.in <- []byte(payload[2:5])
+	ws.in <- []byte(payload[5:])
+	close(ws.in)
+	if err := wsl.Handle(ws); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := httpl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != payload {
+		t.Errorf("unexpected payload: want=%q got=%q", payload, b)
+	}
+
+	if _, err := io.WriteString(c, "response"); err != nil {
+		t.Fatal(err)
+	}
+	if m := <-ws.out; string(m) != "response" {
+		t.Errorf("unexpected message: %q", m)
+	}
+	_ = c.Close()
+}
+
+// testTextWebSocket is a testWebSocket receiving text messages.
+type testTextWebSocket struct {
+	*testWebSocket
+}
+
+func (ws testTextWebSocket) NextReader() (int, io.Reader, error) {
+	_, r, err := ws.testWebSocket.NextReader()
+	// 1 is the type of text messages in RFC 6455.
+	return 1, r, err
+}
+
+func TestWebSocketTextMessage(t *testing.T) {
+	ws := &testWebSocket{in: make(chan []byte, 2)}
+	ws.in <- []byte("text")
+	ws.in <- []byte("more text")
+	close(ws.in)
+
+	c := WebSocketNetConn(testTextWebSocket{ws})
+	b := make([]byte, 16)
+	for i := 0; i < 2; i++ {
+		if n, err := c.Read(b); n != 0 || err != ErrNotBinaryMessage {
+			t.Fatalf("unexpected read: %q, %v", b[:n], err)
+		}
+	}
+}
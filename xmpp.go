@@ -0,0 +1,64 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// maxXMPPRead is the maximum number of bytes read to find the opening of an
+// XMPP stream.
+const maxXMPPRead = 1024
+
+// XMPP matches the XMPP connections by the opening of the stream clients
+// send first, i.e., a <stream:stream> start tag, optionally preceded by an
+// XML declaration.
+func XMPP() Matcher {
+	return func(r io.Reader) bool {
+		br := bufio.NewReaderSize(&io.LimitedReader{R: r, N: maxXMPPRead}, maxXMPPRead)
+		b, err := br.Peek(len("<?xml"))
+		if err != nil {
+			return false
+		}
+		if string(b) == "<?xml" {
+			decl, err := br.ReadString('>')
+			if err != nil || !strings.HasSuffix(decl, "?>") {
+				return false
+			}
+		}
+		const tag = "<stream:stream"
+		for {
+			c, err := br.ReadByte()
+			if err != nil {
+				return false
+			}
+			if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+				break
+			}
+		}
+		_ = br.UnreadByte()
+		b, err = br.Peek(len(tag) + 1)
+		if err != nil || string(b[:len(tag)]) != tag {
+			return false
+		}
+		switch b[len(tag)] {
+		case ' ', '\t', '\r', '\n', '>':
+			return true
+		}
+		return false
+	}
+}
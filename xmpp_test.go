@@ -0,0 +1,43 @@
+// Copyright 2016 The CMux Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package cmux
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestXMPP(t *testing.T) {
+	const stream = "<stream:stream to='example.com' xmlns='jabber:client' " +
+		"xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>"
+	for _, test := range []struct {
+		opening string
+		match   bool
+	}{
+		{stream, true},
+		{"<?xml version='1.0'?>" + stream, true},
+		{"<?xml version='1.0'?>\r\n  " + stream, true},
+		{"<stream:stream>", true},
+		{"<stream:streams>", false},
+		{"<?xml version='1.0'?><soap:Envelope>", false},
+		{"<?xml version='1.0'>" + stream, false},
+		{"<?xml version='1.0'?>", false},
+		{"GET / HTTP/1.1\r\n\r\n", false},
+	} {
+		if got := XMPP()(strings.NewReader(test.opening)); got != test.match {
+			t.Errorf("%q: want=%v got=%v", test.opening, test.match, got)
+		}
+	}
+}